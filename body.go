@@ -2,31 +2,174 @@ package nbhttp
 
 import (
 	"io"
+	"sync"
 )
 
 // BodyReader .
 type BodyReader struct {
+	// buffer is the body, offset the size read, and buf holds the array of
+	// buffer while it's borrowed from the pool
 	buffer []byte
+	offset int
+	buf    *[]byte
 }
 
 // Read implements io.Reader
 func (br *BodyReader) Read(p []byte) (int, error) {
-	n := len(p)
-	if len(br.buffer) >= n {
-		copy(p, br.buffer[:n])
-		br.buffer = br.buffer[n:]
-		return n, nil
+	n := copy(p, br.buffer[br.offset:])
+	br.offset += n
+	if n < len(p) {
+		return n, io.EOF
 	}
-	n = len(br.buffer)
-	if n > 0 {
-		copy(p, br.buffer[:n])
-		br.buffer = br.buffer[n:]
-	}
-	return n, io.EOF
+	return n, nil
 }
 
-// Close implements io. Closer
+// Close implements io. Closer, the buffer of the body is recycled.
 func (br *BodyReader) Close() error {
+	if br.buf != nil {
+		*br.buf = br.buffer
+		buffers.put(br.buf)
+		br.buf = nil
+	}
 	br.buffer = nil
+	br.offset = 0
+	return nil
+}
+
+// append adds data to the body, in a buffer borrowed from the pool.
+func (br *BodyReader) append(data []byte) {
+	if br.buf == nil && br.buffer == nil {
+		br.buf = buffers.get()
+		br.buffer = *br.buf
+	}
+	br.buffer = append(br.buffer, data...)
+}
+
+// readPauser is implemented by the connections whose reading can be paused,
+// it is used to apply back-pressure when a streaming body is consumed slower
+// than it arrives.
+type readPauser interface {
+	PauseRead() error
+	ResumeRead() error
+}
+
+// BodyPipe is the body of a streaming request, it's written by the parsing
+// goroutine and read by the handler.
+type BodyPipe struct {
+	mux  sync.Mutex
+	cond sync.Cond
+
+	buffer        []byte
+	maxBufferSize int
+	pauser        readPauser
+	paused        bool
+
+	err    error // set when the writer is done, io.EOF on success
+	closed bool  // set when the reader is done
+
+	// onConsume is called without the lock with the size of the data read
+	// or discarded by the reader, HTTP/2 replenishes its windows with it
+	onConsume func(n int)
+}
+
+func newBodyPipe(conn interface{}, maxBufferSize int) *BodyPipe {
+	bp := &BodyPipe{maxBufferSize: maxBufferSize}
+	bp.cond.L = &bp.mux
+	if pauser, ok := conn.(readPauser); ok {
+		bp.pauser = pauser
+	}
+	return bp
+}
+
+// Read implements io.Reader, it blocks until data is available or the body
+// is complete.
+func (bp *BodyPipe) Read(p []byte) (int, error) {
+	n, err := bp.read(p)
+	if n > 0 && bp.onConsume != nil {
+		bp.onConsume(n)
+	}
+	return n, err
+}
+
+func (bp *BodyPipe) read(p []byte) (int, error) {
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+
+	for len(bp.buffer) == 0 && bp.err == nil && !bp.closed {
+		bp.cond.Wait()
+	}
+	if bp.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(bp.buffer) == 0 {
+		return 0, bp.err
+	}
+
+	n := copy(p, bp.buffer)
+	bp.buffer = bp.buffer[n:]
+	if len(bp.buffer) == 0 {
+		bp.buffer = nil
+	}
+	if bp.paused && len(bp.buffer) <= bp.maxBufferSize/2 {
+		bp.paused = false
+		bp.pauser.ResumeRead()
+	}
+	return n, nil
+}
+
+// Close implements io.Closer, the rest of the body is discarded.
+func (bp *BodyPipe) Close() error {
+	bp.mux.Lock()
+	discarded := len(bp.buffer)
+	bp.closed = true
+	bp.buffer = nil
+	if bp.paused {
+		bp.paused = false
+		bp.pauser.ResumeRead()
+	}
+	bp.cond.Broadcast()
+	bp.mux.Unlock()
+
+	if discarded > 0 && bp.onConsume != nil {
+		bp.onConsume(discarded)
+	}
 	return nil
 }
+
+// write appends data to the pipe, reading from the connection is paused if
+// more than maxBufferSize bytes are waiting to be read. It returns false if
+// data is discarded since the pipe is closed.
+func (bp *BodyPipe) write(data []byte) bool {
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+
+	if bp.closed || bp.err != nil {
+		return false
+	}
+	bp.buffer = append(bp.buffer, data...)
+	if !bp.paused && bp.pauser != nil && bp.maxBufferSize > 0 && len(bp.buffer) >= bp.maxBufferSize {
+		if bp.pauser.PauseRead() == nil {
+			bp.paused = true
+		}
+	}
+	bp.cond.Broadcast()
+	return true
+}
+
+// complete reports whether the whole body has been received.
+func (bp *BodyPipe) complete() bool {
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+	return bp.err == io.EOF
+}
+
+// closeWithError ends the body, err is io.EOF if the body is complete.
+func (bp *BodyPipe) closeWithError(err error) {
+	bp.mux.Lock()
+	defer bp.mux.Unlock()
+
+	if bp.err == nil {
+		bp.err = err
+	}
+	bp.cond.Broadcast()
+}
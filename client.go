@@ -0,0 +1,488 @@
+package nbhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/net/http/httpguts"
+)
+
+const (
+	// DefaultClientTimeout .
+	DefaultClientTimeout = 30 * time.Second
+
+	// DefaultMaxIdleConnsPerHost .
+	DefaultMaxIdleConnsPerHost = 2
+)
+
+// Client sends requests on pooled keep-alive connections whose responses are
+// read by the pollers of an Engine.
+type Client struct {
+	// Engine runs the pollers of the client's connections, the client
+	// creates and owns one if nil.
+	Engine *Engine
+
+	// Timeout is the default time limit of a request, including dialing,
+	// writing the request and reading the response.
+	Timeout time.Duration
+
+	// MaxIdleConnsPerHost is the max number of idle connections kept for
+	// each host.
+	MaxIdleConnsPerHost int
+
+	// MaxReadSize is passed to each connection's Parser.
+	MaxReadSize int
+
+	// Limits bounds the size of the responses.
+	Limits Limits
+
+	// DecodeTransferEncoding makes the gzip and deflate transfer codings of
+	// the response bodies be decoded, see Parser.SetTransferDecoding.
+	DecodeTransferEncoding bool
+
+	mux         sync.Mutex
+	idle        map[string][]*clientConn
+	ownedEngine bool
+	closed      bool
+}
+
+// NewClient .
+func NewClient(engine *Engine) *Client {
+	c := &Client{
+		Engine:              engine,
+		Timeout:             DefaultClientTimeout,
+		MaxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+		MaxReadSize:         DefaultMaxReadSize,
+		idle:                map[string][]*clientConn{},
+	}
+	if c.Engine == nil {
+		c.Engine = NewEngine(0, 0)
+		c.ownedEngine = true
+	}
+	return c
+}
+
+// Start starts the Engine if it's owned by the client, it's also started by
+// the first request otherwise.
+func (c *Client) Start() error {
+	if c.ownedEngine {
+		return c.Engine.Start()
+	}
+	return nil
+}
+
+// Stop closes the idle connections, then stops the Engine if it's owned by
+// the client.
+func (c *Client) Stop() {
+	c.mux.Lock()
+	c.closed = true
+	idle := c.idle
+	c.idle = map[string][]*clientConn{}
+	c.mux.Unlock()
+
+	for _, conns := range idle {
+		for _, cc := range conns {
+			cc.conn.Close()
+		}
+	}
+	if c.ownedEngine {
+		c.Engine.Stop()
+	}
+}
+
+// Do sends req and waits for its response.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	type result struct {
+		res *http.Response
+		err error
+	}
+	done := make(chan result, 1)
+	c.DoWithTimeout(req, c.Timeout, func(res *http.Response, err error) {
+		done <- result{res, err}
+	})
+	r := <-done
+	return r.res, r.err
+}
+
+// DoAsync sends req and calls handler with its response or error.
+func (c *Client) DoAsync(req *http.Request, handler func(*http.Response, error)) {
+	c.DoWithTimeout(req, c.Timeout, handler)
+}
+
+// DoWithTimeout sends req and calls handler with its response or error, or
+// with ErrClientTimeout if the response is not complete after timeout.
+//
+// handler is called exactly once, usually on a poller goroutine, so it
+// should not block.
+func (c *Client) DoWithTimeout(req *http.Request, timeout time.Duration, handler func(*http.Response, error)) {
+	cr := &clientRequest{
+		req:     req,
+		handler: handler,
+	}
+	if timeout > 0 {
+		cr.mux.Lock()
+		cr.timer = time.AfterFunc(timeout, func() {
+			if cr.finish(nil, ErrClientTimeout) {
+				cr.mux.Lock()
+				cc := cr.conn
+				cr.mux.Unlock()
+				// the response may still arrive, so the connection can't
+				// be reused.
+				if cc != nil {
+					cc.conn.Close()
+				}
+			}
+		})
+		cr.mux.Unlock()
+	}
+
+	key, err := hostKey(req)
+	if err != nil {
+		cr.finish(nil, err)
+		return
+	}
+
+	var data bytes.Buffer
+	if err = req.Write(&data); err != nil {
+		cr.finish(nil, err)
+		return
+	}
+	cr.data = data.Bytes()
+
+	if cc := c.getIdle(key); cc != nil {
+		if cc.send(cr) == nil {
+			return
+		}
+	}
+
+	go func() {
+		cc, err := c.dial(key, timeout)
+		if err != nil {
+			cr.finish(nil, err)
+			return
+		}
+		if err = cc.send(cr); err != nil {
+			cr.finish(nil, err)
+		}
+	}()
+}
+
+func (c *Client) dial(key string, timeout time.Duration) (*clientConn, error) {
+	c.mux.Lock()
+	closed := c.closed
+	c.mux.Unlock()
+	if closed {
+		return nil, ErrClientClosed
+	}
+
+	if c.ownedEngine {
+		if err := c.Engine.Start(); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", key, timeout)
+	if err != nil {
+		return nil, err
+	}
+	cc := &clientConn{cli: c, key: key}
+	if _, err = c.Engine.addConn(conn, cc); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+func (c *Client) getIdle(key string) *clientConn {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	conns := c.idle[key]
+	for len(conns) > 0 {
+		cc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if !cc.isClosed() {
+			c.idle[key] = conns
+			return cc
+		}
+	}
+	delete(c.idle, key)
+	return nil
+}
+
+func (c *Client) putIdle(cc *clientConn) {
+	c.mux.Lock()
+	if !c.closed && len(c.idle[cc.key]) < c.MaxIdleConnsPerHost {
+		c.idle[cc.key] = append(c.idle[cc.key], cc)
+		c.mux.Unlock()
+		return
+	}
+	c.mux.Unlock()
+	cc.conn.Close()
+}
+
+func (c *Client) removeIdle(cc *clientConn) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	conns := c.idle[cc.key]
+	for i, v := range conns {
+		if v == cc {
+			c.idle[cc.key] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(c.idle[cc.key]) == 0 {
+		delete(c.idle, cc.key)
+	}
+}
+
+func hostKey(req *http.Request) (string, error) {
+	if req.URL == nil {
+		return "", fmt.Errorf("nil request URL")
+	}
+	if req.URL.Scheme != "http" {
+		return "", fmt.Errorf("unsupported protocol scheme %q", req.URL.Scheme)
+	}
+	host := req.URL.Host
+	if host == "" {
+		return "", fmt.Errorf("no Host in request URL")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
+	}
+	return host, nil
+}
+
+type clientRequest struct {
+	mux     sync.Mutex
+	req     *http.Request
+	data    []byte
+	conn    *clientConn
+	timer   *time.Timer
+	done    int32
+	handler func(*http.Response, error)
+}
+
+// finish calls the handler if it has not been called yet.
+func (cr *clientRequest) finish(res *http.Response, err error) bool {
+	if !atomic.CompareAndSwapInt32(&cr.done, 0, 1) {
+		return false
+	}
+	cr.mux.Lock()
+	timer := cr.timer
+	cr.mux.Unlock()
+	if timer != nil {
+		timer.Stop()
+	}
+	cr.handler(res, err)
+	return true
+}
+
+// clientConn is a connection of a Client, it has at most one request in
+// flight.
+type clientConn struct {
+	cli *Client
+	key string
+
+	mux     sync.Mutex
+	conn    net.Conn
+	parser  *Parser
+	pending *clientRequest
+	closed  bool
+}
+
+func (cc *clientConn) send(cr *clientRequest) error {
+	// the timer may have fired while the connection was dialed, it closes
+	// cr.conn otherwise.
+	cr.mux.Lock()
+	cr.conn = cc
+	finished := atomic.LoadInt32(&cr.done) != 0
+	cr.mux.Unlock()
+	if finished {
+		cc.conn.Close()
+		return nil
+	}
+
+	cc.mux.Lock()
+	if cc.closed {
+		cc.mux.Unlock()
+		return ErrClientClosed
+	}
+	cc.pending = cr
+	conn := cc.conn
+	parser := cc.parser
+	cc.mux.Unlock()
+
+	parser.ExpectResponse(cr.req.Method)
+
+	_, err := conn.Write(cr.data)
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+func (cc *clientConn) isClosed() bool {
+	cc.mux.Lock()
+	defer cc.mux.Unlock()
+	return cc.closed
+}
+
+func (cc *clientConn) onOpen(conn net.Conn) (*Parser, error) {
+	cc.conn = conn
+	processor := NewClientProcessor(cc.onResponse)
+	processor.(*ClientProcessor).HandleInformational(cc.onInformational)
+	parser := NewParser(conn, processor, true, cc.cli.MaxReadSize)
+	parser.SetLimits(cc.cli.Limits)
+	parser.SetTransferDecoding(cc.cli.DecodeTransferEncoding)
+	cc.parser = parser
+	return parser, nil
+}
+
+func (cc *clientConn) onData(conn net.Conn, parser *Parser, data []byte) {
+	if err := parser.Read(data); err != nil {
+		conn.Close()
+	}
+}
+
+func (cc *clientConn) onClose(conn net.Conn, parser *Parser, err error) {
+	if err == io.EOF {
+		// the end of a body read until the connection is closed, or of a
+		// truncated response
+		if e := parser.Close(); e != nil {
+			err = e
+		}
+	}
+	parser.onClose(err)
+	cc.mux.Lock()
+	cc.closed = true
+	cr := cc.pending
+	cc.pending = nil
+	cc.mux.Unlock()
+
+	cc.cli.removeIdle(cc)
+	if cr != nil {
+		if err == nil {
+			err = ErrClientClosed
+		}
+		cr.finish(nil, err)
+	}
+}
+
+func (cc *clientConn) onResponse(res *http.Response) {
+	cc.mux.Lock()
+	cr := cc.pending
+	cc.pending = nil
+	cc.mux.Unlock()
+
+	if cr == nil {
+		// unsolicited response
+		cc.conn.Close()
+		return
+	}
+
+	res.Request = cr.req
+	if res.StatusCode == http.StatusSwitchingProtocols ||
+		(cr.req.Method == http.MethodConnect && res.StatusCode/100 == 2) {
+		cc.tunnel(cr, res)
+		return
+	}
+	if res.Body == nil {
+		res.Body = http.NoBody
+	}
+	res.Close = res.ProtoMajor < 1 || (res.ProtoMajor == 1 && res.ProtoMinor == 0 &&
+		!httpguts.HeaderValuesContainsToken(res.Header["Connection"], "keep-alive")) ||
+		httpguts.HeaderValuesContainsToken(res.Header["Connection"], "close") ||
+		cr.req.Close
+	if !cr.finish(res, nil) {
+		// the request has timed out, the connection is closed by the timer
+		// unless it fired before the request was sent.
+		cc.conn.Close()
+		return
+	}
+	if res.Close {
+		cc.conn.Close()
+	} else {
+		cc.cli.putIdle(cc)
+	}
+}
+
+// onInformational passes a 1xx response to the Got1xxResponse hook of the
+// request's httptrace.ClientTrace, the request fails if the hook does.
+func (cc *clientConn) onInformational(res *http.Response) {
+	cc.mux.Lock()
+	cr := cc.pending
+	cc.mux.Unlock()
+	if cr == nil {
+		return
+	}
+	trace := httptrace.ContextClientTrace(cr.req.Context())
+	if trace == nil || trace.Got1xxResponse == nil {
+		return
+	}
+	if err := trace.Got1xxResponse(res.StatusCode, textproto.MIMEHeader(res.Header)); err != nil {
+		cr.finish(nil, err)
+		cc.conn.Close()
+	}
+}
+
+// tunnel passes the connection to the caller after a response that switches
+// it out of HTTP, the body of the response reads from and writes to it.
+func (cc *clientConn) tunnel(cr *clientRequest, res *http.Response) {
+	t := &tunnel{pipe: newBodyPipe(cc.conn, DefaultMaxBodyBufferSize), conn: cc.conn}
+	res.Body = t
+	res.Close = true
+	cc.parser.upgradeTo(tunnelUpgrader{t.pipe}, false)
+	if !cr.finish(res, nil) {
+		cc.conn.Close()
+	}
+}
+
+// tunnel is the body of a response after which the connection is a tunnel,
+// it implements io.ReadWriteCloser like the body of such a response of
+// net/http.
+type tunnel struct {
+	pipe *BodyPipe
+	conn net.Conn
+}
+
+// Read .
+func (t *tunnel) Read(p []byte) (int, error) {
+	return t.pipe.Read(p)
+}
+
+// Write .
+func (t *tunnel) Write(p []byte) (int, error) {
+	return t.conn.Write(p)
+}
+
+// Close closes the connection.
+func (t *tunnel) Close() error {
+	t.pipe.Close()
+	return t.conn.Close()
+}
+
+// tunnelUpgrader passes the data read from a tunnel to its body.
+type tunnelUpgrader struct {
+	pipe *BodyPipe
+}
+
+// Read implements Upgrader.
+func (u tunnelUpgrader) Read(p *Parser, data []byte) error {
+	u.pipe.write(data)
+	return nil
+}
+
+func (u tunnelUpgrader) onClose(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	u.pipe.closeWithError(err)
+}
@@ -0,0 +1,268 @@
+package nbhttp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, request *http.Request) {
+		io.Copy(w, request.Body)
+	})
+	svr, addr := newTestServer(t, mux)
+	defer svr.Stop()
+
+	client := NewClient(nil)
+	defer client.Stop()
+
+	for i := 0; i < 5; i++ {
+		body := strings.Repeat("hello", i*1000)
+		req, _ := http.NewRequest("POST", addr+"/echo", strings.NewReader(body))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(data) != body {
+			t.Fatalf("invalid response: %v, %v", res.StatusCode, len(data))
+		}
+	}
+	if n := client.Engine.NumConns(); n != 1 {
+		t.Fatalf("connection not reused: %v", n)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		req, _ := http.NewRequest("GET", addr+"/echo", nil)
+		client.DoAsync(req, func(res *http.Response, err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestClientTimeout(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second / 2)
+	}))
+	defer svr.Close()
+
+	client := NewClient(nil)
+	defer client.Stop()
+
+	req, _ := http.NewRequest("GET", svr.URL, nil)
+	done := make(chan error, 1)
+	client.DoWithTimeout(req, time.Second/10, func(res *http.Response, err error) {
+		done <- err
+	})
+	if err := <-done; err != ErrClientTimeout {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+}
+
+func TestClientTimeoutBeforeSend(t *testing.T) {
+	client := NewClient(nil)
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+
+	// the request times out while its connection is dialed
+	conn := &testConn{}
+	cc := &clientConn{cli: client, key: "localhost:80", conn: conn, parser: NewParser(conn, nil, true, 0)}
+	cr := &clientRequest{req: req, data: []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"), done: 1}
+	if err := cc.send(cr); err != nil || !conn.closed || conn.Len() > 0 {
+		t.Fatalf("request sent after its timeout: %v, %v, %q", err, conn.closed, conn.String())
+	}
+
+	// the response arrives after the timeout
+	conn = &testConn{}
+	cc = &clientConn{cli: client, key: "localhost:80", conn: conn, pending: &clientRequest{req: req, done: 1}}
+	cc.onResponse(&http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}})
+	if !conn.closed || len(client.idle) > 0 {
+		t.Fatalf("connection not closed after a timed out response: %v, %v", conn.closed, client.idle)
+	}
+}
+
+// newRawServer serves the requests of each connection with handle, until
+// it returns false or the connection is closed.
+func newRawServer(t *testing.T, handle func(conn net.Conn, req *http.Request) bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(r)
+					if err != nil || !handle(conn, req) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestClientReadUntilClose(t *testing.T) {
+	body := strings.Repeat("hello world ", 1000)
+	addr := newRawServer(t, func(conn net.Conn, req *http.Request) bool {
+		switch req.URL.Path {
+		case "/gzip":
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\n"))
+			w := gzip.NewWriter(conn)
+			w.Write([]byte(body))
+			w.Close()
+		case "/truncated":
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nhello"))
+		default:
+			conn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n" + body))
+		}
+		return false
+	})
+
+	client := NewClient(nil)
+	client.DecodeTransferEncoding = true
+	defer client.Stop()
+
+	for _, path := range []string{"/gzip", "/"} {
+		req, _ := http.NewRequest("GET", addr+path, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ContentLength != -1 {
+			t.Fatalf("%v: invalid content length: %v", path, res.ContentLength)
+		}
+		data, _ := io.ReadAll(res.Body)
+		if string(data) != body {
+			t.Fatalf("%v: invalid body: %v bytes", path, len(data))
+		}
+	}
+
+	req, _ := http.NewRequest("GET", addr+"/truncated", nil)
+	if _, err := client.Do(req); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestClientBodylessResponses(t *testing.T) {
+	addr := newRawServer(t, func(conn net.Conn, req *http.Request) bool {
+		switch {
+		case req.Method == http.MethodHead:
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n"))
+		case req.URL.Path == "/204":
+			conn.Write([]byte("HTTP/1.1 204 No Content\r\nTransfer-Encoding: chunked\r\n\r\n"))
+		case req.URL.Path == "/304":
+			conn.Write([]byte("HTTP/1.1 304 Not Modified\r\nContent-Length: 1000\r\n\r\n"))
+		default:
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+		}
+		return true
+	})
+
+	client := NewClient(nil)
+	client.MaxIdleConnsPerHost = 1
+	client.Timeout = 5 * time.Second
+	defer client.Stop()
+
+	for _, v := range []struct{ method, path string }{
+		{"HEAD", "/"}, {"GET", "/"}, {"GET", "/204"}, {"GET", "/"}, {"GET", "/304"}, {"GET", "/"},
+	} {
+		req, _ := http.NewRequest(v.method, addr+v.path, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v: %v", v.method, v.path, err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		expected := ""
+		if v.method == "GET" && v.path == "/" {
+			expected = "hello"
+		}
+		if string(data) != expected {
+			t.Fatalf("%v %v: invalid body: %q", v.method, v.path, data)
+		}
+	}
+}
+
+func TestClientInformationalAndTunnel(t *testing.T) {
+	addr := newRawServer(t, func(conn net.Conn, req *http.Request) bool {
+		if req.Method == http.MethodConnect {
+			conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+			buf := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return false
+				}
+				conn.Write(buf)
+			}
+		}
+		conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 103 Early Hints\r\nX-Hint: style\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+		return true
+	})
+
+	client := NewClient(nil)
+	client.Timeout = 5 * time.Second
+	defer client.Stop()
+
+	var codes []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			codes = append(codes, code)
+			return nil
+		},
+	}
+	req, _ := http.NewRequest("GET", addr, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(data) != "hello" || fmt.Sprint(codes) != "[100 103]" {
+		t.Fatalf("invalid response: %v %q, informational responses: %v", res.StatusCode, data, codes)
+	}
+
+	req, _ = http.NewRequest("CONNECT", addr, nil)
+	req.Host = "example.com:443"
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, ok := res.Body.(io.ReadWriteCloser)
+	if res.StatusCode != 200 || !ok {
+		t.Fatalf("invalid response: %v %T", res.StatusCode, res.Body)
+	}
+	defer tunnel.Close()
+	if _, err = tunnel.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("invalid data: %q, %v", buf, err)
+	}
+}
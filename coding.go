@@ -0,0 +1,88 @@
+package nbhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// the transfer codings applied to a body before chunked
+const (
+	codingUnknown int8 = iota
+	codingGzip
+	codingDeflate
+)
+
+// transferCoding returns the coding of a Transfer-Encoding element, ok is
+// false for chunked, and identity is ignored.
+func transferCoding(name []byte) (coding int8, ok bool) {
+	switch {
+	case asciiEqualFold(name, "chunked"), asciiEqualFold(name, "identity"):
+		return 0, false
+	case asciiEqualFold(name, "gzip"), asciiEqualFold(name, "x-gzip"):
+		return codingGzip, true
+	case asciiEqualFold(name, "deflate"):
+		return codingDeflate, true
+	}
+	return codingUnknown, true
+}
+
+// onBody passes data of the body to the processor, or keeps it until the
+// whole body is read if its transfer codings are decoded.
+func (p *Parser) onBody(data []byte) {
+	if p.decoding {
+		p.encoded = append(p.encoded, data...)
+		return
+	}
+	p.callbacks.OnBody(data)
+}
+
+// decodeBody decodes the body kept by onBody, the codings are undone from
+// the last one applied, and passes it to the processor. The decoded size is
+// bounded by MaxBodySize like the body itself.
+func (p *Parser) decodeBody() error {
+	encoded := p.encoded
+	p.encoded = p.encoded[:0]
+	if cap(p.encoded) > maxPooledBufferSize {
+		p.encoded = nil
+	}
+
+	var r io.Reader = bytes.NewReader(encoded)
+	for i := len(p.codings) - 1; i >= 0; i-- {
+		var err error
+		switch p.codings[i] {
+		case codingGzip:
+			r, err = gzip.NewReader(r)
+		case codingDeflate:
+			r, err = zlib.NewReader(r)
+		default:
+			return ErrUnsupportedTransferEncoding
+		}
+		if err != nil {
+			return fmt.Errorf("invalid transfer coding: %w", err)
+		}
+	}
+
+	buf := buffers.get()
+	defer buffers.put(buf)
+	data := (*buf)[:cap(*buf)]
+	size := 0
+	for {
+		n, err := r.Read(data)
+		if n > 0 {
+			size += n
+			if p.limits.MaxBodySize > 0 && size > p.limits.MaxBodySize {
+				return ErrBodyTooLarge
+			}
+			p.callbacks.OnBody(data[:n])
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid transfer coding: %w", err)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+//go:build linux
+
+package nbhttp
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Conn implements net.Conn on a non-blocking fd whose reads are driven by a
+// poller, writes that can't complete at once are buffered and flushed when
+// the fd becomes writable again.
+type Conn struct {
+	mux  sync.Mutex
+	cond sync.Cond
+
+	p  *poller
+	fd int
+
+	laddr net.Addr
+	raddr net.Addr
+
+	writeBuffer []byte
+	closing     bool
+	closed      bool
+	readPaused  bool
+	reading     bool
+
+	// closeDeferred is set if the connection was closed while the poller
+	// was reading it, the fd is then closed with closeErr by endRead.
+	closeDeferred bool
+	closeErr      error
+
+	handler connHandler
+	parser  *Parser
+
+	session interface{}
+}
+
+// Read always fails, data is delivered to the connection's Parser by the
+// poller.
+func (c *Conn) Read(b []byte) (int, error) {
+	return 0, ErrConnReadNotSupported
+}
+
+// Write .
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mux.Lock()
+	if c.closed || c.closing {
+		c.mux.Unlock()
+		return 0, net.ErrClosed
+	}
+
+	if len(c.writeBuffer) > 0 {
+		if err := c.checkWriteBufferLocked(len(b)); err != nil {
+			return 0, err
+		}
+		c.writeBuffer = append(c.writeBuffer, b...)
+		c.mux.Unlock()
+		return len(b), nil
+	}
+
+	n, err := syscall.Write(c.fd, b)
+	if err != nil && err != syscall.EAGAIN && err != syscall.EINTR {
+		c.mux.Unlock()
+		// the writer may hold locks that the onClose handlers need, such
+		// as the response queue's
+		go c.closeWithError(err)
+		return 0, err
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n < len(b) {
+		if err := c.checkWriteBufferLocked(len(b) - n); err != nil {
+			return n, err
+		}
+		c.writeBuffer = append(c.writeBuffer, b[n:]...)
+		c.updateEvents()
+	}
+	c.mux.Unlock()
+	return len(b), nil
+}
+
+// checkWriteBufferLocked closes the connection if buffering n more bytes
+// exceeds MaxWriteBufferSize, the client isn't reading. The lock is released
+// on error.
+func (c *Conn) checkWriteBufferLocked(n int) error {
+	if max := c.p.e.MaxWriteBufferSize; max <= 0 || len(c.writeBuffer)+n <= max {
+		return nil
+	}
+	c.mux.Unlock()
+	go c.closeWithError(ErrWriteBufferFull)
+	return ErrWriteBufferFull
+}
+
+// bufferedWrites returns the size of the data waiting for the fd to become
+// writable.
+func (c *Conn) bufferedWrites() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.writeBuffer)
+}
+
+// flush is called by the poller when the fd becomes writable.
+func (c *Conn) flush() {
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return
+	}
+	for len(c.writeBuffer) > 0 {
+		n, err := syscall.Write(c.fd, c.writeBuffer)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			c.mux.Unlock()
+			return
+		}
+		if err != nil {
+			c.mux.Unlock()
+			c.closeWithError(err)
+			return
+		}
+		c.writeBuffer = c.writeBuffer[n:]
+	}
+	c.writeBuffer = nil
+	closing := c.closing
+	if !closing {
+		c.updateEvents()
+	}
+	c.mux.Unlock()
+
+	if closing {
+		c.closeWithError(nil)
+	}
+}
+
+// PauseRead stops the poller from reading the connection until ResumeRead
+// is called.
+func (c *Conn) PauseRead() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.readPaused = true
+	return c.updateEvents()
+}
+
+// ResumeRead .
+func (c *Conn) ResumeRead() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.readPaused = false
+	return c.updateEvents()
+}
+
+// beginRead reports whether the poller can read the connection, and
+// whether it's paused otherwise. The read lasts until endRead.
+func (c *Conn) beginRead() (bool, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return false, false
+	}
+	if c.readPaused {
+		return false, true
+	}
+	c.reading = true
+	return true, false
+}
+
+func (c *Conn) endRead() {
+	c.mux.Lock()
+	c.reading = false
+	c.cond.Broadcast()
+	closeDeferred := c.closeDeferred
+	err := c.closeErr
+	if closeDeferred {
+		c.closeDeferred = false
+		c.closeErr = nil
+		c.p.deleteConn(c)
+		syscall.Close(c.fd)
+	}
+	c.mux.Unlock()
+
+	if closeDeferred {
+		c.p.e.onClose(c, c.parser, c.handler, err)
+	}
+}
+
+// updateEvents must be called with c.mux held.
+func (c *Conn) updateEvents() error {
+	var events uint32
+	if !c.readPaused {
+		events = epollEventsRead
+	}
+	if len(c.writeBuffer) > 0 {
+		events |= syscall.EPOLLOUT
+	}
+	return c.p.modEvents(c.fd, events)
+}
+
+// Close closes the connection after the buffered data has been written.
+func (c *Conn) Close() error {
+	c.mux.Lock()
+	if c.closed || c.closing {
+		c.mux.Unlock()
+		return nil
+	}
+	if len(c.writeBuffer) > 0 {
+		c.closing = true
+		c.mux.Unlock()
+		return nil
+	}
+	c.mux.Unlock()
+	return c.closeWithError(nil)
+}
+
+func (c *Conn) closeWithError(err error) error {
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.writeBuffer = nil
+	if c.reading {
+		// the poller may be about to read the fd, whose number can be
+		// reused by a new connection once it's closed.
+		c.closeDeferred = true
+		c.closeErr = err
+		c.mux.Unlock()
+		return nil
+	}
+	c.p.deleteConn(c)
+	closeErr := syscall.Close(c.fd)
+	c.mux.Unlock()
+
+	c.p.e.onClose(c, c.parser, c.handler, err)
+	return closeErr
+}
+
+// hijack implements hijacker, the buffered writes are written to the
+// returned connection first.
+func (c *Conn) hijack(wait bool) (net.Conn, error) {
+	c.mux.Lock()
+	if c.closed || c.closing {
+		c.mux.Unlock()
+		return nil, net.ErrClosed
+	}
+	c.closed = true
+	for wait && c.reading {
+		c.cond.Wait()
+	}
+	pending := c.writeBuffer
+	c.writeBuffer = nil
+	c.p.deleteConn(c)
+	c.mux.Unlock()
+
+	// FileConn dups the fd, which is then closed with f
+	f := os.NewFile(uintptr(c.fd), "")
+	conn, err := net.FileConn(f)
+	f.Close()
+	c.p.e.onClose(c, c.parser, c.handler, http.ErrHijacked)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		if _, err = conn.Write(pending); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// LocalAddr .
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr .
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline .
+func (c *Conn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline .
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline .
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Session returns user session
+func (c *Conn) Session() interface{} {
+	return c.session
+}
+
+// SetSession sets user session
+func (c *Conn) SetSession(session interface{}) {
+	c.session = session
+}
@@ -0,0 +1,150 @@
+//go:build linux
+
+package nbhttp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// closingHandler closes its connections from another goroutine while the
+// poller is delivering their data.
+type closingHandler struct {
+	t      *testing.T
+	fdOpen chan bool
+	closed chan error
+}
+
+func (h *closingHandler) onOpen(conn net.Conn) (*Parser, error) {
+	return nil, nil
+}
+
+func (h *closingHandler) onData(conn net.Conn, parser *Parser, data []byte) {
+	c := conn.(*Conn)
+	done := make(chan struct{})
+	go func() {
+		c.closeWithError(ErrClientClosed)
+		close(done)
+	}()
+	<-done
+	select {
+	case <-h.closed:
+		h.t.Error("connection closed while it's read")
+	default:
+	}
+	var stat syscall.Stat_t
+	h.fdOpen <- syscall.Fstat(c.fd, &stat) == nil
+}
+
+func (h *closingHandler) onClose(conn net.Conn, parser *Parser, err error) {
+	h.closed <- err
+}
+
+func TestConnCloseWhileReading(t *testing.T) {
+	engine := NewEngine(1, 0)
+	if err := engine.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &closingHandler{t: t, fdOpen: make(chan bool, 1), closed: make(chan error, 1)}
+	if _, err = engine.addConn(conn, h); err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("hello"))
+
+	if !<-h.fdOpen {
+		t.Fatal("fd closed while it's read")
+	}
+	select {
+	case err := <-h.closed:
+		if err != ErrClientClosed {
+			t.Fatalf("expected %v, got %v", ErrClientClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after the read")
+	}
+}
+
+// recordingHandler records the close error of its connections.
+type recordingHandler struct {
+	closed chan error
+}
+
+func (h *recordingHandler) onOpen(conn net.Conn) (*Parser, error) {
+	return nil, nil
+}
+
+func (h *recordingHandler) onData(conn net.Conn, parser *Parser, data []byte) {}
+
+func (h *recordingHandler) onClose(conn net.Conn, parser *Parser, err error) {
+	h.closed <- err
+}
+
+func TestConnMaxWriteBufferSize(t *testing.T) {
+	engine := NewEngine(1, 0)
+	engine.MaxWriteBufferSize = 1024 * 64
+	if err := engine.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Stop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &recordingHandler{closed: make(chan error, 1)}
+	c, err := engine.addConn(conn, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client never reads, the kernel buffers fill up first
+	data := make([]byte, 1024*16)
+	for i := 0; ; i++ {
+		if i == 1024*16 {
+			t.Fatal("write buffer not limited")
+		}
+		if _, err = c.Write(data); err != nil {
+			break
+		}
+	}
+	if err != ErrWriteBufferFull {
+		t.Fatalf("expected %v, got %v", ErrWriteBufferFull, err)
+	}
+	select {
+	case err := <-h.closed:
+		if err != ErrWriteBufferFull {
+			t.Fatalf("expected %v, got %v", ErrWriteBufferFull, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
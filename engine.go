@@ -0,0 +1,159 @@
+package nbhttp
+
+import (
+	"net"
+	"runtime"
+	"sync"
+)
+
+// connHandler handles the events of a connection added to an Engine.
+type connHandler interface {
+	// onOpen is called before the first read of the connection.
+	onOpen(conn net.Conn) (*Parser, error)
+	// onData is called with the bytes read from the connection, data is only
+	// valid during the call.
+	onData(conn net.Conn, parser *Parser, data []byte)
+	// onClose is called after the connection has been closed.
+	onClose(conn net.Conn, parser *Parser, err error)
+}
+
+// Engine runs the pollers that read from the connections of Servers and
+// Clients, it can be shared by several of them.
+type Engine struct {
+	NPoller        int
+	ReadBufferSize int
+
+	// MaxWriteBufferSize is the size of the data a connection buffers until
+	// its fd becomes writable, the connection is closed with
+	// ErrWriteBufferFull above it, no limit if 0. It must be set before
+	// Start.
+	MaxWriteBufferSize int
+
+	mux      sync.Mutex
+	wg       sync.WaitGroup
+	pollers  []*poller
+	conns    map[net.Conn]struct{}
+	next     int
+	started  bool
+	shutdown bool
+}
+
+// NewEngine .
+func NewEngine(nPoller int, readBufferSize int) *Engine {
+	if nPoller <= 0 {
+		nPoller = runtime.NumCPU()
+	}
+	if readBufferSize <= 0 {
+		readBufferSize = DefaultReadBufferSize
+	}
+	return &Engine{
+		NPoller:            nPoller,
+		ReadBufferSize:     readBufferSize,
+		MaxWriteBufferSize: DefaultMaxWriteBufferSize,
+		conns:              map[net.Conn]struct{}{},
+	}
+}
+
+// Start starts the pollers.
+func (e *Engine) Start() error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.shutdown {
+		return ErrEngineStopped
+	}
+	if e.started {
+		return nil
+	}
+
+	for i := 0; i < e.NPoller; i++ {
+		p, err := newPoller(e, i)
+		if err != nil {
+			for _, p := range e.pollers {
+				p.stop()
+			}
+			e.pollers = nil
+			return err
+		}
+		e.pollers = append(e.pollers, p)
+	}
+	for _, p := range e.pollers {
+		e.wg.Add(1)
+		go p.start()
+	}
+	e.started = true
+
+	return nil
+}
+
+// Stop closes all connections and waits for the pollers to exit.
+func (e *Engine) Stop() {
+	e.mux.Lock()
+	if e.shutdown {
+		e.mux.Unlock()
+		return
+	}
+	e.shutdown = true
+	conns := make([]net.Conn, 0, len(e.conns))
+	for c := range e.conns {
+		conns = append(conns, c)
+	}
+	e.mux.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	for _, p := range e.pollers {
+		p.stop()
+	}
+	e.wg.Wait()
+}
+
+// NumConns returns the number of open connections.
+func (e *Engine) NumConns() int {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return len(e.conns)
+}
+
+// addConn registers conn to one of the pollers, the returned net.Conn must
+// be used instead of conn afterwards.
+func (e *Engine) addConn(conn net.Conn, h connHandler) (net.Conn, error) {
+	e.mux.Lock()
+	if e.shutdown || !e.started {
+		e.mux.Unlock()
+		conn.Close()
+		return nil, ErrEngineStopped
+	}
+	p := e.pollers[e.next%len(e.pollers)]
+	e.next++
+	e.mux.Unlock()
+
+	return p.addConn(conn, h)
+}
+
+func (e *Engine) onOpen(conn net.Conn, h connHandler) (*Parser, error) {
+	e.mux.Lock()
+	if e.shutdown {
+		e.mux.Unlock()
+		return nil, ErrEngineStopped
+	}
+	e.conns[conn] = struct{}{}
+	e.mux.Unlock()
+
+	parser, err := h.onOpen(conn)
+	if err != nil {
+		e.mux.Lock()
+		delete(e.conns, conn)
+		e.mux.Unlock()
+	}
+	return parser, err
+}
+
+func (e *Engine) onClose(conn net.Conn, parser *Parser, h connHandler, err error) {
+	e.mux.Lock()
+	delete(e.conns, conn)
+	e.mux.Unlock()
+
+	h.onClose(conn, parser, err)
+}
@@ -52,9 +52,78 @@ var (
 	// ErrInvalidContentLength .
 	ErrInvalidContentLength = errors.New("invalid ContentLength")
 
+	// ErrInvalidTransferEncoding .
+	ErrInvalidTransferEncoding = errors.New("invalid transfer-encoding")
+
+	// ErrUnsupportedTransferEncoding .
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer-encoding")
+
 	// ErrInvalidChunkSize .
 	ErrInvalidChunkSize = errors.New("invalid chunk size")
 
+	// ErrInvalidChunkExtension .
+	ErrInvalidChunkExtension = errors.New("invalid chunk extension")
+
+	// ErrChunkExtensionTooLarge .
+	ErrChunkExtensionTooLarge = errors.New("chunk extension too large")
+
 	// ErrTrailerExpected .
 	ErrTrailerExpected = errors.New("trailer expected")
+
+	// ErrLineTooLarge .
+	ErrLineTooLarge = errors.New("request line or status line too large")
+
+	// ErrChunkLineTooLarge .
+	ErrChunkLineTooLarge = errors.New("chunk size line too large")
+
+	// ErrHeaderTooLarge .
+	ErrHeaderTooLarge = errors.New("header too large")
+
+	// ErrTooManyHeaders .
+	ErrTooManyHeaders = errors.New("too many headers")
+
+	// ErrBodyTooLarge .
+	ErrBodyTooLarge = errors.New("body too large")
+
+	// ErrReadLimitExceeded .
+	ErrReadLimitExceeded = errors.New("unparsed data exceeds max read size")
+
+	// ErrEngineStopped .
+	ErrEngineStopped = errors.New("engine stopped")
+
+	// ErrServerStopped .
+	ErrServerStopped = errors.New("server stopped")
+
+	// ErrConnReadNotSupported .
+	ErrConnReadNotSupported = errors.New("read is driven by the poller")
+
+	// ErrClientTimeout .
+	ErrClientTimeout = errors.New("client request timeout")
+
+	// ErrUpgradeNotSupported .
+	ErrUpgradeNotSupported = errors.New("connection can't be upgraded or hijacked")
+
+	// ErrWebsocketBadHandshake .
+	ErrWebsocketBadHandshake = errors.New("websocket: bad handshake")
+
+	// ErrWebsocketClosed .
+	ErrWebsocketClosed = errors.New("websocket: connection closed")
+
+	// ErrWebsocketInvalidMessage .
+	ErrWebsocketInvalidMessage = errors.New("websocket: invalid message type or size")
+
+	// ErrSSENotSupported .
+	ErrSSENotSupported = errors.New("sse: response can't be streamed")
+
+	// ErrSSEClosed .
+	ErrSSEClosed = errors.New("sse: stream closed")
+
+	// ErrHTTP2StreamClosed .
+	ErrHTTP2StreamClosed = errors.New("http2: stream closed")
+
+	// ErrClientClosed .
+	ErrClientClosed = errors.New("client connection closed")
+
+	// ErrWriteBufferFull .
+	ErrWriteBufferFull = errors.New("buffered writes exceed max write buffer size")
 )
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/lesismal/nbhttp"
+)
+
+var addr = flag.String("a", "localhost:8888", "listen address")
+
+func onEcho(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		io.Copy(w, r.Body)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/echo", onEcho)
+
+	svr := nbhttp.NewServer(nbhttp.Config{
+		Addrs:   []string{*addr},
+		Handler: mux,
+	})
+
+	err := svr.Start()
+	if err != nil {
+		fmt.Printf("nbhttp.Start failed: %v\n", err)
+		return
+	}
+	defer svr.Stop()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
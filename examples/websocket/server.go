@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/lesismal/nbhttp"
+)
+
+var addr = flag.String("a", "localhost:8888", "listen address")
+
+var upgrader = &nbhttp.WebsocketUpgrader{
+	OnMessage: func(c *nbhttp.WebsocketConn, messageType nbhttp.MessageType, data []byte) {
+		c.WriteMessage(messageType, data)
+	},
+	OnClose: func(c *nbhttp.WebsocketConn, err error) {
+		fmt.Printf("websocket closed: %v, %v\n", c.RemoteAddr(), err)
+	},
+}
+
+func onWebsocket(w http.ResponseWriter, r *http.Request) {
+	if _, err := upgrader.Upgrade(w, r, nil); err != nil {
+		fmt.Printf("upgrade failed: %v\n", err)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/ws", onWebsocket)
+
+	svr := nbhttp.NewServer(nbhttp.Config{
+		Addrs:   []string{*addr},
+		Handler: mux,
+	})
+
+	err := svr.Start()
+	if err != nil {
+		fmt.Printf("nbhttp.Start failed: %v\n", err)
+		return
+	}
+	defer svr.Stop()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
@@ -0,0 +1,107 @@
+package nbhttp
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+)
+
+// Executor runs the handlers of a ServerProcessor. It returns false if f
+// can't be run because the executor is overloaded, the request is then
+// answered with 503 Service Unavailable.
+//
+// A nil Executor runs the handlers inline on the parsing goroutine, which is
+// the fastest for trivial handlers, but a slow handler delays every other
+// connection of the same poller.
+type Executor func(f func()) bool
+
+// GoExecutor runs each handler on a new goroutine.
+func GoExecutor(f func()) bool {
+	go f()
+	return true
+}
+
+// WorkerPool runs the handlers on a fixed number of goroutines, with a
+// bounded queue of waiting handlers.
+type WorkerPool struct {
+	mux     sync.RWMutex
+	tasks   chan func()
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+// NewWorkerPool starts size workers, at most queueSize handlers wait for a
+// free worker before new ones are rejected.
+func NewWorkerPool(size int, queueSize int) *WorkerPool {
+	if size <= 0 {
+		size = runtime.NumCPU() * 64
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	wp := &WorkerPool{
+		tasks: make(chan func(), queueSize),
+	}
+	for i := 0; i < size; i++ {
+		wp.wg.Add(1)
+		go wp.work()
+	}
+	return wp
+}
+
+// Exec implements Executor.
+func (wp *WorkerPool) Exec(f func()) bool {
+	wp.mux.RLock()
+	defer wp.mux.RUnlock()
+	if wp.stopped {
+		return false
+	}
+	select {
+	case wp.tasks <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop rejects new handlers and waits for the queued ones to return.
+func (wp *WorkerPool) Stop() {
+	wp.mux.Lock()
+	if wp.stopped {
+		wp.mux.Unlock()
+		return
+	}
+	wp.stopped = true
+	close(wp.tasks)
+	wp.mux.Unlock()
+	wp.wg.Wait()
+}
+
+func (wp *WorkerPool) work() {
+	defer wp.wg.Done()
+	for f := range wp.tasks {
+		wp.call(f)
+	}
+}
+
+// logPanic logs the panic of a handler with its stack, except
+// http.ErrAbortHandler which aborts the response silently.
+func logPanic(err interface{}) {
+	if err == http.ErrAbortHandler {
+		return
+	}
+	const size = 64 << 10
+	buf := make([]byte, size)
+	buf = buf[:runtime.Stack(buf, false)]
+	log.Printf("nbhttp: panic serving handler: %v\n%s", err, buf)
+}
+
+func (wp *WorkerPool) call(f func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			logPanic(err)
+		}
+	}()
+	f()
+}
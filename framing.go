@@ -0,0 +1,194 @@
+package nbhttp
+
+// the headers that determine how a message is read
+const (
+	framingTransferEncoding = iota
+	framingTrailer
+	framingContentLength
+	framingConnection
+	framingUpgrade
+	framingExpect
+	numFramingHeaders
+)
+
+var framingHeaderKeys = [numFramingHeaders]string{
+	"Transfer-Encoding",
+	"Trailer",
+	"Content-Length",
+	"Connection",
+	"Upgrade",
+	"Expect",
+}
+
+// framingHeaders are the headers the parser needs to read a message. Their
+// values are copied to buf, which is reused by the next message, so that
+// they are collected without allocations whatever the processor.
+type framingHeaders struct {
+	buf    []byte
+	values [numFramingHeaders][][2]int // offsets of the values in buf
+}
+
+// framingHeader returns the id of a framing header key, matched
+// case-insensitively, or -1.
+func framingHeader(key []byte) int {
+	for id, k := range framingHeaderKeys {
+		if asciiEqualFold(key, k) {
+			return id
+		}
+	}
+	return -1
+}
+
+func (h *framingHeaders) add(id int, value []byte) {
+	start := len(h.buf)
+	h.buf = append(h.buf, value...)
+	h.values[id] = append(h.values[id], [2]int{start, len(h.buf)})
+}
+
+func (h *framingHeaders) count(id int) int {
+	return len(h.values[id])
+}
+
+func (h *framingHeaders) value(id int, i int) []byte {
+	v := h.values[id][i]
+	return h.buf[v[0]:v[1]]
+}
+
+// get returns the first value of a header, nil if it's not present.
+func (h *framingHeaders) get(id int) []byte {
+	if len(h.values[id]) == 0 {
+		return nil
+	}
+	return h.value(id, 0)
+}
+
+func (h *framingHeaders) del(id int) {
+	h.values[id] = h.values[id][:0]
+}
+
+// strings returns the values of a header, for the error messages and the
+// rarely used headers.
+func (h *framingHeaders) strings(id int) []string {
+	values := make([]string, h.count(id))
+	for i := range values {
+		values[i] = string(h.value(id, i))
+	}
+	return values
+}
+
+// containsToken reports whether a comma-separated list of the values of a
+// header contains token, like httpguts.HeaderValuesContainsToken.
+func (h *framingHeaders) containsToken(id int, token string) bool {
+	for i := 0; i < h.count(id); i++ {
+		v := h.value(id, i)
+		for len(v) > 0 {
+			elem := v
+			rest := []byte(nil)
+			for j, c := range v {
+				if c == ',' {
+					elem, rest = v[:j], v[j+1:]
+					break
+				}
+			}
+			if asciiEqualFold(trimOWS(elem), token) {
+				return true
+			}
+			v = rest
+		}
+	}
+	return false
+}
+
+func (h *framingHeaders) reset() {
+	h.buf = h.buf[:0]
+	for id := range h.values {
+		h.values[id] = h.values[id][:0]
+	}
+}
+
+// asciiEqualFold reports whether b and s are equal, ignoring the case of
+// ASCII letters.
+func asciiEqualFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		c1, c2 := b[i], s[i]
+		if c1 == c2 {
+			continue
+		}
+		if 'A' <= c1 && c1 <= 'Z' {
+			c1 += 'a' - 'A'
+		}
+		if 'A' <= c2 && c2 <= 'Z' {
+			c2 += 'a' - 'A'
+		}
+		if c1 != c2 {
+			return false
+		}
+	}
+	return true
+}
+
+// trimOWS trims the optional whitespace around b, like textproto.TrimString.
+func trimOWS(b []byte) []byte {
+	for len(b) > 0 && isOWS(b[0]) {
+		b = b[1:]
+	}
+	for len(b) > 0 && isOWS(b[len(b)-1]) {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+func isOWS(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// parseDecimal parses the digits of b, ok is false if b isn't a number
+// that fits in 63 bits.
+func parseDecimal(b []byte) (n int64, ok bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	for len(b) > 1 && b[0] == '0' {
+		b = b[1:]
+	}
+	if len(b) > 18 {
+		return 0, false
+	}
+	for _, c := range b {
+		if !isNum(c) {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	return n, true
+}
+
+// parseHex parses the hex digits of b, ok is false if b isn't a number
+// that fits in 63 bits.
+func parseHex(b []byte) (n int64, ok bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	for len(b) > 1 && b[0] == '0' {
+		b = b[1:]
+	}
+	if len(b) > 15 {
+		return 0, false
+	}
+	for _, c := range b {
+		switch {
+		case '0' <= c && c <= '9':
+			n = n<<4 | int64(c-'0')
+		case 'a' <= c && c <= 'f':
+			n = n<<4 | int64(c-'a'+10)
+		case 'A' <= c && c <= 'F':
+			n = n<<4 | int64(c-'A'+10)
+		default:
+			return 0, false
+		}
+	}
+	return n, true
+}
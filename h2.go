@@ -0,0 +1,1416 @@
+package nbhttp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/net/http/httpguts"
+	"github.com/golang/net/http2/hpack"
+)
+
+const (
+	// DefaultHTTP2MaxConcurrentStreams .
+	DefaultHTTP2MaxConcurrentStreams = 250
+
+	// DefaultHTTP2ConnWindowSize .
+	DefaultHTTP2ConnWindowSize = 1024 * 1024
+
+	// DefaultHTTP2SendBufferSize .
+	DefaultHTTP2SendBufferSize = 64 * 1024
+
+	// DefaultHTTP2MaxResetStreams .
+	DefaultHTTP2MaxResetStreams = 100
+)
+
+// HTTP2Config enables HTTP/2 on a Server: with prior knowledge or an
+// "Upgrade: h2c" request on cleartext connections, and by ALPN under TLS.
+type HTTP2Config struct {
+	// MaxConcurrentStreams is the number of requests a client can send at
+	// once on a connection, DefaultHTTP2MaxConcurrentStreams if 0. A stream
+	// counts until its handler returns, even if the client reset it.
+	MaxConcurrentStreams uint32
+
+	// MaxResetStreams is the number of streams a client can reset per
+	// second, its connection is closed with GOAWAY above it.
+	// DefaultHTTP2MaxResetStreams if 0.
+	MaxResetStreams uint32
+
+	// SendBufferSize is the size of the response body of a stream buffered
+	// beyond the flow control windows of the client, the writes of the
+	// handler wait for WINDOW_UPDATE above it. DefaultHTTP2SendBufferSize if
+	// 0.
+	SendBufferSize int
+
+	// InitialWindowSize is the flow control window of the body of each
+	// request, 65535 if 0.
+	InitialWindowSize uint32
+
+	// ConnWindowSize is the flow control window of the request bodies of a
+	// connection, DefaultHTTP2ConnWindowSize if 0.
+	ConnWindowSize uint32
+
+	// MaxFrameSize is the size of the largest frame accepted, 16384 if 0.
+	MaxFrameSize uint32
+
+	// MaxHeaderListSize limits the size of the header fields of a request,
+	// as counted by HPACK. Limits.MaxHeaderSize is used if 0.
+	MaxHeaderListSize uint32
+}
+
+func (conf HTTP2Config) withDefaults(limits Limits) HTTP2Config {
+	if conf.MaxConcurrentStreams == 0 {
+		conf.MaxConcurrentStreams = DefaultHTTP2MaxConcurrentStreams
+	}
+	if conf.MaxResetStreams == 0 {
+		conf.MaxResetStreams = DefaultHTTP2MaxResetStreams
+	}
+	if conf.SendBufferSize <= 0 {
+		conf.SendBufferSize = DefaultHTTP2SendBufferSize
+	}
+	if conf.InitialWindowSize == 0 {
+		conf.InitialWindowSize = h2DefaultWindowSize
+	} else if conf.InitialWindowSize > h2MaxWindowSize {
+		conf.InitialWindowSize = h2MaxWindowSize
+	}
+	if conf.ConnWindowSize == 0 {
+		conf.ConnWindowSize = DefaultHTTP2ConnWindowSize
+	} else if conf.ConnWindowSize < h2DefaultWindowSize {
+		conf.ConnWindowSize = h2DefaultWindowSize
+	} else if conf.ConnWindowSize > h2MaxWindowSize {
+		conf.ConnWindowSize = h2MaxWindowSize
+	}
+	if conf.MaxFrameSize < h2DefaultMaxFrameSize {
+		conf.MaxFrameSize = h2DefaultMaxFrameSize
+	} else if conf.MaxFrameSize > h2MaxFrameSize {
+		conf.MaxFrameSize = h2MaxFrameSize
+	}
+	if conf.MaxHeaderListSize == 0 && limits.MaxHeaderSize > 0 {
+		conf.MaxHeaderListSize = uint32(limits.MaxHeaderSize)
+	}
+	return conf
+}
+
+// h2ConnectionHeaders are the HTTP/1.x headers that are not valid in HTTP/2.
+var h2ConnectionHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// h2Stream is a request of an HTTP/2 connection and its response.
+type h2Stream struct {
+	id      uint32
+	request *http.Request
+	body    *BodyPipe
+
+	bodySize     int
+	remoteClosed bool // the request is complete
+	localClosed  bool // the response is complete
+	reset        bool // the stream has been closed before it completed
+
+	// a stream counts against MaxConcurrentStreams until it's forgotten
+	// and its handler isn't serving it.
+	counted   bool
+	forgotten bool
+	serving   bool
+
+	// recvWindow is the flow control window of the request body, consumed
+	// is the size of the body read by the handler since the last
+	// WINDOW_UPDATE
+	recvWindow int64
+	consumed   int64
+
+	// sendWindow is the flow control window of the response, the data that
+	// doesn't fit in it is pending, followed by trailers once pendingEnd.
+	sendWindow int64
+	pending    []byte
+	pendingEnd bool
+	trailers   []hpack.HeaderField
+}
+
+// h2HeaderBlock is the header block being read, from a HEADERS frame and
+// its CONTINUATION frames.
+type h2HeaderBlock struct {
+	stream    uint32
+	endStream bool
+	trailer   bool  // the trailers of an open stream
+	ignored   bool  // the stream is closed, the block only updates HPACK
+	refused   bool  // too many streams are open
+	err       error // a stream error found before the block was decoded
+	fields    []hpack.HeaderField
+	size      int
+	rawSize   int
+	tooLarge  bool
+}
+
+// h2Conn serves HTTP/2 on a connection, it's the Upgrader of the
+// connection's Parser. Frames are parsed as they are read, the handler is
+// called once the header of a request is complete and reads its body as it
+// arrives, the flow control windows are replenished as the body is read.
+//
+// mux guards the streams and the writes to the connection, the frames of
+// the handlers are written as they are produced, within the flow control
+// windows of the client. The handlers wait on cond while their streams have
+// more than SendBufferSize pending.
+type h2Conn struct {
+	config     HTTP2Config
+	conn       net.Conn
+	handler    http.Handler
+	executor   Executor
+	limits     Limits
+	methods    *MethodPolicy
+	remoteAddr string
+	tls        *tls.ConnectionState
+
+	// only used by Read
+	preface int // bytes of the client preface read
+	cache   []byte
+	decoder *hpack.Decoder
+	block   h2HeaderBlock
+	ready   []*h2Stream
+
+	mux               sync.Mutex
+	cond              sync.Cond
+	streams           map[uint32]*h2Stream
+	open              int // streams counted against MaxConcurrentStreams
+	lastStreamID      uint32
+	resets            uint32 // streams reset by the client since resetsStart
+	resetsStart       time.Time
+	gotSettings       bool // the first SETTINGS of the client has been read
+	settingsAcked     bool // the client applied our SETTINGS
+	prefaceSent       bool
+	closed            bool
+	encoder           *hpack.Encoder
+	encoderBuf        bytes.Buffer
+	sendWindow        int64
+	initialSendWindow int64
+	maxSendFrameSize  int
+	recvWindow        int64
+	consumed          int64
+	out               []byte
+}
+
+func newH2Conn(p *ServerProcessor, parser *Parser, config *HTTP2Config) *h2Conn {
+	c := &h2Conn{
+		config:            config.withDefaults(parser.limits),
+		conn:              p.conn,
+		handler:           p.handler,
+		executor:          p.executor,
+		limits:            parser.limits,
+		methods:           parser.methods,
+		streams:           map[uint32]*h2Stream{},
+		sendWindow:        h2DefaultWindowSize,
+		initialSendWindow: h2DefaultWindowSize,
+		maxSendFrameSize:  h2DefaultMaxFrameSize,
+	}
+	c.cond.L = &c.mux
+	c.recvWindow = int64(c.config.ConnWindowSize)
+	if p.conn != nil {
+		c.remoteAddr = p.conn.RemoteAddr().String()
+	}
+	if tlsConn, ok := p.conn.(*TLSConn); ok {
+		state := tlsConn.ConnectionState()
+		c.tls = &state
+	}
+	c.decoder = hpack.NewDecoder(4096, c.onField)
+	if c.config.MaxHeaderListSize > 0 {
+		c.decoder.SetMaxStringLength(int(c.config.MaxHeaderListSize))
+	}
+	c.encoder = hpack.NewEncoder(&c.encoderBuf)
+	return c
+}
+
+// Read implements Upgrader.
+func (c *h2Conn) Read(p *Parser, data []byte) error {
+	c.mux.Lock()
+	err := c.readLocked(data)
+	c.sendLocked()
+	ready := c.ready
+	c.ready = nil
+	c.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range ready {
+		c.serve(s)
+	}
+	return nil
+}
+
+func (c *h2Conn) readLocked(data []byte) error {
+	if c.closed {
+		return nil
+	}
+	c.sendPrefaceLocked()
+
+	for c.preface < len(h2ClientPreface) && len(data) > 0 {
+		n := len(h2ClientPreface) - c.preface
+		if n > len(data) {
+			n = len(data)
+		}
+		if string(data[:n]) != h2ClientPreface[c.preface:c.preface+n] {
+			return c.connError(h2ConnError(h2ProtocolError, "invalid client preface"))
+		}
+		c.preface += n
+		data = data[n:]
+	}
+
+	buf := data
+	if len(c.cache) > 0 {
+		c.cache = append(c.cache, data...)
+		buf = c.cache
+	}
+	for len(buf) >= h2FrameHeaderLen {
+		length, f := parseH2FrameHeader(buf)
+		if length > c.config.MaxFrameSize {
+			return c.connError(h2ConnError(h2FrameSizeError, "frame too large"))
+		}
+		end := h2FrameHeaderLen + int(length)
+		if len(buf) < end {
+			break
+		}
+		f.payload = buf[h2FrameHeaderLen:end]
+		buf = buf[end:]
+		if err := c.handleFrame(&f); err != nil {
+			he, ok := err.(*h2Error)
+			if !ok || he.stream == 0 {
+				return c.connError(err)
+			}
+			c.resetStreamLocked(he.stream, he.code)
+		}
+		if c.closed {
+			return nil
+		}
+	}
+	// overlapping copies are fine for append
+	c.cache = append(c.cache[:0], buf...)
+	return nil
+}
+
+// connError sends GOAWAY, the connection is then closed by the caller of
+// Read.
+func (c *h2Conn) connError(err error) error {
+	code := h2ProtocolError
+	if he, ok := err.(*h2Error); ok {
+		code = he.code
+	}
+	c.out = appendH2GoAway(c.out, c.lastStreamID, code)
+	c.closed = true
+	return err
+}
+
+func (c *h2Conn) handleFrame(f *h2Frame) error {
+	if c.block.stream != 0 && f.typ != h2FrameContinuation {
+		return h2ConnError(h2ProtocolError, "CONTINUATION expected")
+	}
+	if !c.gotSettings && (f.typ != h2FrameSettings || f.has(h2FlagAck)) {
+		return h2ConnError(h2ProtocolError, "SETTINGS expected")
+	}
+
+	switch f.typ {
+	case h2FrameData:
+		return c.onData(f)
+	case h2FrameHeaders:
+		return c.onHeaders(f)
+	case h2FrameContinuation:
+		if c.block.stream == 0 || f.stream != c.block.stream {
+			return h2ConnError(h2ProtocolError, "unexpected CONTINUATION")
+		}
+		return c.onHeaderFragment(f.payload, f.has(h2FlagEndHeaders))
+	case h2FramePriority:
+		if f.stream == 0 {
+			return h2ConnError(h2ProtocolError, "PRIORITY on stream 0")
+		}
+		if len(f.payload) != 5 {
+			return h2StreamError(f.stream, h2FrameSizeError, "invalid PRIORITY length")
+		}
+	case h2FrameRSTStream:
+		if len(f.payload) != 4 {
+			return h2ConnError(h2FrameSizeError, "invalid RST_STREAM length")
+		}
+		if f.stream == 0 || f.stream > c.lastStreamID {
+			return h2ConnError(h2ProtocolError, "RST_STREAM on idle stream")
+		}
+		if s := c.streams[f.stream]; s != nil {
+			c.abortStreamLocked(s)
+			if c.tooManyResetsLocked() {
+				return h2ConnError(h2EnhanceYourCalm, "too many reset streams")
+			}
+		}
+	case h2FrameSettings:
+		return c.onSettings(f)
+	case h2FramePushPromise:
+		return h2ConnError(h2ProtocolError, "PUSH_PROMISE from a client")
+	case h2FramePing:
+		if f.stream != 0 {
+			return h2ConnError(h2ProtocolError, "PING on a stream")
+		}
+		if len(f.payload) != 8 {
+			return h2ConnError(h2FrameSizeError, "invalid PING length")
+		}
+		if !f.has(h2FlagAck) {
+			c.out = appendH2Frame(c.out, h2FramePing, h2FlagAck, 0, f.payload)
+		}
+	case h2FrameGoAway:
+		if f.stream != 0 {
+			return h2ConnError(h2ProtocolError, "GOAWAY on a stream")
+		}
+		if len(f.payload) < 8 {
+			return h2ConnError(h2FrameSizeError, "invalid GOAWAY length")
+		}
+		// the client sends no more requests, the open ones are served
+	case h2FrameWindowUpdate:
+		return c.onWindowUpdate(f)
+	}
+	// unknown frames are ignored
+	return nil
+}
+
+// tooManyResetsLocked counts a stream reset by the client, it reports
+// whether the client resets more than MaxResetStreams per second.
+func (c *h2Conn) tooManyResetsLocked() bool {
+	now := time.Now()
+	if now.Sub(c.resetsStart) >= time.Second {
+		c.resetsStart = now
+		c.resets = 0
+	}
+	c.resets++
+	return c.resets > c.config.MaxResetStreams
+}
+
+func (c *h2Conn) onSettings(f *h2Frame) error {
+	if f.stream != 0 {
+		return h2ConnError(h2ProtocolError, "SETTINGS on a stream")
+	}
+	if f.has(h2FlagAck) {
+		if len(f.payload) != 0 {
+			return h2ConnError(h2FrameSizeError, "SETTINGS ack with a payload")
+		}
+		c.settingsAcked = true
+		return nil
+	}
+	settings, err := parseH2Settings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := c.applySettings(settings); err != nil {
+		return err
+	}
+	c.gotSettings = true
+	c.out = appendH2FrameHeader(c.out, 0, h2FrameSettings, h2FlagAck, 0)
+	return nil
+}
+
+// applySettings applies the SETTINGS of the client.
+func (c *h2Conn) applySettings(settings []h2Setting) error {
+	for _, s := range settings {
+		switch s.id {
+		case h2SettingHeaderTableSize:
+			c.encoder.SetMaxDynamicTableSize(s.value)
+		case h2SettingEnablePush:
+			if s.value > 1 {
+				return h2ConnError(h2ProtocolError, "invalid SETTINGS_ENABLE_PUSH")
+			}
+		case h2SettingInitialWindowSize:
+			if s.value > h2MaxWindowSize {
+				return h2ConnError(h2FlowControlError, "invalid SETTINGS_INITIAL_WINDOW_SIZE")
+			}
+			delta := int64(s.value) - c.initialSendWindow
+			c.initialSendWindow = int64(s.value)
+			for _, st := range c.streams {
+				st.sendWindow += delta
+				if st.sendWindow > h2MaxWindowSize {
+					return h2ConnError(h2FlowControlError, "window overflow")
+				}
+			}
+		case h2SettingMaxFrameSize:
+			if s.value < h2DefaultMaxFrameSize || s.value > h2MaxFrameSize {
+				return h2ConnError(h2ProtocolError, "invalid SETTINGS_MAX_FRAME_SIZE")
+			}
+			c.maxSendFrameSize = int(s.value)
+		}
+	}
+	for _, st := range c.streams {
+		c.flushStreamLocked(st)
+	}
+	return nil
+}
+
+func (c *h2Conn) onWindowUpdate(f *h2Frame) error {
+	if len(f.payload) != 4 {
+		return h2ConnError(h2FrameSizeError, "invalid WINDOW_UPDATE length")
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+	if f.stream == 0 {
+		if increment == 0 {
+			return h2ConnError(h2ProtocolError, "zero WINDOW_UPDATE")
+		}
+		c.sendWindow += increment
+		if c.sendWindow > h2MaxWindowSize {
+			return h2ConnError(h2FlowControlError, "window overflow")
+		}
+		for _, s := range c.streams {
+			c.flushStreamLocked(s)
+		}
+		return nil
+	}
+
+	if f.stream > c.lastStreamID {
+		return h2ConnError(h2ProtocolError, "WINDOW_UPDATE on idle stream")
+	}
+	s := c.streams[f.stream]
+	if s == nil {
+		return nil
+	}
+	if increment == 0 {
+		return h2StreamError(s.id, h2ProtocolError, "zero WINDOW_UPDATE")
+	}
+	s.sendWindow += increment
+	if s.sendWindow > h2MaxWindowSize {
+		return h2StreamError(s.id, h2FlowControlError, "window overflow")
+	}
+	c.flushStreamLocked(s)
+	return nil
+}
+
+func (c *h2Conn) onHeaders(f *h2Frame) error {
+	id := f.stream
+	if id == 0 || id%2 == 0 {
+		return h2ConnError(h2ProtocolError, "invalid stream id")
+	}
+	payload, err := f.unpad()
+	if err != nil {
+		return err
+	}
+	if f.has(h2FlagPriority) {
+		if len(payload) < 5 {
+			return h2ConnError(h2FrameSizeError, "HEADERS too short")
+		}
+		payload = payload[5:]
+	}
+
+	block := h2HeaderBlock{stream: id, endStream: f.has(h2FlagEndStream)}
+	if s := c.streams[id]; s != nil {
+		block.trailer = true
+		if s.remoteClosed {
+			block.err = h2StreamError(id, h2StreamClosed, "HEADERS on a half-closed stream")
+		} else if !block.endStream {
+			block.err = h2StreamError(id, h2ProtocolError, "trailers without END_STREAM")
+		}
+	} else if id <= c.lastStreamID {
+		block.ignored = true
+	} else {
+		c.lastStreamID = id
+		if uint32(c.open) >= c.config.MaxConcurrentStreams {
+			block.refused = true
+		} else {
+			c.streams[id] = &h2Stream{
+				id:         id,
+				sendWindow: c.initialSendWindow,
+				recvWindow: int64(c.config.InitialWindowSize),
+				counted:    true,
+			}
+			c.open++
+		}
+	}
+	c.block = block
+	return c.onHeaderFragment(payload, f.has(h2FlagEndHeaders))
+}
+
+// onHeaderFragment decodes a part of the header block, the block is always
+// decoded to keep the HPACK state of the connection.
+func (c *h2Conn) onHeaderFragment(payload []byte, end bool) error {
+	c.block.rawSize += len(payload)
+	if max := int(c.config.MaxHeaderListSize); max > 0 && c.block.rawSize > 2*max {
+		return h2ConnError(h2EnhanceYourCalm, "header block too large")
+	}
+	if _, err := c.decoder.Write(payload); err != nil {
+		return h2ConnError(h2CompressionError, err.Error())
+	}
+	if !end {
+		return nil
+	}
+	if err := c.decoder.Close(); err != nil {
+		return h2ConnError(h2CompressionError, err.Error())
+	}
+	block := c.block
+	c.block = h2HeaderBlock{}
+	return c.endHeaders(&block)
+}
+
+// onField is the emit func of the HPACK decoder.
+func (c *h2Conn) onField(f hpack.HeaderField) {
+	b := &c.block
+	if b.tooLarge || b.ignored {
+		return
+	}
+	b.size += int(f.Size())
+	if max := int(c.config.MaxHeaderListSize); max > 0 && b.size > max {
+		b.tooLarge = true
+	}
+	if max := c.limits.MaxHeaderCount; max > 0 && len(b.fields) >= max {
+		b.tooLarge = true
+	}
+	if b.tooLarge {
+		b.fields = nil
+		return
+	}
+	b.fields = append(b.fields, f)
+}
+
+func (c *h2Conn) endHeaders(b *h2HeaderBlock) error {
+	switch {
+	case b.ignored:
+		return nil
+	case b.refused:
+		return h2StreamError(b.stream, h2RefusedStream, "too many concurrent streams")
+	case b.err != nil:
+		return b.err
+	}
+
+	s := c.streams[b.stream]
+	if b.trailer {
+		if b.tooLarge {
+			return h2StreamError(s.id, h2ProtocolError, "trailers too large")
+		}
+		for _, f := range b.fields {
+			if f.IsPseudo() || !validH2FieldName(f.Name) || !httpguts.ValidHeaderFieldValue(f.Value) {
+				return h2StreamError(s.id, h2ProtocolError, "invalid trailer")
+			}
+			if s.request.Trailer == nil {
+				s.request.Trailer = http.Header{}
+			}
+			s.request.Trailer.Add(http.CanonicalHeaderKey(f.Name), f.Value)
+		}
+		return c.endStream(s)
+	}
+
+	if b.tooLarge {
+		s.remoteClosed = b.endStream
+		c.respondLocked(s, http.StatusRequestHeaderFieldsTooLarge)
+		return nil
+	}
+	request, err := c.newRequest(b)
+	if err != nil {
+		return h2StreamError(s.id, h2ProtocolError, err.Error())
+	}
+	s.request = request
+	if b.endStream {
+		return c.endStream(s)
+	}
+	if max := c.limits.MaxBodySize; max > 0 && request.ContentLength > int64(max) {
+		c.respondLocked(s, http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	// the handler is called at once and reads the body as it arrives
+	s.body = newBodyPipe(nil, 0)
+	s.body.onConsume = func(n int) {
+		c.consume(s, n)
+	}
+	request.Body = s.body
+	s.serving = true
+	c.ready = append(c.ready, s)
+	return nil
+}
+
+func (c *h2Conn) onData(f *h2Frame) error {
+	if f.stream == 0 {
+		return h2ConnError(h2ProtocolError, "DATA on stream 0")
+	}
+	// the whole payload counts for flow control, the windows are
+	// replenished as the handler reads the body
+	n := int64(len(f.payload))
+	if n > c.recvWindow {
+		return h2ConnError(h2FlowControlError, "connection window exceeded")
+	}
+	c.recvWindow -= n
+
+	s := c.streams[f.stream]
+	if s == nil {
+		if f.stream > c.lastStreamID {
+			return h2ConnError(h2ProtocolError, "DATA on idle stream")
+		}
+		// the stream has been reset
+		c.consumeLocked(nil, n)
+		return nil
+	}
+	if s.remoteClosed || s.request == nil {
+		c.consumeLocked(nil, n)
+		return h2StreamError(s.id, h2StreamClosed, "DATA on a half-closed stream")
+	}
+	window := s.recvWindow
+	if !c.settingsAcked && c.config.InitialWindowSize < h2DefaultWindowSize {
+		// the client may not have applied our SETTINGS yet
+		window += int64(h2DefaultWindowSize - c.config.InitialWindowSize)
+	}
+	if n > window {
+		c.consumeLocked(nil, n)
+		return h2StreamError(s.id, h2FlowControlError, "stream window exceeded")
+	}
+	s.recvWindow -= n
+	data, err := f.unpad()
+	if err != nil {
+		return err
+	}
+
+	s.bodySize += len(data)
+	if cl := s.request.ContentLength; cl >= 0 && int64(s.bodySize) > cl {
+		c.consumeLocked(nil, n)
+		return h2StreamError(s.id, h2ProtocolError, "body exceeds content-length")
+	}
+	if c.limits.MaxBodySize > 0 && s.bodySize > c.limits.MaxBodySize {
+		// the rest of the body is discarded, and the stream is reset once
+		// the handler responded
+		s.body.closeWithError(ErrBodyTooLarge)
+	}
+	if s.body.write(data) {
+		// the padding is consumed at once
+		c.consumeLocked(s, n-int64(len(data)))
+	} else {
+		// the window of the stream is not replenished with the discarded
+		// data, the client stops sending it
+		c.consumeLocked(nil, n)
+	}
+
+	if f.has(h2FlagEndStream) {
+		return c.endStream(s)
+	}
+	return nil
+}
+
+// endStream completes the request of s, the handler of a request without a
+// body is called once the frames read have been processed.
+func (c *h2Conn) endStream(s *h2Stream) error {
+	s.remoteClosed = true
+	request := s.request
+	if request.ContentLength >= 0 && int64(s.bodySize) != request.ContentLength {
+		return h2StreamError(s.id, h2ProtocolError, "body shorter than content-length")
+	}
+	if s.body != nil {
+		s.body.closeWithError(io.EOF)
+		return nil
+	}
+	request.Body = http.NoBody
+	request.ContentLength = 0
+	s.serving = true
+	c.ready = append(c.ready, s)
+	return nil
+}
+
+// consumeLocked returns n bytes of the request bodies to the windows of the
+// connection and of s if it's not nil, they are replenished by a
+// WINDOW_UPDATE once half of them is consumed.
+func (c *h2Conn) consumeLocked(s *h2Stream, n int64) {
+	if n <= 0 || c.closed {
+		return
+	}
+	c.consumed += n
+	if c.consumed >= int64(c.config.ConnWindowSize/2) {
+		c.out = appendH2WindowUpdate(c.out, 0, uint32(c.consumed))
+		c.recvWindow += c.consumed
+		c.consumed = 0
+	}
+	if s == nil || s.remoteClosed || s.reset {
+		return
+	}
+	s.consumed += n
+	if s.consumed >= int64(c.config.InitialWindowSize/2) {
+		c.out = appendH2WindowUpdate(c.out, s.id, uint32(s.consumed))
+		s.recvWindow += s.consumed
+		s.consumed = 0
+	}
+}
+
+// consume is called when the handler of s reads or closes its body.
+func (c *h2Conn) consume(s *h2Stream, n int) {
+	c.mux.Lock()
+	c.consumeLocked(s, int64(n))
+	c.sendLocked()
+	c.mux.Unlock()
+}
+
+func validH2FieldName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if b := name[i]; b >= 'A' && b <= 'Z' {
+			return false
+		}
+	}
+	return httpguts.ValidHeaderFieldName(name)
+}
+
+// newRequest builds the request of a header block, it fails if the request
+// is malformed.
+func (c *h2Conn) newRequest(b *h2HeaderBlock) (*http.Request, error) {
+	var method, scheme, path, authority string
+	header := http.Header{}
+	regular := false
+	for _, f := range b.fields {
+		if f.IsPseudo() {
+			if regular {
+				return nil, errH2Malformed("pseudo-header after a regular header")
+			}
+			var dst *string
+			switch f.Name {
+			case ":method":
+				dst = &method
+			case ":scheme":
+				dst = &scheme
+			case ":path":
+				dst = &path
+			case ":authority":
+				dst = &authority
+			default:
+				return nil, errH2Malformed("invalid pseudo-header " + f.Name)
+			}
+			if *dst != "" {
+				return nil, errH2Malformed("duplicate pseudo-header " + f.Name)
+			}
+			*dst = f.Value
+			continue
+		}
+		regular = true
+		if !validH2FieldName(f.Name) || !httpguts.ValidHeaderFieldValue(f.Value) {
+			return nil, errH2Malformed("invalid header field")
+		}
+		key := http.CanonicalHeaderKey(f.Name)
+		if h2ConnectionHeaders[key] {
+			return nil, errH2Malformed("connection-specific header " + f.Name)
+		}
+		if key == "Te" && f.Value != "trailers" {
+			return nil, errH2Malformed("invalid te header")
+		}
+		header.Add(key, f.Value)
+	}
+
+	m, ok := c.methods.lookup([]byte(method))
+	if !ok {
+		return nil, ErrInvalidMethod
+	}
+	method = m
+	isConnect := method == http.MethodConnect
+	if isConnect {
+		if scheme != "" || path != "" || authority == "" {
+			return nil, errH2Malformed("invalid CONNECT request")
+		}
+	} else if scheme == "" || path == "" {
+		return nil, errH2Malformed("missing pseudo-header")
+	}
+	if cookies := header["Cookie"]; len(cookies) > 1 {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	var u *url.URL
+	var err error
+	if isConnect {
+		u = &url.URL{Host: authority}
+		path = authority
+	} else if u, err = url.ParseRequestURI(path); err != nil {
+		return nil, err
+	}
+	if authority == "" {
+		authority = header.Get("Host")
+	}
+	if u.Host == "" {
+		u.Host = authority
+	}
+
+	request := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        header,
+		ContentLength: -1,
+		Host:          authority,
+		RemoteAddr:    c.remoteAddr,
+		RequestURI:    path,
+		TLS:           c.tls,
+	}
+	if v := header.Get("Content-Length"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 63)
+		if err != nil {
+			return nil, ErrInvalidContentLength
+		}
+		request.ContentLength = int64(n)
+	}
+	return request, nil
+}
+
+func errH2Malformed(reason string) error {
+	return errors.New("malformed request: " + reason)
+}
+
+// serve runs the handler of a request with the executor, or on a new
+// goroutine if it's nil since its body is fed by the parsing goroutine and
+// its writes wait for the client's WINDOW_UPDATE.
+func (c *h2Conn) serve(s *h2Stream) {
+	w := &h2Response{conn: c, stream: s, request: s.request, header: http.Header{}}
+	f := func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logPanic(err)
+				w.abort()
+			}
+			w.finish()
+			s.request.Body.Close()
+		}()
+		c.handler.ServeHTTP(w, s.request)
+	}
+	if c.executor == nil {
+		go f()
+		return
+	}
+	if !c.executor(f) {
+		// overloaded
+		s.request.Body.Close()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.finish()
+	}
+}
+
+// sendPrefaceLocked queues the SETTINGS of the server, which must be its
+// first frame.
+func (c *h2Conn) sendPrefaceLocked() {
+	if c.prefaceSent {
+		return
+	}
+	c.prefaceSent = true
+	settings := []h2Setting{{h2SettingMaxConcurrentStreams, c.config.MaxConcurrentStreams}}
+	if c.config.InitialWindowSize != h2DefaultWindowSize {
+		settings = append(settings, h2Setting{h2SettingInitialWindowSize, c.config.InitialWindowSize})
+	}
+	if c.config.MaxFrameSize != h2DefaultMaxFrameSize {
+		settings = append(settings, h2Setting{h2SettingMaxFrameSize, c.config.MaxFrameSize})
+	}
+	if c.config.MaxHeaderListSize > 0 {
+		settings = append(settings, h2Setting{h2SettingMaxHeaderListSize, c.config.MaxHeaderListSize})
+	}
+	c.out = appendH2Settings(c.out, settings)
+	if c.config.ConnWindowSize > h2DefaultWindowSize {
+		c.out = appendH2WindowUpdate(c.out, 0, c.config.ConnWindowSize-h2DefaultWindowSize)
+	}
+}
+
+// sendLocked writes the queued frames to the connection.
+func (c *h2Conn) sendLocked() {
+	if len(c.out) == 0 {
+		return
+	}
+	c.conn.Write(c.out)
+	c.out = c.out[:0]
+}
+
+// writeHeadersLocked queues a header block, split into CONTINUATION frames
+// if it's larger than the frames the client accepts.
+func (c *h2Conn) writeHeadersLocked(s *h2Stream, fields []hpack.HeaderField, endStream bool) {
+	c.encoderBuf.Reset()
+	for _, f := range fields {
+		c.encoder.WriteField(f)
+	}
+	block := c.encoderBuf.Bytes()
+	typ := h2FrameHeaders
+	flags := uint8(0)
+	if endStream {
+		flags = h2FlagEndStream
+		s.localClosed = true
+	}
+	for {
+		n := len(block)
+		if n > c.maxSendFrameSize {
+			n = c.maxSendFrameSize
+		} else {
+			flags |= h2FlagEndHeaders
+		}
+		c.out = appendH2Frame(c.out, typ, flags, s.id, block[:n])
+		block = block[n:]
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = h2FrameContinuation, 0
+	}
+	if s.localClosed {
+		c.closeStreamLocked(s)
+	}
+}
+
+// flushStreamLocked queues the pending data of s that fits in the windows,
+// then its trailers.
+func (c *h2Conn) flushStreamLocked(s *h2Stream) {
+	if s.localClosed || s.reset {
+		return
+	}
+	for len(s.pending) > 0 {
+		n := int64(len(s.pending))
+		if n > int64(c.maxSendFrameSize) {
+			n = int64(c.maxSendFrameSize)
+		}
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > c.sendWindow {
+			n = c.sendWindow
+		}
+		if n <= 0 {
+			return
+		}
+		flags := uint8(0)
+		if int(n) == len(s.pending) && s.pendingEnd && len(s.trailers) == 0 {
+			flags = h2FlagEndStream
+			s.localClosed = true
+		}
+		c.out = appendH2Frame(c.out, h2FrameData, flags, s.id, s.pending[:n])
+		s.pending = s.pending[n:]
+		s.sendWindow -= n
+		c.sendWindow -= n
+		c.cond.Broadcast()
+	}
+	s.pending = nil
+	if s.pendingEnd && !s.localClosed {
+		if len(s.trailers) > 0 {
+			c.writeHeadersLocked(s, s.trailers, true)
+			return
+		}
+		c.out = appendH2FrameHeader(c.out, 0, h2FrameData, h2FlagEndStream, s.id)
+		s.localClosed = true
+	}
+	if s.localClosed {
+		c.closeStreamLocked(s)
+	}
+}
+
+// closeStreamLocked forgets a stream whose response is complete, the rest
+// of its request is refused if it's still being sent.
+func (c *h2Conn) closeStreamLocked(s *h2Stream) {
+	if !s.remoteClosed {
+		c.out = appendH2RSTStream(c.out, s.id, h2NoError)
+		c.abortStreamLocked(s)
+		return
+	}
+	c.forgetStreamLocked(s)
+}
+
+// forgetStreamLocked removes a closed stream, it stops counting against
+// MaxConcurrentStreams once its handler returned.
+func (c *h2Conn) forgetStreamLocked(s *h2Stream) {
+	delete(c.streams, s.id)
+	s.forgotten = true
+	c.releaseStreamLocked(s)
+}
+
+func (c *h2Conn) releaseStreamLocked(s *h2Stream) {
+	if s.counted && s.forgotten && !s.serving {
+		s.counted = false
+		c.open--
+	}
+}
+
+func (c *h2Conn) resetStreamLocked(id uint32, code uint32) {
+	c.out = appendH2RSTStream(c.out, id, code)
+	if s := c.streams[id]; s != nil {
+		c.abortStreamLocked(s)
+	}
+}
+
+// abortStreamLocked forgets a stream closed before its request is complete,
+// the handler reading its body gets an error.
+func (c *h2Conn) abortStreamLocked(s *h2Stream) {
+	s.reset = true
+	if s.body != nil {
+		s.body.closeWithError(ErrHTTP2StreamClosed)
+	}
+	c.forgetStreamLocked(s)
+	c.cond.Broadcast()
+}
+
+// respondLocked answers a request that can't be passed to the handler.
+func (c *h2Conn) respondLocked(s *h2Stream, statusCode int) {
+	c.writeHeadersLocked(s, []hpack.HeaderField{
+		{Name: ":status", Value: strconv.Itoa(statusCode)},
+		{Name: "content-length", Value: "0"},
+	}, true)
+}
+
+// serveUpgrade serves the request of an "Upgrade: h2c" request as stream 1,
+// once the 101 response has been written.
+func (c *h2Conn) serveUpgrade(s *h2Stream) {
+	c.mux.Lock()
+	c.sendPrefaceLocked()
+	c.sendLocked()
+	c.mux.Unlock()
+	c.serve(s)
+}
+
+func (c *h2Conn) onClose(err error) {
+	c.mux.Lock()
+	c.closed = true
+	for _, s := range c.streams {
+		s.reset = true
+		if s.body != nil {
+			s.body.closeWithError(ErrHTTP2StreamClosed)
+		}
+	}
+	c.streams = map[uint32]*h2Stream{}
+	c.cond.Broadcast()
+	c.mux.Unlock()
+}
+
+// h2Response is the http.ResponseWriter of an HTTP/2 request. The body is
+// buffered like the one of a Response, Flush sends it as DATA frames.
+type h2Response struct {
+	conn    *h2Conn
+	stream  *h2Stream
+	request *http.Request
+
+	statusCode  int
+	header      http.Header
+	trailers    http.Header // announced trailers
+	body        []byte
+	wroteHeader bool
+	bodyAllowed bool
+	finished    bool
+}
+
+// Header .
+func (w *h2Response) Header() http.Header {
+	return w.header
+}
+
+// Write . The data is flushed as the buffer fills up, so that the pending
+// data of the stream stays within SendBufferSize.
+func (w *h2Response) Write(data []byte) (int, error) {
+	if w.finished {
+		return 0, ErrHTTP2StreamClosed
+	}
+	w.WriteHeader(http.StatusOK)
+	written := 0
+	for len(data) > 0 {
+		n := DefaultResponseBufferSize - len(w.body)
+		if n > len(data) {
+			n = len(data)
+		}
+		w.body = append(w.body, data[:n]...)
+		data = data[n:]
+		if len(w.body) >= DefaultResponseBufferSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// WriteString .
+func (w *h2Response) WriteString(s string) (int, error) {
+	if w.finished {
+		return 0, ErrHTTP2StreamClosed
+	}
+	if len(s) > DefaultResponseBufferSize {
+		return w.Write([]byte(s))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.body = append(w.body, s...)
+	if len(w.body) >= DefaultResponseBufferSize {
+		if err := w.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(s), nil
+}
+
+// WriteHeader . A 1xx status sends an informational response with the
+// current header before the final one.
+func (w *h2Response) WriteHeader(statusCode int) {
+	if statusCode >= 100 && statusCode < 200 {
+		w.writeInformational(statusCode)
+		return
+	}
+	if w.statusCode == 0 && http.StatusText(statusCode) != "" {
+		w.statusCode = statusCode
+	}
+}
+
+// writeInformational sends the HEADERS of a 1xx response, 101 doesn't exist
+// in HTTP/2.
+func (w *h2Response) writeInformational(statusCode int) {
+	if statusCode == http.StatusSwitchingProtocols || http.StatusText(statusCode) == "" ||
+		w.statusCode != 0 || w.wroteHeader || w.finished {
+		return
+	}
+	fields := appendH2Fields([]hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(statusCode)}}, w.header)
+
+	c := w.conn
+	s := w.stream
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if s.reset || c.closed || s.localClosed {
+		return
+	}
+	c.writeHeadersLocked(s, fields, false)
+	c.sendLocked()
+}
+
+// abort replaces the response of a handler that panicked with 500 Internal
+// Server Error if its header hasn't been sent, otherwise the stream is
+// reset.
+func (w *h2Response) abort() {
+	if w.finished {
+		return
+	}
+	w.body = nil
+	if !w.wroteHeader {
+		clear(w.header)
+		w.statusCode = http.StatusInternalServerError
+		return
+	}
+	w.finished = true
+	c := w.conn
+	c.mux.Lock()
+	if !w.stream.reset && !c.closed {
+		c.resetStreamLocked(w.stream.id, h2InternalError)
+		c.sendLocked()
+	}
+	c.mux.Unlock()
+}
+
+// Flush implements http.Flusher.
+func (w *h2Response) Flush() {
+	w.flush(false)
+}
+
+// finish completes the response once the handler returned, the stream
+// stops counting against MaxConcurrentStreams when it's closed.
+func (w *h2Response) finish() error {
+	c := w.conn
+	c.mux.Lock()
+	w.stream.serving = false
+	c.releaseStreamLocked(w.stream)
+	c.mux.Unlock()
+	return w.flush(true)
+}
+
+// flush sends the header and the buffered body, final reports whether the
+// response is complete. It waits while the client's windows leave more than
+// SendBufferSize pending.
+func (w *h2Response) flush(final bool) error {
+	if w.finished {
+		return nil
+	}
+	w.finished = final
+	w.WriteHeader(http.StatusOK)
+
+	var fields []hpack.HeaderField
+	if !w.wroteHeader {
+		fields = w.headerFields(final)
+	}
+	body := w.body
+	w.body = nil
+	if !w.bodyAllowed {
+		body = nil
+	}
+	var trailers []hpack.HeaderField
+	if final {
+		trailers = w.trailerFields()
+	}
+
+	c := w.conn
+	s := w.stream
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if s.reset || c.closed {
+		return ErrHTTP2StreamClosed
+	}
+	if fields != nil {
+		endStream := final && len(body) == 0 && len(trailers) == 0
+		c.writeHeadersLocked(s, fields, endStream)
+	}
+	if !s.localClosed {
+		s.pending = append(s.pending, body...)
+		if final {
+			s.pendingEnd = true
+			s.trailers = trailers
+		}
+		c.flushStreamLocked(s)
+	}
+	c.sendLocked()
+	for len(s.pending) > c.config.SendBufferSize && !s.reset && !c.closed {
+		c.cond.Wait()
+	}
+	if s.reset || c.closed {
+		return ErrHTTP2StreamClosed
+	}
+	return nil
+}
+
+// headerFields returns the fields of the header, with the status and
+// without the connection-specific headers.
+func (w *h2Response) headerFields(final bool) []hpack.HeaderField {
+	w.wroteHeader = true
+	header := w.header
+	bodyAllowed := bodyAllowedForStatus(w.statusCode)
+	isHead := w.request.Method == http.MethodHead
+	if w.request.Method == http.MethodConnect && w.statusCode/100 == 2 {
+		bodyAllowed = false
+	}
+	if bodyAllowed {
+		if final && header.Get("Content-Length") == "" && !(isHead && len(w.body) == 0) {
+			header.Set("Content-Length", strconv.Itoa(len(w.body)))
+		}
+		if _, hasType := header["Content-Type"]; !hasType && len(w.body) > 0 {
+			header.Set("Content-Type", http.DetectContentType(w.body))
+		}
+	} else {
+		header.Del("Content-Length")
+	}
+	if _, ok := header["Date"]; !ok {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	w.bodyAllowed = bodyAllowed && !isHead
+	w.trailers = announcedTrailers(header)
+
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(w.statusCode)}}
+	return appendH2Fields(fields, header)
+}
+
+// trailerFields returns the values of the announced trailers and of the
+// keys prefixed by http.TrailerPrefix.
+func (w *h2Response) trailerFields() []hpack.HeaderField {
+	trailers := http.Header{}
+	for k := range w.trailers {
+		if vv, ok := w.header[k]; ok {
+			trailers[k] = vv
+		}
+	}
+	for k, vv := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = vv
+		}
+	}
+	return appendH2Fields(nil, trailers)
+}
+
+func appendH2Fields(fields []hpack.HeaderField, header http.Header) []hpack.HeaderField {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		if !httpguts.ValidHeaderFieldName(k) || h2ConnectionHeaders[k] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := strings.ToLower(k)
+		for _, v := range header[k] {
+			v = headerNewlineToSpace.Replace(v)
+			fields = append(fields, hpack.HeaderField{Name: name, Value: strings.TrimSpace(v)})
+		}
+	}
+	return fields
+}
+
+// isH2CUpgrade reports whether request asks to switch a cleartext
+// connection to HTTP/2.
+func isH2CUpgrade(request *http.Request) bool {
+	return request.TLS == nil &&
+		httpguts.HeaderValuesContainsToken(request.Header["Upgrade"], "h2c") &&
+		httpguts.HeaderValuesContainsToken(request.Header["Connection"], "HTTP2-Settings") &&
+		len(request.Header["Http2-Settings"]) == 1
+}
+
+// upgradeH2C answers an "Upgrade: h2c" request with 101 Switching Protocols
+// and serves it as the first stream of the HTTP/2 connection. It returns
+// false if the request must be served as HTTP/1.x.
+func (p *ServerProcessor) upgradeH2C(response *Response, request *http.Request) bool {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(request.Header.Get("Http2-Settings"), "="))
+	if err != nil {
+		return false
+	}
+	settings, err := parseH2Settings(payload)
+	if err != nil || !response.waitPrevious(false) {
+		return false
+	}
+	c := newH2Conn(p, p.parser, p.http2)
+	if c.applySettings(settings) != nil {
+		return false
+	}
+
+	s := &h2Stream{id: 1, request: request, remoteClosed: true, sendWindow: c.initialSendWindow, counted: true, serving: true}
+	c.streams[1] = s
+	c.open = 1
+	c.lastStreamID = 1
+	request.Proto, request.ProtoMajor, request.ProtoMinor = "HTTP/2.0", 2, 0
+	request.Close = false
+	for key := range h2ConnectionHeaders {
+		request.Header.Del(key)
+	}
+	request.Header.Del("Http2-Settings")
+
+	response.inline = true
+	response.header.Set("Connection", "Upgrade")
+	response.header.Set("Upgrade", "h2c")
+	response.WriteHeader(http.StatusSwitchingProtocols)
+	if err := response.Upgrade(c); err != nil {
+		p.conn.Close()
+		return true
+	}
+	c.serveUpgrade(s)
+	return true
+}
+
+// sniffH2C switches a cleartext connection to HTTP/2 if it starts with the
+// client preface, the data to parse is returned once it's known.
+func (p *ServerProcessor) sniffH2C(data []byte) []byte {
+	buf := data
+	if len(p.h2Preface) > 0 {
+		buf = append(p.h2Preface, data...)
+	}
+	n := len(buf)
+	if n > len(h2ClientPreface) {
+		n = len(h2ClientPreface)
+	}
+	if string(buf[:n]) != h2ClientPreface[:n] {
+		p.h2Sniffing = false
+		p.h2Preface = nil
+		return buf
+	}
+	if n < len(h2ClientPreface) {
+		p.h2Preface = append(p.h2Preface[:0:0], buf...)
+		return nil
+	}
+	p.h2Sniffing = false
+	p.h2Preface = nil
+	p.startH2()
+	return buf
+}
+
+// startH2 makes the parser read HTTP/2 frames.
+func (p *ServerProcessor) startH2() {
+	parser := p.parser
+	c := newH2Conn(p, parser, p.http2)
+	parser.mux.Lock()
+	parser.upgradeTo(c, false)
+	parser.mux.Unlock()
+}
+
+// enableHTTP2 makes the processor upgrade the requests with an
+// "Upgrade: h2c" header, and the server sniff the client preface of
+// cleartext connections.
+func (p *ServerProcessor) enableHTTP2(config *HTTP2Config, cleartext bool) {
+	p.http2 = config
+	p.h2Sniffing = cleartext
+}
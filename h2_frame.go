@@ -0,0 +1,187 @@
+package nbhttp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	h2ClientPreface  = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	h2FrameHeaderLen = 9
+
+	h2DefaultWindowSize   = 65535
+	h2DefaultMaxFrameSize = 16384
+	h2MaxFrameSize        = 1<<24 - 1
+	h2MaxWindowSize       = 1<<31 - 1
+)
+
+// frame types
+const (
+	h2FrameData         uint8 = 0x0
+	h2FrameHeaders      uint8 = 0x1
+	h2FramePriority     uint8 = 0x2
+	h2FrameRSTStream    uint8 = 0x3
+	h2FrameSettings     uint8 = 0x4
+	h2FramePushPromise  uint8 = 0x5
+	h2FramePing         uint8 = 0x6
+	h2FrameGoAway       uint8 = 0x7
+	h2FrameWindowUpdate uint8 = 0x8
+	h2FrameContinuation uint8 = 0x9
+)
+
+// frame flags
+const (
+	h2FlagEndStream  uint8 = 0x1
+	h2FlagAck        uint8 = 0x1
+	h2FlagEndHeaders uint8 = 0x4
+	h2FlagPadded     uint8 = 0x8
+	h2FlagPriority   uint8 = 0x20
+)
+
+// settings
+const (
+	h2SettingHeaderTableSize      uint16 = 0x1
+	h2SettingEnablePush           uint16 = 0x2
+	h2SettingMaxConcurrentStreams uint16 = 0x3
+	h2SettingInitialWindowSize    uint16 = 0x4
+	h2SettingMaxFrameSize         uint16 = 0x5
+	h2SettingMaxHeaderListSize    uint16 = 0x6
+)
+
+// error codes
+const (
+	h2NoError            uint32 = 0x0
+	h2ProtocolError      uint32 = 0x1
+	h2InternalError      uint32 = 0x2
+	h2FlowControlError   uint32 = 0x3
+	h2StreamClosed       uint32 = 0x5
+	h2FrameSizeError     uint32 = 0x6
+	h2RefusedStream      uint32 = 0x7
+	h2Cancel             uint32 = 0x8
+	h2CompressionError   uint32 = 0x9
+	h2EnhanceYourCalm    uint32 = 0xb
+	h2InadequateSecurity uint32 = 0xc
+	h2HTTP11Required     uint32 = 0xd
+)
+
+// h2Error is a connection error, or an error of a stream if stream isn't 0.
+type h2Error struct {
+	code   uint32
+	stream uint32
+	reason string
+}
+
+func (e *h2Error) Error() string {
+	if e.stream != 0 {
+		return fmt.Sprintf("http2: stream %d error %d: %s", e.stream, e.code, e.reason)
+	}
+	return fmt.Sprintf("http2: connection error %d: %s", e.code, e.reason)
+}
+
+func h2ConnError(code uint32, reason string) *h2Error {
+	return &h2Error{code: code, reason: reason}
+}
+
+func h2StreamError(stream uint32, code uint32, reason string) *h2Error {
+	return &h2Error{code: code, stream: stream, reason: reason}
+}
+
+// h2Frame is a frame read from a connection, payload is only valid until the
+// next frame is read.
+type h2Frame struct {
+	typ     uint8
+	flags   uint8
+	stream  uint32
+	payload []byte
+}
+
+func (f *h2Frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// parseH2FrameHeader parses the first 9 bytes of data.
+func parseH2FrameHeader(data []byte) (length uint32, f h2Frame) {
+	length = uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2])
+	f.typ = data[3]
+	f.flags = data[4]
+	f.stream = binary.BigEndian.Uint32(data[5:]) & (1<<31 - 1)
+	return length, f
+}
+
+// unpad returns the payload of a DATA, HEADERS or PUSH_PROMISE frame without
+// its padding.
+func (f *h2Frame) unpad() ([]byte, error) {
+	payload := f.payload
+	if !f.has(h2FlagPadded) {
+		return payload, nil
+	}
+	if len(payload) < 1 {
+		return nil, h2ConnError(h2FrameSizeError, "padded frame too short")
+	}
+	padding := int(payload[0])
+	payload = payload[1:]
+	if padding > len(payload) {
+		return nil, h2ConnError(h2ProtocolError, "padding exceeds the payload")
+	}
+	return payload[:len(payload)-padding], nil
+}
+
+func appendH2FrameHeader(buf []byte, length int, typ, flags uint8, stream uint32) []byte {
+	return append(buf,
+		byte(length>>16), byte(length>>8), byte(length),
+		typ, flags,
+		byte(stream>>24)&0x7f, byte(stream>>16), byte(stream>>8), byte(stream))
+}
+
+func appendH2Frame(buf []byte, typ, flags uint8, stream uint32, payload []byte) []byte {
+	buf = appendH2FrameHeader(buf, len(payload), typ, flags, stream)
+	return append(buf, payload...)
+}
+
+func appendH2Uint32Frame(buf []byte, typ uint8, stream uint32, v uint32) []byte {
+	buf = appendH2FrameHeader(buf, 4, typ, 0, stream)
+	return binary.BigEndian.AppendUint32(buf, v)
+}
+
+func appendH2WindowUpdate(buf []byte, stream uint32, increment uint32) []byte {
+	return appendH2Uint32Frame(buf, h2FrameWindowUpdate, stream, increment)
+}
+
+func appendH2RSTStream(buf []byte, stream uint32, code uint32) []byte {
+	return appendH2Uint32Frame(buf, h2FrameRSTStream, stream, code)
+}
+
+func appendH2GoAway(buf []byte, lastStream uint32, code uint32) []byte {
+	buf = appendH2FrameHeader(buf, 8, h2FrameGoAway, 0, 0)
+	buf = binary.BigEndian.AppendUint32(buf, lastStream)
+	return binary.BigEndian.AppendUint32(buf, code)
+}
+
+// h2Setting is a parameter of a SETTINGS frame.
+type h2Setting struct {
+	id    uint16
+	value uint32
+}
+
+func appendH2Settings(buf []byte, settings []h2Setting) []byte {
+	buf = appendH2FrameHeader(buf, 6*len(settings), h2FrameSettings, 0, 0)
+	for _, s := range settings {
+		buf = binary.BigEndian.AppendUint16(buf, s.id)
+		buf = binary.BigEndian.AppendUint32(buf, s.value)
+	}
+	return buf
+}
+
+func parseH2Settings(payload []byte) ([]h2Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, h2ConnError(h2FrameSizeError, "invalid SETTINGS length")
+	}
+	settings := make([]h2Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, h2Setting{
+			id:    binary.BigEndian.Uint16(payload[i:]),
+			value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
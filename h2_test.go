@@ -0,0 +1,503 @@
+package nbhttp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/net/http2/hpack"
+)
+
+func TestServerHTTP2(t *testing.T) {
+	cert := newTestCertificate(t, "localhost")
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, request *http.Request) {
+		if request.ProtoMajor != 2 {
+			t.Errorf("invalid proto: %v", request.Proto)
+		}
+		w.Header().Set("Trailer", "X-Length")
+		n, _ := io.Copy(w, request.Body)
+		w.Header().Set("X-Length", strconv.Itoa(int(n)))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, request *http.Request) {
+		w.Write(bytes.Repeat([]byte("b"), 300*1024))
+	})
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, request *http.Request) {
+		w.Write([]byte("partial"))
+		panic(http.ErrAbortHandler)
+	})
+	mux.HandleFunc("/flushed", func(w http.ResponseWriter, request *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+
+	for _, useTLS := range []bool{true, false} {
+		conf := Config{
+			Addrs:    []string{"127.0.0.1:0"},
+			NPoller:  2,
+			HTTP2:    &HTTP2Config{},
+			Handler:  mux,
+			Executor: GoExecutor,
+		}
+		transport := &http.Transport{}
+		scheme := "http://"
+		if useTLS {
+			conf.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			transport.ForceAttemptHTTP2 = true
+			scheme = "https://"
+		} else {
+			// prior knowledge
+			transport.Protocols = new(http.Protocols)
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+		svr := NewServer(conf)
+		if err := svr.Start(); err != nil {
+			t.Fatal(err)
+		}
+		url := scheme + svr.Addr()[0].String()
+		client := &http.Client{Transport: transport}
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := strings.Repeat(strconv.Itoa(i%10), i*10*1024)
+				res, err := client.Post(url+"/echo", "text/plain", strings.NewReader(body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				if res.ProtoMajor != 2 {
+					t.Errorf("invalid proto: %v", res.Proto)
+				}
+				if string(data) != body {
+					t.Errorf("invalid body: %v bytes, expected %v", len(data), len(body))
+				}
+				if res.Trailer.Get("X-Length") != strconv.Itoa(len(body)) {
+					t.Errorf("invalid trailer: %v", res.Trailer)
+				}
+
+				res, err = client.Get(url + "/big")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, _ = io.ReadAll(res.Body)
+				res.Body.Close()
+				if len(data) != 300*1024 {
+					t.Errorf("invalid body: %v bytes", len(data))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		res, err := client.Get(url + "/panic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusInternalServerError || len(data) != 0 {
+			t.Fatalf("invalid response: %v %q", res.StatusCode, data)
+		}
+		res, err = client.Get(url + "/flushed")
+		if err == nil {
+			_, err = io.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		if err == nil {
+			t.Fatal("reset stream read without error")
+		}
+		client.CloseIdleConnections()
+		svr.Stop()
+	}
+}
+
+type testH2Frame struct {
+	typ     uint8
+	flags   uint8
+	stream  uint32
+	payload []byte
+}
+
+func readTestH2Frame(t *testing.T, r io.Reader) testH2Frame {
+	header := make([]byte, h2FrameHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	length, f := parseH2FrameHeader(header)
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return testH2Frame{typ: f.typ, flags: f.flags, stream: f.stream, payload: payload}
+}
+
+// readTestH2Response reads the frames until the end of the response of
+// stream, its status and body are returned.
+func readTestH2Response(t *testing.T, r io.Reader, decoder *hpack.Decoder, stream uint32) (string, string) {
+	var status string
+	var body []byte
+	decoder.SetEmitFunc(func(f hpack.HeaderField) {
+		if f.Name == ":status" {
+			status = f.Value
+		}
+	})
+	for {
+		f := readTestH2Frame(t, r)
+		if f.stream != stream {
+			continue
+		}
+		switch f.typ {
+		case h2FrameHeaders:
+			if _, err := decoder.Write(f.payload); err != nil {
+				t.Fatal(err)
+			}
+		case h2FrameData:
+			body = append(body, f.payload...)
+		case h2FrameRSTStream:
+			t.Fatalf("stream %v reset", stream)
+		}
+		if f.flags&h2FlagEndStream != 0 {
+			return status, string(body)
+		}
+	}
+}
+
+func TestServerH2CUpgrade(t *testing.T) {
+	block := make(chan struct{})
+	svr := NewServer(Config{
+		Addrs:   []string{"127.0.0.1:0"},
+		NPoller: 1,
+		HTTP2:   &HTTP2Config{MaxConcurrentStreams: 1},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/block" {
+				<-block
+			}
+			w.Write([]byte(request.URL.Path + " " + request.Proto))
+		}),
+		Executor: GoExecutor,
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	settings := appendH2Settings(nil, []h2Setting{{h2SettingInitialWindowSize, 1 << 20}})
+	conn.Write([]byte("GET /up HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n" +
+		"HTTP2-Settings: " + base64.RawURLEncoding.EncodeToString(settings[h2FrameHeaderLen:]) + "\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("invalid response: %v %v", res.Status, res.Header)
+	}
+	conn.Write(append([]byte(h2ClientPreface), appendH2Settings(nil, nil)...))
+
+	f := readTestH2Frame(t, r)
+	if f.typ != h2FrameSettings || f.flags&h2FlagAck != 0 {
+		t.Fatalf("SETTINGS expected, got %+v", f)
+	}
+	serverSettings, _ := parseH2Settings(f.payload)
+	if len(serverSettings) == 0 || serverSettings[0] != (h2Setting{h2SettingMaxConcurrentStreams, 1}) {
+		t.Fatalf("invalid settings: %+v", serverSettings)
+	}
+
+	decoder := hpack.NewDecoder(4096, nil)
+	status, body := readTestH2Response(t, r, decoder, 1)
+	if status != "200" || body != "/up HTTP/2.0" {
+		t.Fatalf("invalid response: %v %q", status, body)
+	}
+
+	var buf bytes.Buffer
+	encoder := hpack.NewEncoder(&buf)
+	request := func(stream uint32, path string) {
+		buf.Reset()
+		encoder.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+		encoder.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+		encoder.WriteField(hpack.HeaderField{Name: ":path", Value: path})
+		encoder.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+		conn.Write(appendH2Frame(nil, h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, stream, buf.Bytes()))
+	}
+
+	// the second concurrent stream is refused
+	request(3, "/block")
+	request(5, "/refused")
+	for {
+		f = readTestH2Frame(t, r)
+		if f.typ == h2FrameRSTStream {
+			break
+		}
+	}
+	if f.stream != 5 || binary.BigEndian.Uint32(f.payload) != h2RefusedStream {
+		t.Fatalf("REFUSED_STREAM expected, got %+v", f)
+	}
+	close(block)
+	status, body = readTestH2Response(t, r, decoder, 3)
+	if status != "200" || body != "/block HTTP/2.0" {
+		t.Fatalf("invalid response: %v %q", status, body)
+	}
+
+	request(7, "/next")
+	status, body = readTestH2Response(t, r, decoder, 7)
+	if status != "200" || body != "/next HTTP/2.0" {
+		t.Fatalf("invalid response: %v %q", status, body)
+	}
+
+	// a connection error is answered with GOAWAY
+	conn.Write(appendH2Frame(nil, h2FrameHeaders, h2FlagEndHeaders, 4, nil))
+	for {
+		f = readTestH2Frame(t, r)
+		if f.typ == h2FrameGoAway {
+			break
+		}
+	}
+	if code := binary.BigEndian.Uint32(f.payload[4:]); code != h2ProtocolError {
+		t.Fatalf("invalid GOAWAY code: %v", code)
+	}
+}
+
+func TestServerHTTP2FlowControl(t *testing.T) {
+	read := make(chan struct{})
+	readMore := make(chan struct{})
+	done := make(chan error, 1)
+	svr := NewServer(Config{
+		Addrs:   []string{"127.0.0.1:0"},
+		NPoller: 1,
+		HTTP2:   &HTTP2Config{},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			<-read
+			if _, err := io.ReadFull(request.Body, make([]byte, 3*16384)); err != nil {
+				done <- err
+				return
+			}
+			<-readMore
+			_, err := io.ReadAll(request.Body)
+			done <- err
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.Write(append([]byte(h2ClientPreface), appendH2Settings(nil, nil)...))
+	conn.Write(appendH2FrameHeader(nil, 0, h2FrameSettings, h2FlagAck, 0))
+	var buf bytes.Buffer
+	encoder := hpack.NewEncoder(&buf)
+	encoder.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+	encoder.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+	encoder.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+	encoder.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	conn.Write(appendH2Frame(nil, h2FrameHeaders, h2FlagEndHeaders, 1, buf.Bytes()))
+	data := make([]byte, 16384)
+	sendData := func(n int) {
+		for i := 0; i < n; i++ {
+			conn.Write(appendH2Frame(nil, h2FrameData, 0, 1, data))
+		}
+	}
+	// readUntil returns the increment of the WINDOW_UPDATE frames of stream 1
+	// read before a frame of typ
+	readUntil := func(typ uint8) (uint32, testH2Frame) {
+		var increment uint32
+		for {
+			f := readTestH2Frame(t, r)
+			if f.typ == typ && f.stream <= 1 {
+				return increment, f
+			}
+			if f.typ == h2FrameWindowUpdate && f.stream == 1 {
+				increment += binary.BigEndian.Uint32(f.payload)
+			}
+		}
+	}
+
+	// the window is not replenished until the handler reads the body
+	sendData(3)
+	conn.Write(appendH2Frame(nil, h2FramePing, 0, 0, make([]byte, 8)))
+	if increment, _ := readUntil(h2FramePing); increment != 0 {
+		t.Fatalf("window replenished before the body is read: %v", increment)
+	}
+	close(read)
+	for total := uint32(0); total < 3*16384; {
+		f := readTestH2Frame(t, r)
+		if f.typ == h2FrameWindowUpdate && f.stream == 1 {
+			total += binary.BigEndian.Uint32(f.payload)
+		}
+	}
+
+	// the data exceeding the window resets the stream
+	sendData(4)
+	_, f := readUntil(h2FrameRSTStream)
+	if f.stream != 1 || binary.BigEndian.Uint32(f.payload) != h2FlowControlError {
+		t.Fatalf("FLOW_CONTROL_ERROR expected, got %+v", f)
+	}
+	close(readMore)
+	if err := <-done; err != ErrHTTP2StreamClosed {
+		t.Fatalf("invalid body error: %v", err)
+	}
+}
+
+func TestServerHTTP2RapidReset(t *testing.T) {
+	release := make(chan struct{})
+	svr := NewServer(Config{
+		Addrs:   []string{"127.0.0.1:0"},
+		NPoller: 1,
+		HTTP2:   &HTTP2Config{MaxConcurrentStreams: 2, MaxResetStreams: 4},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/block" {
+				<-release
+				return
+			}
+			io.ReadAll(request.Body)
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	conn.Write(append([]byte(h2ClientPreface), appendH2Settings(nil, nil)...))
+	conn.Write(appendH2FrameHeader(nil, 0, h2FrameSettings, h2FlagAck, 0))
+	var buf bytes.Buffer
+	encoder := hpack.NewEncoder(&buf)
+	request := func(stream uint32, path string, flags uint8) {
+		buf.Reset()
+		encoder.WriteField(hpack.HeaderField{Name: ":method", Value: "POST"})
+		encoder.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+		encoder.WriteField(hpack.HeaderField{Name: ":path", Value: path})
+		encoder.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+		conn.Write(appendH2Frame(nil, h2FrameHeaders, h2FlagEndHeaders|flags, stream, buf.Bytes()))
+	}
+
+	// the reset streams count against the limit until their handlers return
+	request(1, "/block", h2FlagEndStream)
+	request(3, "/block", h2FlagEndStream)
+	conn.Write(appendH2RSTStream(nil, 1, h2Cancel))
+	conn.Write(appendH2RSTStream(nil, 3, h2Cancel))
+	request(5, "/block", h2FlagEndStream)
+	for {
+		f := readTestH2Frame(t, r)
+		if f.typ != h2FrameRSTStream {
+			continue
+		}
+		if f.stream != 5 || binary.BigEndian.Uint32(f.payload) != h2RefusedStream {
+			t.Fatalf("REFUSED_STREAM expected, got %+v", f)
+		}
+		break
+	}
+	close(release)
+
+	// the client resetting too many streams is sent GOAWAY, a stream is
+	// reset once a PING shows it's not refused
+	for stream := uint32(7); ; stream += 2 {
+		request(stream, "/read", 0)
+		conn.Write(appendH2Frame(nil, h2FramePing, 0, 0, make([]byte, 8)))
+		refused := false
+		for f := readTestH2Frame(t, r); f.typ != h2FramePing; f = readTestH2Frame(t, r) {
+			switch f.typ {
+			case h2FrameRSTStream:
+				refused = f.stream == stream
+			case h2FrameGoAway:
+				if code := binary.BigEndian.Uint32(f.payload[4:]); code != h2EnhanceYourCalm {
+					t.Fatalf("ENHANCE_YOUR_CALM expected, got %v", code)
+				}
+				return
+			}
+		}
+		if refused {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		conn.Write(appendH2RSTStream(nil, stream, h2Cancel))
+	}
+}
+
+func TestServerHTTP2SendBuffer(t *testing.T) {
+	size := 1024 * 1024
+	done := make(chan error, 1)
+	svr := NewServer(Config{
+		Addrs:   []string{"127.0.0.1:0"},
+		NPoller: 1,
+		HTTP2:   &HTTP2Config{},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			_, err := w.Write(make([]byte, size))
+			done <- err
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	conn.Write(append([]byte(h2ClientPreface), appendH2Settings(nil, []h2Setting{{h2SettingInitialWindowSize, 0}})...))
+	conn.Write(appendH2FrameHeader(nil, 0, h2FrameSettings, h2FlagAck, 0))
+	var buf bytes.Buffer
+	encoder := hpack.NewEncoder(&buf)
+	encoder.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	encoder.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+	encoder.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+	encoder.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	conn.Write(appendH2Frame(nil, h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, buf.Bytes()))
+
+	// the write waits for the client's window
+	select {
+	case err := <-done:
+		t.Fatalf("write not blocked by the send buffer: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Write(appendH2WindowUpdate(nil, 0, uint32(size)))
+	conn.Write(appendH2WindowUpdate(nil, 1, uint32(size)))
+	status, body := readTestH2Response(t, r, hpack.NewDecoder(4096, nil), 1)
+	if status != "200" || len(body) != size {
+		t.Fatalf("invalid response: %v, %v bytes", status, len(body))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+package nbhttp
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// hijacker is implemented by the connections of an Engine, hijack detaches
+// the connection from its poller and returns it as a blocking net.Conn.
+// wait is false when called by a handler running inside Parser.Read, which
+// is then known not to be reading the connection.
+type hijacker interface {
+	hijack(wait bool) (net.Conn, error)
+}
+
+// hijackedConn returns the data read before the connection was hijacked
+// first.
+type hijackedConn struct {
+	net.Conn
+	buffer []byte
+}
+
+// Read .
+func (c *hijackedConn) Read(b []byte) (int, error) {
+	if len(c.buffer) > 0 {
+		n := copy(b, c.buffer)
+		c.buffer = c.buffer[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// Hijack implements http.Hijacker, the connection is detached from its
+// poller and the handler owns it afterwards. The data already read after
+// the request is returned by the first reads of the net.Conn and the
+// bufio.Reader.
+//
+// The response is not written. Hijack waits for the responses to earlier
+// pipelined requests to be written, it fails if they are not written yet
+// and the handler runs inside Parser.Read.
+func (response *Response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if response.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	p := response.processor
+	hj, ok := p.conn.(hijacker)
+	if !ok || p.parser == nil {
+		return nil, nil, ErrUpgradeNotSupported
+	}
+
+	async := !response.inline
+	if !response.waitPrevious(async) {
+		return nil, nil, ErrUpgradeNotSupported
+	}
+	conn, err := hj.hijack(async)
+	if err != nil {
+		return nil, nil, err
+	}
+	response.hijacked = true
+
+	parser := p.parser
+	if async {
+		parser.mux.Lock()
+		defer parser.mux.Unlock()
+	}
+	hc := &hijackedConn{Conn: conn, buffer: parser.hijack(async)}
+	return hc, bufio.NewReadWriter(bufio.NewReader(hc), bufio.NewWriter(hc)), nil
+}
+
+// Upgrade writes the response, then passes the data read after the request
+// to u instead of parsing it as HTTP, the connection stays on its poller.
+// It's used after a 101 Switching Protocols response to an Upgrade request,
+// or a 2xx response to a CONNECT request.
+//
+// u is called with the data already read before Upgrade returns, then on
+// the poller's goroutine as data arrives. Like Hijack, Upgrade waits for the
+// responses to earlier pipelined requests to be written.
+func (response *Response) Upgrade(u Upgrader) error {
+	if response.hijacked {
+		return http.ErrHijacked
+	}
+	p := response.processor
+	parser := p.parser
+	if parser == nil || p.conn == nil {
+		return ErrUpgradeNotSupported
+	}
+
+	async := !response.inline
+	if !response.waitPrevious(async) {
+		return ErrUpgradeNotSupported
+	}
+	if err := response.finish(); err != nil {
+		return err
+	}
+	response.hijacked = true
+
+	if async {
+		parser.mux.Lock()
+		defer parser.mux.Unlock()
+	}
+	return parser.upgradeTo(u, async)
+}
+
+// waitPrevious waits for the responses before this one to be written, a
+// handler running inside Parser.Read can't wait for them.
+func (response *Response) waitPrevious(async bool) bool {
+	q := &response.processor.responses
+	if async {
+		return q.wait(response.sequence)
+	}
+	return q.written(response.sequence)
+}
@@ -0,0 +1,108 @@
+package nbhttp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MethodPolicy is the set of request methods accepted by a server Parser.
+// It's immutable once created, so it can be shared by all the parsers.
+type MethodPolicy struct {
+	anyToken bool
+	methods  map[string]string // canonical methods by upper case name
+	charMap  [256]bool
+}
+
+var (
+	// StrictMethods accepts the methods defined by RFC 9110, it's the
+	// default policy.
+	StrictMethods = mustMethodPolicy("GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE")
+
+	// AnyMethod accepts any method that is a valid token.
+	AnyMethod = &MethodPolicy{anyToken: true, charMap: tokenCharMap}
+)
+
+// NewMethodPolicy returns a policy accepting methods, which are matched
+// case-insensitively and passed to the processor as registered.
+func NewMethodPolicy(methods ...string) (*MethodPolicy, error) {
+	mp := &MethodPolicy{methods: map[string]string{}}
+	return mp.add(methods)
+}
+
+// With returns a policy accepting the methods of mp and methods, e.g.
+// StrictMethods.With("PATCH") or StrictMethods.With("PROPFIND", "MKCOL").
+func (mp *MethodPolicy) With(methods ...string) (*MethodPolicy, error) {
+	if mp.anyToken {
+		return mp, nil
+	}
+	registered := make([]string, 0, len(mp.methods)+len(methods))
+	for _, m := range mp.methods {
+		registered = append(registered, m)
+	}
+	return NewMethodPolicy(append(registered, methods...)...)
+}
+
+func (mp *MethodPolicy) add(methods []string) (*MethodPolicy, error) {
+	var dis byte = 'a' - 'A'
+	for _, m := range methods {
+		if m == "" {
+			return nil, fmt.Errorf("invalid method %q", m)
+		}
+		for i := 0; i < len(m); i++ {
+			if !isToken(m[i]) {
+				return nil, fmt.Errorf("invalid method %q", m)
+			}
+		}
+		mp.methods[strings.ToUpper(m)] = m
+		for i := 0; i < len(m); i++ {
+			c := m[i]
+			mp.charMap[c] = true
+			// methods are matched case-insensitively, as before
+			if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+				mp.charMap[c|dis] = true
+				mp.charMap[c&^dis] = true
+			}
+		}
+	}
+	return mp, nil
+}
+
+func mustMethodPolicy(methods ...string) *MethodPolicy {
+	mp, err := NewMethodPolicy(methods...)
+	if err != nil {
+		panic(err)
+	}
+	return mp
+}
+
+func (mp *MethodPolicy) isMethodChar(c byte) bool {
+	return mp.charMap[c]
+}
+
+// lookup returns the method named by b if it's accepted.
+func (mp *MethodPolicy) lookup(b []byte) (string, bool) {
+	if mp.anyToken {
+		// the standard methods are not allocated
+		if m, ok := StrictMethods.methods[string(b)]; ok && m == string(b) {
+			return m, true
+		}
+		return string(b), true
+	}
+	if m, ok := mp.methods[string(b)]; ok {
+		return m, true
+	}
+	var buf [16]byte
+	if len(b) > len(buf) {
+		m, ok := mp.methods[strings.ToUpper(string(b))]
+		return m, ok
+	}
+	upper := buf[:len(b)]
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper[i] = c
+	}
+	m, ok := mp.methods[string(upper)]
+	return m, ok
+}
@@ -1,55 +1,250 @@
 package nbhttp
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/textproto"
-	"strconv"
 	"strings"
+	"sync"
 )
 
+const (
+	// DefaultMaxLineSize .
+	DefaultMaxLineSize = 1024 * 8
+
+	// DefaultMaxHeaderSize .
+	DefaultMaxHeaderSize = http.DefaultMaxHeaderBytes
+
+	// DefaultMaxHeaderCount .
+	DefaultMaxHeaderCount = 1024
+
+	// DefaultMaxBodySize .
+	DefaultMaxBodySize = 1024 * 1024 * 32
+
+	// DefaultMaxChunkExtensionSize .
+	DefaultMaxChunkExtensionSize = 1024 * 4
+)
+
+// expectHandler is implemented by the processors that answer the Expect
+// header of a request once its header is read. onExpect reports whether the
+// body is read, otherwise the request has been rejected with a final
+// response after which the connection is closed.
+type expectHandler interface {
+	onExpect(contentLength int, chunked bool) bool
+}
+
 // Parser .
 type Parser struct {
+	// mux serializes Read with the handlers that take over the connection
+	// from another goroutine.
+	mux sync.Mutex
+
 	conn net.Conn
 
 	state int8
 
-	cache []byte
-
-	proto string
+	// cache is the unparsed data kept for the next Read, in the buffer
+	// cacheBuf borrowed from the pool until it's all parsed.
+	cache    []byte
+	cacheBuf *[]byte
 
 	statusCode int
-	status     string
 
-	headerKey   string
-	headerValue string
+	// keyLen is the length of the header key being read, from the start of
+	// the unparsed data, and valueStart the offset of its value.
+	keyLen     int
+	valueStart int
+
+	// extStart is the offset of the extensions of the chunk being read,
+	// from the start of its size.
+	chunkSize int
+	extStart  int
 
-	chunkSize     int
-	header        http.Header
+	framing       framingHeaders
 	chunked       bool
 	contentLength int
 	trailer       http.Header
-	// todo
-	readLimit   int
+
+	limits      Limits
+	methods     *MethodPolicy
+	headerSize  int
+	headerCount int
+	bodySize    int
 	maxReadSize int
 	isClient    bool
 
+	// strict is set by SetStrict, http10 is set for an HTTP/1.0 request.
+	// mustClose is set if the connection must be closed after the response
+	// to the request being read.
+	strict    bool
+	http10    bool
+	mustClose bool
+
+	// codings are the transfer codings of the body other than chunked,
+	// decoded from encoded if decoding. untilClose is set for a response
+	// whose body ends with the connection.
+	decode     bool
+	decoding   bool
+	codings    []int8
+	encoded    []byte
+	untilClose bool
+
+	// requests are the methods of the requests whose responses are
+	// expected by a client, in order.
+	requests []string
+
+	// connect and upgrade are set for a CONNECT or Upgrade request, the data
+	// read after it is kept in raw until its handler decides whether the
+	// connection is still HTTP. deferred is set while the handler runs on
+	// another goroutine, rest is the data read after the message being
+	// completed.
+	connect  bool
+	upgrade  bool
+	deferred bool
+	raw      []byte
+	rest     []byte
+	upgrader Upgrader
+
+	// upgraderMux guards upgrader for onClose, which can't take mux since
+	// the connection may be closed by a write inside Read.
+	upgraderMux sync.Mutex
+
+	// callbacks receives the parts of the messages, it's processor
+	// converting them to strings unless it's a BytesProcessor.
 	processor Processor
+	callbacks BytesProcessor
 
 	session interface{}
 }
 
+// Limits bounds the messages read by a Parser, zero fields use the default
+// values and negative fields disable the limit.
+type Limits struct {
+	// MaxLineSize limits the size of the request line or status line, and
+	// of each chunk size line.
+	MaxLineSize int
+
+	// MaxHeaderSize limits the size of the request line or status line, the
+	// headers and the trailers together.
+	MaxHeaderSize int
+
+	// MaxHeaderCount limits the number of headers and trailers.
+	MaxHeaderCount int
+
+	// MaxBodySize limits the size of the body, the chunk extensions
+	// included.
+	MaxBodySize int
+
+	// MaxChunkExtensionSize limits the size of the extensions of a chunk.
+	MaxChunkExtensionSize int
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxLineSize == 0 {
+		l.MaxLineSize = DefaultMaxLineSize
+	}
+	if l.MaxHeaderSize == 0 {
+		l.MaxHeaderSize = DefaultMaxHeaderSize
+	}
+	if l.MaxHeaderCount == 0 {
+		l.MaxHeaderCount = DefaultMaxHeaderCount
+	}
+	if l.MaxBodySize == 0 {
+		l.MaxBodySize = DefaultMaxBodySize
+	}
+	if l.MaxChunkExtensionSize == 0 {
+		l.MaxChunkExtensionSize = DefaultMaxChunkExtensionSize
+	}
+	return l
+}
+
+// Upgrader reads the data of a connection after its Parser has been
+// switched out of HTTP by Response.Upgrade, data is only valid during the
+// call.
+type Upgrader interface {
+	Read(p *Parser, data []byte) error
+}
+
 func (p *Parser) nextState(state int8) {
 	p.state = state
 }
 
+// SetLimits .
+func (p *Parser) SetLimits(limits Limits) {
+	p.limits = limits.withDefaults()
+}
+
+// SetStrict makes the parser reject the messages whose framing could be
+// interpreted differently by another implementation, the ones used to
+// smuggle requests through proxies, following RFC 9112 sections 6 and 11:
+//   - whitespace between a field name and the colon
+//   - duplicated Content-Length values, or Content-Length with
+//     Transfer-Encoding
+//   - Transfer-Encoding in an HTTP/1.0 request
+//   - bare LF, NUL and other control characters in the request line, the
+//     field values and the chunk extensions
+//   - more than one space between the parts of the request line
+//   - anything but a chunk extension after the size of a chunk
+//
+// Obsolete line folding, conflicting Content-Length values and requests
+// whose final transfer coding isn't chunked are rejected in any case, and
+// the connection is closed after the response to a request with both
+// Content-Length and Transfer-Encoding.
+func (p *Parser) SetStrict(strict bool) {
+	p.strict = strict
+}
+
+// SetTransferDecoding makes the parser decode the gzip and deflate transfer
+// codings applied to the bodies before chunked, the processor then receives
+// the decoded body once it has been read. Messages with other codings are
+// rejected. The codings are left to the processor otherwise.
+func (p *Parser) SetTransferDecoding(decode bool) {
+	p.decode = decode
+}
+
+// SetMethodPolicy sets the request methods accepted by the parser, nil uses
+// StrictMethods.
+func (p *Parser) SetMethodPolicy(methods *MethodPolicy) {
+	if methods == nil {
+		methods = StrictMethods
+	}
+	p.methods = methods
+}
+
 // Read .
 func (p *Parser) Read(data []byte) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.read(data)
+}
+
+func (p *Parser) read(data []byte) error {
 	if len(data) == 0 {
 		return nil
 	}
 
+	switch p.state {
+	case statePipelineFull:
+		p.cache = append(p.cache, data...)
+		if p.maxReadSize > 0 && len(p.cache) > p.maxReadSize {
+			return ErrReadLimitExceeded
+		}
+		return nil
+	case stateUpgradePending:
+		p.raw = append(p.raw, data...)
+		if p.maxReadSize > 0 && len(p.raw) > p.maxReadSize {
+			return ErrReadLimitExceeded
+		}
+		return nil
+	case stateUpgraded:
+		return p.upgrader.Read(p, data)
+	case stateHijacked, stateClosing:
+		return nil
+	}
+
 	var c byte
 	var start = 0
 	var offset = len(p.cache)
@@ -58,13 +253,29 @@ func (p *Parser) Read(data []byte) error {
 	}
 	for i := offset; i < len(data); i++ {
 		c = data[i]
+		if p.state < stateBodyContentLength {
+			p.headerSize++
+			if p.state < stateHeaderKeyBefore {
+				if p.limits.MaxLineSize > 0 && p.headerSize > p.limits.MaxLineSize {
+					return ErrLineTooLarge
+				}
+			} else if p.limits.MaxHeaderSize > 0 && p.headerSize > p.limits.MaxHeaderSize {
+				return ErrHeaderTooLarge
+			}
+		} else if p.state >= stateBodyTrailerHeaderValueLF && p.state <= stateBodyTrailerHeaderValue {
+			// the trailers count with the headers
+			p.headerSize++
+			if p.limits.MaxHeaderSize > 0 && p.headerSize > p.limits.MaxHeaderSize {
+				return ErrHeaderTooLarge
+			}
+		}
 		switch p.state {
 		// case stateInit:
 		// 	if !isValidMethodChar(c) {
 		// 		return ErrInvalidMethod
 		// 	}
 		case stateMethodBefore:
-			if isValidMethodChar(c) {
+			if p.methods.isMethodChar(c) {
 				// data = data[i:]
 				// i = 0
 				start = i
@@ -74,43 +285,50 @@ func (p *Parser) Read(data []byte) error {
 			return ErrInvalidMethod
 		case stateMethod:
 			if c == ' ' {
-				var method = strings.ToUpper(string(data[start:i]))
-				if !isValidMethod(method) {
+				method, ok := p.methods.lookup(data[start:i])
+				if !ok {
 					return ErrInvalidMethod
 				}
-				p.processor.OnMethod(method)
+				p.connect = method == http.MethodConnect
+				p.callbacks.OnMethod(method)
 				// data = data[i+1:]
 				// i = -1
 				start = i + 1
 				p.nextState(statePathBefore)
 				continue
 			}
-			if !isAlpha(c) {
+			if !p.methods.isMethodChar(c) {
 				return ErrInvalidMethod
 			}
 		case statePathBefore:
-			if c == '/' {
+			// origin-form, absolute-form, authority-form or asterisk-form,
+			// validated by the processor
+			if c > ' ' && c < 0x7f {
 				// data = data[i:]
 				// i = 0
 				start = i
 				p.nextState(statePath)
 				continue
 			}
-			if c != ' ' {
+			if c != ' ' || p.strict {
 				return ErrInvalidRequestURI
 			}
 		case statePath:
 			if c == ' ' {
-				var uri = string(data[start:i])
-				if err := p.processor.OnURL(uri); err != nil {
+				if err := p.callbacks.OnURLBytes(data[start:i]); err != nil {
 					return err
 				}
 				// data = data[i+1:]
 				// i = -1
 				start = i + 1
 				p.nextState(stateProtoBefore)
+			} else if p.strict && isCTL(c) {
+				return ErrInvalidRequestURI
 			}
 		case stateProtoBefore:
+			if p.strict && (c == ' ' || isCTL(c)) {
+				return ErrInvalidHTTPVersion
+			}
 			if c != ' ' {
 				// data = data[i:]
 				// i = 0
@@ -118,21 +336,19 @@ func (p *Parser) Read(data []byte) error {
 				p.nextState(stateProto)
 			}
 		case stateProto:
-			switch c {
-			case ' ':
-				if p.proto == "" {
-					p.proto = string(data[start:i])
-				}
-			case '\r':
-				if p.proto == "" {
-					p.proto = string(data[start:i])
+			if c == '\r' {
+				// anything after a space is ignored
+				proto := data[start:i]
+				if n := bytes.IndexByte(proto, ' '); n >= 0 {
+					proto = proto[:n]
 				}
-				if err := p.processor.OnProto(p.proto); err != nil {
-					p.proto = ""
+				if err := p.callbacks.OnProtoBytes(proto); err != nil {
 					return err
 				}
-				p.proto = ""
+				p.http10 = string(proto) == "HTTP/1.0"
 				p.nextState(stateProtoLF)
+			} else if p.strict && (c == ' ' || isCTL(c)) {
+				return ErrInvalidHTTPVersion
 			}
 		case stateClientProtoBefore:
 			if c == 'H' {
@@ -146,14 +362,9 @@ func (p *Parser) Read(data []byte) error {
 		case stateClientProto:
 			switch c {
 			case ' ':
-				if p.proto == "" {
-					p.proto = string(data[start:i])
-				}
-				if err := p.processor.OnProto(p.proto); err != nil {
-					p.proto = ""
+				if err := p.callbacks.OnProtoBytes(data[start:i]); err != nil {
 					return err
 				}
-				p.proto = ""
 				p.nextState(stateStatusCodeBefore)
 			}
 		case stateStatusCodeBefore:
@@ -169,12 +380,11 @@ func (p *Parser) Read(data []byte) error {
 			return ErrInvalidHTTPStatusCode
 		case stateStatusCode:
 			if c == ' ' {
-				cs := string(data[start:i])
-				code, err := strconv.Atoi(cs)
-				if err != nil {
-					return err
+				code, ok := parseDecimal(data[start:i])
+				if !ok || i-start != 3 {
+					return ErrInvalidHTTPStatusCode
 				}
-				p.statusCode = code
+				p.statusCode = int(code)
 				p.nextState(stateStatusBefore)
 				continue
 			}
@@ -193,18 +403,8 @@ func (p *Parser) Read(data []byte) error {
 			}
 			return ErrInvalidHTTPStatus
 		case stateStatus:
-			switch c {
-			case ' ':
-				if p.status == "" {
-					p.status = string(data[start:i])
-				}
-			case '\r':
-				if p.status == "" {
-					p.status = string(data[start:i])
-				}
-				p.processor.OnStatus(p.statusCode, p.status)
-				p.statusCode = 0
-				p.status = ""
+			if c == '\r' {
+				p.callbacks.OnStatusBytes(p.statusCode, data[start:i])
 				p.nextState(stateStatusLF)
 			}
 		case stateStatusLF:
@@ -239,15 +439,24 @@ func (p *Parser) Read(data []byte) error {
 
 			switch c {
 			case '\r':
-				err := p.parseTransferEncoding()
+				err := p.parseFraming()
 				if err != nil {
 					return err
 				}
-				err = p.parseContentLength()
-				if err != nil {
-					return err
+				if !p.isClient {
+					p.upgrade = p.connect || (p.framing.count(framingUpgrade) > 0 &&
+						p.framing.containsToken(framingConnection, "upgrade"))
+				} else {
+					p.upgrade = p.tunnel()
+				}
+				if !p.isClient && p.framing.count(framingExpect) > 0 {
+					if eh, ok := p.processor.(expectHandler); ok && !eh.onExpect(p.contentLength, p.chunked) {
+						// the request has been rejected before its body
+						p.nextState(stateClosing)
+						return nil
+					}
 				}
-				p.processor.OnContentLength(p.contentLength)
+				p.callbacks.OnContentLength(p.contentLength)
 				err = p.parseTrailer()
 				if err != nil {
 					return err
@@ -267,18 +476,19 @@ func (p *Parser) Read(data []byte) error {
 				return ErrInvalidCharInHeader
 			}
 		case stateHeaderKey:
+			// the key is kept in the unparsed data until the value is read
 			switch c {
 			case ' ':
-				if p.headerKey == "" {
-					p.headerKey = http.CanonicalHeaderKey(string(data[start:i]))
+				if p.strict {
+					return ErrInvalidCharInHeader
+				}
+				if p.keyLen == 0 {
+					p.keyLen = i - start
 				}
 			case ':':
-				if p.headerKey == "" {
-					p.headerKey = http.CanonicalHeaderKey(string(data[start:i]))
+				if p.keyLen == 0 {
+					p.keyLen = i - start
 				}
-				// data = data[i+1:]
-				// i = -1
-				start = i + 1
 				p.nextState(stateHeaderValueBefore)
 			default:
 				if !isToken(c) {
@@ -292,9 +502,7 @@ func (p *Parser) Read(data []byte) error {
 				if !isToken(c) {
 					return ErrInvalidCharInHeader
 				}
-				// data = data[i:]
-				// i = 0
-				start = i
+				p.valueStart = i - start
 				p.nextState(stateHeaderValue)
 			}
 		case stateHeaderValue:
@@ -304,30 +512,29 @@ func (p *Parser) Read(data []byte) error {
 			// 		p.headerValue = string(data[start:i])
 			// 	}
 			case '\r':
-				if p.headerValue == "" {
-					p.headerValue = string(data[start:i])
+				key := data[start : start+p.keyLen]
+				value := data[start+p.valueStart : i]
+				if id := framingHeader(key); id >= 0 {
+					p.framing.add(id, value)
 				}
-				switch p.headerKey {
-				case "Transfer-Encoding", "Trailer", "Content-Length":
-					if p.header == nil {
-						p.header = http.Header{}
-					}
-					p.header.Add(p.headerKey, p.headerValue)
-				default:
+
+				p.headerCount++
+				if p.limits.MaxHeaderCount > 0 && p.headerCount > p.limits.MaxHeaderCount {
+					return ErrTooManyHeaders
 				}
 
-				p.processor.OnHeader(p.headerKey, p.headerValue)
-				p.headerKey = ""
-				p.headerValue = ""
+				p.callbacks.OnHeaderBytes(key, value)
+				p.keyLen = 0
+				p.valueStart = 0
 
 				// data = data[i+1:]
 				// i = -1
 				start = i + 1
 				p.nextState(stateHeaderValueLF)
 			default:
-				// if !isToken(c) {
-				// 	return ErrInvalidCharInHeader
-				// }
+				if p.strict && isCTL(c) {
+					return invalidCTL(c)
+				}
 			}
 		case stateHeaderOverLF:
 			if c == '\n' {
@@ -343,25 +550,41 @@ func (p *Parser) Read(data []byte) error {
 					// }
 					if p.contentLength > 0 {
 						p.nextState(stateBodyContentLength)
-					} else {
-						p.handleMessage()
+					} else if p.untilClose {
+						p.nextState(stateBodyUntilClose)
+					} else if stop, err := p.handleMessage(data[start:]); stop {
+						return p.stop(data, start, offset, err)
 					}
 				}
 				continue
 			}
 			return ErrLFExpected
 		case stateBodyContentLength:
+			// contentLength is the size of the body that hasn't been read yet
 			cl := p.contentLength
 			if len(data)-start < cl {
-				p.cache = data[start:]
+				p.contentLength -= len(data) - start
+				p.onBody(data[start:])
+				p.releaseCache()
 				return nil
 			}
-			p.processor.OnBody(data[start : start+cl])
+			p.onBody(data[start : start+cl])
 			// data = data[cl:]
 			i = start + cl - 1
-			start = cl
+			start += cl
 
-			p.handleMessage()
+			if stop, err := p.handleMessage(data[start:]); stop {
+				return p.stop(data, start, offset, err)
+			}
+		case stateBodyUntilClose:
+			// the body is complete when the connection is closed, see eof
+			p.bodySize += len(data) - start
+			if p.limits.MaxBodySize > 0 && p.bodySize > p.limits.MaxBodySize {
+				return ErrBodyTooLarge
+			}
+			p.onBody(data[start:])
+			p.releaseCache()
+			return nil
 		case stateBodyChunkSizeBefore:
 			if isHex(c) {
 				p.chunkSize = -1
@@ -373,15 +596,27 @@ func (p *Parser) Read(data []byte) error {
 			}
 			return ErrInvalidChunkSize
 		case stateBodyChunkSize:
+			// the size may have any number of leading zeros
+			if max := p.limits.MaxLineSize; max > 0 && i-start >= max {
+				return ErrChunkLineTooLarge
+			}
 			switch c {
 			case '\r':
+				if p.strict {
+					if err := checkChunkExtension(data[start:i]); err != nil {
+						return err
+					}
+				}
 				if p.chunkSize < 0 {
-					cs := string(data[start:i])
-					chunkSize, err := strconv.ParseInt(cs, 16, 63)
-					if err != nil || chunkSize < 0 {
-						return fmt.Errorf("invalid chunk size %v", cs)
+					chunkSize, ok := parseHex(data[start:i])
+					if !ok {
+						return fmt.Errorf("invalid chunk size %s", data[start:i])
 					}
 					p.chunkSize = int(chunkSize)
+					p.extStart = i - start
+				}
+				if err := p.onChunkHeader(data[start+p.extStart : i]); err != nil {
+					return err
 				}
 				// data = data[i+1:]
 				// i = -1
@@ -389,14 +624,16 @@ func (p *Parser) Read(data []byte) error {
 				p.nextState(stateBodyChunkSizeLF)
 			default:
 				if !isHex(c) && p.chunkSize < 0 {
-					cs := string(data[start:i])
-					chunkSize, err := strconv.ParseInt(cs, 16, 63)
-					if err != nil || chunkSize < 0 {
-						return fmt.Errorf("invalid chunk size %v", cs)
+					chunkSize, ok := parseHex(data[start:i])
+					if !ok {
+						return fmt.Errorf("invalid chunk size %s", data[start:i])
 					}
 					p.chunkSize = int(chunkSize)
-				} else {
-					// chunk extension
+					p.extStart = i - start
+				}
+				// chunk extension
+				if max := p.limits.MaxChunkExtensionSize; p.chunkSize >= 0 && max > 0 && i-start-p.extStart >= max {
+					return ErrChunkExtensionTooLarge
 				}
 			}
 		case stateBodyChunkSizeLF:
@@ -405,9 +642,18 @@ func (p *Parser) Read(data []byte) error {
 				// i = -1
 				start = i + 1
 				if p.chunkSize > 0 {
+					p.bodySize += p.chunkSize
+					if p.limits.MaxBodySize > 0 && p.bodySize > p.limits.MaxBodySize {
+						return ErrBodyTooLarge
+					}
 					p.nextState(stateBodyChunkData)
 				} else {
 					// chunk size is 0
+					if p.decoding {
+						if err := p.decodeBody(); err != nil {
+							return err
+						}
+					}
 
 					if len(p.trailer) > 0 {
 						// read trailer headers
@@ -421,11 +667,14 @@ func (p *Parser) Read(data []byte) error {
 			}
 			return ErrLFExpected
 		case stateBodyChunkData:
+			// chunkSize is the size of the chunk that hasn't been read yet
 			if len(data)-start < p.chunkSize {
-				p.cache = data[start:]
+				p.chunkSize -= len(data) - start
+				p.onBody(data[start:])
+				p.releaseCache()
 				return nil
 			}
-			p.processor.OnBody(data[start : start+p.chunkSize])
+			p.onBody(data[start : start+p.chunkSize])
 			// data = data[p.chunkSize:]
 			start += p.chunkSize
 			i = start - 1
@@ -438,6 +687,9 @@ func (p *Parser) Read(data []byte) error {
 			return ErrCRExpected
 		case stateBodyChunkDataLF:
 			if c == '\n' {
+				if cp := p.chunkProcessor(); cp != nil {
+					cp.OnChunkEnd()
+				}
 				p.nextState(stateBodyChunkSizeBefore)
 				continue
 			}
@@ -471,20 +723,23 @@ func (p *Parser) Read(data []byte) error {
 				p.nextState(stateTailLF)
 				continue
 			}
+			if p.strict {
+				return ErrInvalidCharInHeader
+			}
 		case stateBodyTrailerHeaderKey:
 			switch c {
 			case ' ':
-				if p.headerKey == "" {
-					p.headerKey = http.CanonicalHeaderKey(string(data[start:i]))
+				if p.strict {
+					return ErrInvalidCharInHeader
+				}
+				if p.keyLen == 0 {
+					p.keyLen = i - start
 				}
 				continue
 			case ':':
-				if p.headerKey == "" {
-					p.headerKey = http.CanonicalHeaderKey(string(data[start:i]))
+				if p.keyLen == 0 {
+					p.keyLen = i - start
 				}
-				// data = data[i+1:]
-				// i = -1
-				start = i + 1
 				p.nextState(stateBodyTrailerHeaderValueBefore)
 				continue
 			}
@@ -498,7 +753,7 @@ func (p *Parser) Read(data []byte) error {
 				if !isToken(c) {
 					return ErrInvalidCharInHeader
 				}
-				start = i
+				p.valueStart = i - start
 				p.nextState(stateBodyTrailerHeaderValue)
 			}
 		case stateBodyTrailerHeaderValue:
@@ -508,25 +763,34 @@ func (p *Parser) Read(data []byte) error {
 			// 		p.headerValue = string(data[start:i])
 			// 	}
 			case '\r':
-				if p.headerValue == "" {
-					p.headerValue = string(data[start:i])
-				}
+				key := data[start : start+p.keyLen]
+				value := data[start+p.valueStart : i]
 				if len(p.trailer) == 0 {
-					return fmt.Errorf("invalid trailer '%v'", p.headerKey)
+					return fmt.Errorf("invalid trailer '%s'", key)
+				}
+				for k := range p.trailer {
+					if asciiEqualFold(key, k) {
+						delete(p.trailer, k)
+						break
+					}
+				}
+
+				p.headerCount++
+				if p.limits.MaxHeaderCount > 0 && p.headerCount > p.limits.MaxHeaderCount {
+					return ErrTooManyHeaders
 				}
-				delete(p.trailer, p.headerKey)
 
-				p.processor.OnTrailerHeader(p.headerKey, p.headerValue)
+				p.callbacks.OnTrailerHeaderBytes(key, value)
 				// data = data[i+1:]
 				// i = -1
 				start = i + 1
-				p.headerKey = ""
-				p.headerValue = ""
+				p.keyLen = 0
+				p.valueStart = 0
 				p.nextState(stateBodyTrailerHeaderValueLF)
 			default:
-				// if !isToken(c) {
-				// 	return ErrInvalidCharInHeader
-				// }
+				if p.strict && isCTL(c) {
+					return invalidCTL(c)
+				}
 			}
 		case stateTailCR:
 			if c == '\r' {
@@ -539,17 +803,57 @@ func (p *Parser) Read(data []byte) error {
 				// data = data[i+1:]
 				// i = -1
 				start = i + 1
-				p.handleMessage()
+				if stop, err := p.handleMessage(data[start:]); stop {
+					return p.stop(data, start, offset, err)
+				}
 				continue
 			}
 			return ErrLFExpected
 		default:
 		}
 	}
-	p.cache = data[start:]
+	p.keep(data, start, offset)
+	if p.maxReadSize > 0 && len(p.cache) > p.maxReadSize {
+		return ErrReadLimitExceeded
+	}
 	return nil
 }
 
+// keep stores the unparsed bytes data[start:] for the next Read, they are
+// copied if they still belong to the caller's buffer, which may be reused
+// after Read returns, or moved to the start of the cache otherwise.
+func (p *Parser) keep(data []byte, start int, offset int) {
+	if start == len(data) {
+		p.releaseCache()
+		return
+	}
+	if offset > 0 {
+		p.cache = append(data[:0], data[start:]...)
+		return
+	}
+	if p.cacheBuf == nil {
+		p.cacheBuf = buffers.get()
+		p.cache = *p.cacheBuf
+	}
+	p.cache = append(p.cache[:0], data[start:]...)
+}
+
+// releaseCache returns the buffer of the cache to the pool once its data
+// has been parsed, so that idle connections don't hold one.
+func (p *Parser) releaseCache() {
+	if p.cacheBuf != nil {
+		*p.cacheBuf = p.cache
+		buffers.put(p.cacheBuf)
+		p.cacheBuf = nil
+	}
+	p.cache = nil
+}
+
+// Conn returns the connection the parser reads.
+func (p *Parser) Conn() net.Conn {
+	return p.conn
+}
+
 // Session returns user session
 func (p *Parser) Session() interface{} {
 	return p.session
@@ -560,56 +864,316 @@ func (p *Parser) SetSession(session interface{}) {
 	p.session = session
 }
 
-func (p *Parser) parseTransferEncoding() error {
-	raw, present := p.header["Transfer-Encoding"]
-	if !present {
+// onClose is called when the connection of the parser has been closed.
+func (p *Parser) onClose(err error) {
+	if pc, ok := p.processor.(interface{ onClose(err error) }); ok {
+		pc.onClose(err)
+	}
+	p.upgraderMux.Lock()
+	u := p.upgrader
+	p.upgraderMux.Unlock()
+	if uc, ok := u.(interface{ onClose(err error) }); ok {
+		uc.onClose(err)
+	}
+}
+
+// parseFraming reads the headers that delimit the body. A response has no
+// body if bodyless, and without Content-Length or chunked its body is read
+// until the connection is closed.
+func (p *Parser) parseFraming() error {
+	if p.isClient && p.bodyless() {
+		p.contentLength = 0
 		return nil
 	}
-	delete(p.header, "Transfer-Encoding")
+	if err := p.parseTransferEncoding(); err != nil {
+		return err
+	}
+	if err := p.parseContentLength(); err != nil {
+		return err
+	}
+	if p.isClient && !p.chunked && p.contentLength < 0 {
+		p.untilClose = true
+	}
+	return nil
+}
+
+// bodyless reports whether the response being read has no body whatever
+// its headers say: the 1xx, 204 and 304 responses, the response to a HEAD
+// request and the 2xx response to a CONNECT request.
+func (p *Parser) bodyless() bool {
+	return p.method() == http.MethodHead || p.tunnel() || (p.statusCode >= 100 && p.statusCode < 200) ||
+		p.statusCode == http.StatusNoContent || p.statusCode == http.StatusNotModified
+}
+
+// tunnel reports whether the connection is no longer HTTP after the
+// response being read: a 101 response, or a 2xx response to a CONNECT
+// request.
+func (p *Parser) tunnel() bool {
+	return p.statusCode == http.StatusSwitchingProtocols ||
+		(p.method() == http.MethodConnect && p.statusCode/100 == 2)
+}
+
+// method returns the method of the request whose response is being read,
+// empty if the client didn't call ExpectResponse.
+func (p *Parser) method() string {
+	if len(p.requests) == 0 {
+		return ""
+	}
+	return p.requests[0]
+}
 
-	if len(raw) != 1 {
-		return fmt.Errorf("too many transfer encodings: %q", raw)
+// parseTransferEncoding reads the codings of the repeated or comma-separated
+// Transfer-Encoding values. chunked must be the final coding of a request,
+// the body of a response without it is read until the connection is closed.
+func (p *Parser) parseTransferEncoding() error {
+	h := &p.framing
+	if h.count(framingTransferEncoding) == 0 {
+		return nil
+	}
+	if p.strict {
+		if err := p.checkTransferEncoding(); err != nil {
+			return err
+		}
+	}
+	chunked := false
+	for i := 0; i < h.count(framingTransferEncoding); i++ {
+		v := h.value(framingTransferEncoding, i)
+		for len(v) > 0 {
+			elem := v
+			v = nil
+			if n := bytes.IndexByte(elem, ','); n >= 0 {
+				elem, v = elem[:n], elem[n+1:]
+			}
+			elem = trimOWS(elem)
+			if len(elem) == 0 {
+				continue
+			}
+			if chunked {
+				// chunked is applied once, last
+				return ErrInvalidTransferEncoding
+			}
+			coding, ok := transferCoding(elem)
+			if !ok {
+				chunked = asciiEqualFold(elem, "chunked")
+				continue
+			}
+			if coding == codingUnknown && p.decode {
+				return ErrUnsupportedTransferEncoding
+			}
+			p.codings = append(p.codings, coding)
+		}
 	}
-	if strings.ToLower(textproto.TrimString(raw[0])) != "chunked" {
-		return fmt.Errorf("unsupported transfer encoding: %q", raw[0])
+	if !chunked && !p.isClient {
+		return ErrInvalidTransferEncoding
 	}
-	delete(p.header, "Content-Length")
-	p.chunked = true
+	if !p.isClient && (h.count(framingContentLength) > 0 || p.http10) {
+		// the framing may be understood differently by an intermediary,
+		// RFC 9112 section 6.3
+		p.mustClose = true
+	}
+	h.del(framingContentLength)
+	p.chunked = chunked
+	p.decoding = p.decode && len(p.codings) > 0
+	return nil
+}
 
+// checkTransferEncoding rejects the ambiguous uses of Transfer-Encoding in
+// strict mode: with Content-Length, or in an HTTP/1.0 request.
+func (p *Parser) checkTransferEncoding() error {
+	if p.framing.count(framingContentLength) > 0 {
+		return ErrUnexpectedContentLength
+	}
+	if !p.isClient && p.http10 {
+		return ErrInvalidTransferEncoding
+	}
 	return nil
 }
 
 func (p *Parser) parseContentLength() (err error) {
-	if cl := p.header.Get("Content-Length"); cl != "" {
+	h := &p.framing
+	if cl := h.get(framingContentLength); len(cl) > 0 {
 		if p.chunked {
 			return ErrUnexpectedContentLength
 		}
-		l, err := strconv.ParseInt(cl, 10, 63)
-		if err != nil {
+		if cl[0] == '-' {
+			return ErrInvalidContentLength
+		}
+		l, ok := parseDecimal(cl)
+		if !ok {
 			return fmt.Errorf("%s %q", "bad Content-Length", cl)
 		}
-		if l < 0 {
-			return ErrInvalidContentLength
+		// the values of repeated headers must agree, RFC 9112 section 6.3
+		for i := 1; i < h.count(framingContentLength); i++ {
+			if p.strict {
+				return ErrInvalidContentLength
+			}
+			if v, ok := parseDecimal(h.value(framingContentLength, i)); !ok || v != l {
+				return ErrInvalidContentLength
+			}
 		}
 		p.contentLength = int(l)
+		if p.limits.MaxBodySize > 0 && p.contentLength > p.limits.MaxBodySize {
+			return ErrBodyTooLarge
+		}
 	} else {
 		p.contentLength = -1
 	}
 	return nil
 }
 
-func (p *Parser) parseTrailer() error {
-	if !p.chunked {
+// checkChunkExtension checks the line of a chunk size in strict mode, only
+// chunk extensions may follow the size.
+func checkChunkExtension(line []byte) error {
+	n := 0
+	for n < len(line) && isHex(line[n]) {
+		n++
+	}
+	ext := line[n:]
+	for len(ext) > 0 && (ext[0] == ' ' || ext[0] == '\t') {
+		ext = ext[1:]
+	}
+	if len(ext) > 0 && ext[0] != ';' {
+		return ErrInvalidChunkSize
+	}
+	for _, c := range ext {
+		if isCTL(c) {
+			return invalidCTL(c)
+		}
+	}
+	return nil
+}
+
+// onChunkHeader passes the size and extensions of a chunk to the
+// ChunkProcessor. The extensions count toward the size of the body, so that
+// many small chunks with large extensions can't exceed it.
+func (p *Parser) onChunkHeader(ext []byte) error {
+	p.bodySize += len(ext)
+	if p.limits.MaxBodySize > 0 && p.bodySize > p.limits.MaxBodySize {
+		return ErrBodyTooLarge
+	}
+	cp := p.chunkProcessor()
+	if cp == nil {
 		return nil
 	}
-	header := p.header
+	extensions, err := parseChunkExtension(ext)
+	if err != nil {
+		return err
+	}
+	cp.OnChunkHeader(p.chunkSize, extensions)
+	return nil
+}
 
-	trailers, ok := header["Trailer"]
-	if !ok {
+// chunkProcessor returns the processor of the chunks, nil if it doesn't
+// implement ChunkProcessor or the chunks of an encoded body are decoded.
+func (p *Parser) chunkProcessor() ChunkProcessor {
+	if p.decoding {
 		return nil
 	}
+	if cp, ok := p.callbacks.(ChunkProcessor); ok {
+		return cp
+	}
+	cp, _ := p.processor.(ChunkProcessor)
+	return cp
+}
 
-	header.Del("Trailer")
+// parseChunkExtension parses the extensions of a chunk, the names and
+// values of a list of ";name" or ";name=value", whose values are tokens or
+// quoted strings. It returns nil if there are none.
+func parseChunkExtension(ext []byte) (map[string]string, error) {
+	var extensions map[string]string
+	for {
+		ext = trimBWS(ext)
+		if len(ext) == 0 {
+			return extensions, nil
+		}
+		if ext[0] != ';' {
+			return nil, ErrInvalidChunkExtension
+		}
+		ext = trimBWS(ext[1:])
+		n := 0
+		for n < len(ext) && isToken(ext[n]) {
+			n++
+		}
+		if n == 0 {
+			return nil, ErrInvalidChunkExtension
+		}
+		name := string(ext[:n])
+		ext = trimBWS(ext[n:])
+		value := ""
+		if len(ext) > 0 && ext[0] == '=' {
+			ext = trimBWS(ext[1:])
+			var err error
+			if value, ext, err = parseChunkExtensionValue(ext); err != nil {
+				return nil, err
+			}
+		}
+		if extensions == nil {
+			extensions = map[string]string{}
+		}
+		extensions[name] = value
+	}
+}
+
+// parseChunkExtensionValue parses a token or a quoted string at the start of
+// ext, and returns the rest of ext.
+func parseChunkExtensionValue(ext []byte) (string, []byte, error) {
+	if len(ext) > 0 && ext[0] == '"' {
+		var value []byte
+		for i := 1; i < len(ext); i++ {
+			switch c := ext[i]; {
+			case c == '"':
+				return string(value), ext[i+1:], nil
+			case c == '\\' && i+1 < len(ext) && !isCTL(ext[i+1]):
+				i++
+				value = append(value, ext[i])
+			case c == '\\' || isCTL(c):
+				return "", nil, ErrInvalidChunkExtension
+			default:
+				value = append(value, c)
+			}
+		}
+		return "", nil, ErrInvalidChunkExtension
+	}
+	n := 0
+	for n < len(ext) && isToken(ext[n]) {
+		n++
+	}
+	if n == 0 {
+		return "", nil, ErrInvalidChunkExtension
+	}
+	return string(ext[:n]), ext[n:], nil
+}
+
+// trimBWS trims the spaces and tabs at the start of b.
+func trimBWS(b []byte) []byte {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+		b = b[1:]
+	}
+	return b
+}
+
+// isCTL reports whether c is a control character other than HTAB, which
+// can't appear in the field values.
+func isCTL(c byte) bool {
+	return (c < ' ' && c != '\t') || c == 0x7f
+}
+
+// invalidCTL returns the error of a control character in a field value.
+func invalidCTL(c byte) error {
+	if c == '\n' {
+		return ErrInvalidCRLF
+	}
+	return ErrInvalidCharInHeader
+}
+
+func (p *Parser) parseTrailer() error {
+	if !p.chunked {
+		return nil
+	}
+	trailers := p.framing.strings(framingTrailer)
+	if len(trailers) == 0 {
+		return nil
+	}
 
 	trailer := http.Header{}
 	for _, key := range trailers {
@@ -645,15 +1209,269 @@ func (p *Parser) parseTrailer() error {
 	return nil
 }
 
-func (p *Parser) handleMessage() {
-	p.processor.OnComplete(p.conn)
-	p.header = nil
+// handleMessage completes a message, rest is the data read after it. It
+// reports whether rest must not be parsed as HTTP, because the connection
+// has been upgraded or hijacked by the handler, or the handler of an
+// upgrade request has not returned yet.
+func (p *Parser) handleMessage(rest []byte) (bool, error) {
+	// an informational response precedes the final response to the same
+	// request
+	informational := p.isClient && p.statusCode/100 == 1 && p.statusCode != http.StatusSwitchingProtocols
+	if !informational && len(p.requests) > 0 {
+		p.requests = append(p.requests[:0], p.requests[1:]...)
+	}
+
+	upgrade := p.upgrade
+	if upgrade {
+		p.raw = append(p.raw, rest...)
+		p.nextState(stateUpgradePending)
+	} else {
+		p.rest = rest
+		if !p.isClient {
+			p.nextState(stateMethodBefore)
+		} else {
+			p.nextState(stateClientProtoBefore)
+		}
+	}
+
+	if ip := p.informationalProcessor(); informational && ip != nil {
+		ip.OnInformational(p.conn)
+	} else {
+		p.callbacks.OnComplete(p.conn)
+	}
+	p.framing.reset()
+	p.chunked = false
+	p.contentLength = 0
+	p.trailer = nil
+	p.headerSize = 0
+	p.headerCount = 0
+	p.bodySize = 0
+	p.connect = false
+	p.upgrade = false
+	p.rest = nil
+	p.mustClose = false
+	p.decoding = false
+	p.codings = p.codings[:0]
+	p.untilClose = false
+	p.statusCode = 0
+
+	switch p.state {
+	case stateUpgradePending:
+		p.releaseCache()
+		if p.deferred || p.isClient {
+			// the data after a tunnel response is kept for whoever takes
+			// over the connection
+			return true, nil
+		}
+		// the handler returned without taking over the connection
+		return true, p.resume()
+	case stateUpgraded, stateHijacked, stateClosing:
+		return true, nil
+	case stateMethodBefore:
+		if pl, ok := p.processor.(pipeliner); ok && pl.pipelineFull() {
+			// the rest is kept by stop until unblock
+			p.nextState(statePipelineFull)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pipeliner is implemented by the processors that bound the number of
+// requests whose responses are not written yet. pipelineFull reports
+// whether the parser must stop reading requests, it then calls unblock once
+// responses have been written.
+type pipeliner interface {
+	pipelineFull() bool
+}
+
+// stop ends a Read interrupted by handleMessage, the data after start is
+// kept if the pipeline is full.
+func (p *Parser) stop(data []byte, start int, offset int, err error) error {
+	if p.state == statePipelineFull {
+		p.keep(data, start, offset)
+	}
+	return err
+}
+
+// unblock parses the data read while the pipeline was full.
+func (p *Parser) unblock() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.state != statePipelineFull {
+		return nil
+	}
+	p.nextState(stateMethodBefore)
+	data, buf := p.cache, p.cacheBuf
+	p.cache, p.cacheBuf = nil, nil
+	err := p.read(data)
+	if buf != nil {
+		*buf = data
+		buffers.put(buf)
+	}
+	return err
+}
+
+// Close is called when the peer has closed the connection, it completes a
+// response whose body is delimited by the end of the connection. It returns
+// io.ErrUnexpectedEOF if a message was being read, and the data read after
+// it is discarded. Close must not be called by the processor during Read.
+func (p *Parser) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	var err error
+	switch p.state {
+	case stateMethodBefore, stateClientProtoBefore, stateUpgradePending,
+		stateUpgraded, stateHijacked, stateClosing:
+		return nil
+	case stateBodyUntilClose:
+		if p.decoding {
+			err = p.decodeBody()
+		}
+		if err == nil {
+			_, err = p.handleMessage(nil)
+		}
+	default:
+		err = io.ErrUnexpectedEOF
+	}
+	p.releaseCache()
+	p.nextState(stateClosing)
+	return err
+}
+
+// ExpectResponse is called by a client before it sends a request, with the
+// method of the request, so that the responses are read by the rules of the
+// requests they answer: the response to a HEAD request has no body, and the
+// connection is a tunnel after a 2xx response to a CONNECT request. The
+// requests may be pipelined, their responses are expected in order. It must
+// not be called by the processor during Read.
+func (p *Parser) ExpectResponse(method string) {
+	p.mux.Lock()
+	p.requests = append(p.requests, method)
+	p.mux.Unlock()
+}
+
+// informationalProcessor returns the processor of the 1xx responses, nil if
+// they're passed to OnComplete like the final responses.
+func (p *Parser) informationalProcessor() InformationalProcessor {
+	if ip, ok := p.callbacks.(InformationalProcessor); ok {
+		return ip
+	}
+	ip, _ := p.processor.(InformationalProcessor)
+	return ip
+}
+
+// phase returns the part of a request being read, for the timeouts of the
+// server.
+func (p *Parser) phase() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	switch {
+	case p.state >= statePipelineFull:
+		return phaseNone
+	case p.state == stateMethodBefore && len(p.cache) == 0:
+		return phaseIdle
+	case p.state < stateBodyContentLength || p.state == stateHeaderOverLF:
+		return phaseHeader
+	}
+	return phaseBody
+}
+
+// closing makes the parser discard the data read after the current request,
+// whose response closes the connection.
+func (p *Parser) closing() {
+	if p.state != stateUpgradePending {
+		p.nextState(stateClosing)
+	}
+}
+
+// discard makes the parser discard the data read after an error.
+func (p *Parser) discard() {
+	p.mux.Lock()
+	p.releaseCache()
+	p.nextState(stateClosing)
+	p.mux.Unlock()
+}
+
+// resume parses the data read after an upgrade request as HTTP again.
+func (p *Parser) resume() error {
+	p.deferred = false
+	p.nextState(stateMethodBefore)
+	data := p.raw
+	p.raw = nil
+	return p.read(data)
+}
+
+// upgrading reports whether the request being handled is a CONNECT or
+// Upgrade request.
+func (p *Parser) upgrading() bool {
+	return p.upgrade || p.state == stateUpgradePending
+}
 
-	if !p.isClient {
-		p.nextState(stateMethodBefore)
+// upgradeDone is called when the handler of an upgrade request returns on
+// another goroutine without taking over the connection.
+func (p *Parser) upgradeDone() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.state != stateUpgradePending {
+		// the request is not complete yet
+		p.deferred = false
+		return nil
+	}
+	return p.resume()
+}
+
+// isUpgraded reports whether the parser no longer reads HTTP.
+func (p *Parser) isUpgraded() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.state == stateUpgraded || p.state == stateHijacked
+}
+
+// takeRead returns the data read after the current request, async reports
+// whether the connection is taken over by a handler that doesn't run inside
+// Read.
+func (p *Parser) takeRead(async bool) []byte {
+	data := append([]byte(nil), p.raw...)
+	if async {
+		data = append(data, p.cache...)
 	} else {
-		p.nextState(stateClientProtoBefore)
+		data = append(data, p.rest...)
 	}
+	p.raw = nil
+	p.rest = nil
+	p.releaseCache()
+	return data
+}
+
+// upgradeTo makes u read the data of the connection.
+func (p *Parser) upgradeTo(u Upgrader, async bool) error {
+	data := p.takeRead(async)
+	p.upgraderMux.Lock()
+	p.upgrader = u
+	p.upgraderMux.Unlock()
+	p.nextState(stateUpgraded)
+	if len(data) > 0 {
+		return u.Read(p, data)
+	}
+	return nil
+}
+
+// hijack stops the parser and returns the data read after the current
+// request.
+func (p *Parser) hijack(async bool) []byte {
+	data := p.takeRead(async)
+	p.nextState(stateHijacked)
+	return data
+}
+
+// NewBytesParser creates a parser that passes the messages to a
+// BytesProcessor, without converting their parts to strings.
+func NewBytesParser(conn net.Conn, processor BytesProcessor, isClient bool, maxReadSize int) *Parser {
+	p := NewParser(conn, nil, isClient, maxReadSize)
+	p.callbacks = processor
+	return p
 }
 
 // NewParser .
@@ -665,11 +1483,22 @@ func NewParser(conn net.Conn, processor Processor, isClient bool, maxReadSize in
 	if isClient {
 		state = stateClientProtoBefore
 	}
-	return &Parser{
+	p := &Parser{
 		conn:        conn,
 		state:       state,
+		limits:      Limits{}.withDefaults(),
+		methods:     StrictMethods,
 		maxReadSize: maxReadSize,
 		isClient:    isClient,
 		processor:   processor,
 	}
+	if bp, ok := processor.(BytesProcessor); ok {
+		p.callbacks = bp
+	} else {
+		p.callbacks = stringProcessor{processor}
+	}
+	if ps, ok := processor.(interface{ setParser(*Parser) }); ok {
+		ps.setParser(p)
+	}
+	return p
 }
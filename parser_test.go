@@ -1,10 +1,15 @@
 package nbhttp
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 )
@@ -51,6 +56,410 @@ func TestClientParserTrailer(t *testing.T) {
 	testParser(t, true, data)
 }
 
+func TestParserLimits(t *testing.T) {
+	limits := Limits{
+		MaxLineSize:    32,
+		MaxHeaderSize:  64,
+		MaxHeaderCount: 2,
+		MaxBodySize:    8,
+	}
+	cases := []struct {
+		data string
+		err  error
+	}{
+		{"GET /" + strings.Repeat("a", 32) + " HTTP/1.1\r\n\r\n", ErrLineTooLarge},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: " + strings.Repeat("a", 64) + "\r\n\r\n", ErrHeaderTooLarge},
+		{"GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", ErrTooManyHeaders},
+		{"POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n", ErrBodyTooLarge},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n", ErrBodyTooLarge},
+		{"POST / HTTP/1.1\r\nContent-Length: 8\r\n\r\n12345678", nil},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + strings.Repeat("0", 32) + "5\r\nhello\r\n", ErrChunkLineTooLarge},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTrailer: X-T\r\n\r\n0\r\nX-T: " + strings.Repeat("a", 64) + "\r\n\r\n", ErrHeaderTooLarge},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTrailer: X-T\r\n\r\n0\r\n" + strings.Repeat("!", 64), ErrHeaderTooLarge},
+	}
+	for _, v := range cases {
+		mux := &http.ServeMux{}
+		mux.HandleFunc("/", func(http.ResponseWriter, *http.Request) {})
+		parser := NewParser(nil, NewServerProcessor(mux), false, 1024*1024*4)
+		parser.SetLimits(limits)
+		var err error
+		for i := 0; i < len(v.data) && err == nil; i++ {
+			err = parser.Read([]byte(v.data[i : i+1]))
+		}
+		if err != v.err {
+			t.Fatalf("%q: expected %v, got %v", v.data, v.err, err)
+		}
+	}
+}
+
+func TestParserStrict(t *testing.T) {
+	cases := []struct {
+		data  string
+		lax   bool  // accepted without strict mode
+		err   error // error in strict mode
+		close bool  // the connection is closed after the request without strict mode
+	}{
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nX-Text: caf\xc3\xa9\tb\r\n\r\n5;name=\"v\"\r\nhello\r\n0\r\n\r\n", true, nil, false},
+		// CL.CL
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!", false, ErrInvalidContentLength, false},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", true, ErrInvalidContentLength, false},
+		// CL.TE and TE.CL
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", true, ErrUnexpectedContentLength, true},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n", true, ErrUnexpectedContentLength, true},
+		// whitespace before the colon
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", true, ErrInvalidCharInHeader, false},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length : 5\r\n\r\nhello", true, ErrInvalidCharInHeader, false},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTrailer: X-T\r\n\r\n0\r\nX-T : 1\r\n\r\n", true, ErrInvalidCharInHeader, false},
+		// obs-fold
+		{"POST / HTTP/1.1\r\nHost: a\r\nX-Foo: a\r\n\tTransfer-Encoding: chunked\r\n\r\n", false, ErrInvalidCharInHeader, false},
+		{"POST / HTTP/1.1\r\nHost: a\r\nX-Foo: a\r\n Content-Length: 5\r\n\r\n", false, ErrInvalidCharInHeader, false},
+		// bare LF and control characters
+		{"POST / HTTP/1.1\r\nHost: a\r\nX-Foo: a\nTransfer-Encoding: chunked\r\n\r\n", true, ErrInvalidCRLF, false},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX-Foo: a\x00b\r\n\r\n", true, ErrInvalidCharInHeader, false},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX-Foo: a\x7fb\r\n\r\n", true, ErrInvalidCharInHeader, false},
+		{"GET /a\x01b HTTP/1.1\r\nHost: a\r\n\r\n", false, ErrInvalidRequestURI, false},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;a\nb\r\nhello\r\n0\r\n\r\n", true, ErrInvalidCRLF, false},
+		// Transfer-Encoding
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, identity\r\n\r\n", false, ErrInvalidTransferEncoding, false},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, chunked\r\n\r\n", false, ErrInvalidTransferEncoding, false},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n", false, ErrInvalidTransferEncoding, false},
+		{"POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", true, ErrInvalidTransferEncoding, true},
+		// chunk size
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5x\r\nhello\r\n0\r\n\r\n", true, ErrInvalidChunkSize, false},
+		// request line
+		{"GET  / HTTP/1.1\r\nHost: a\r\n\r\n", true, ErrInvalidRequestURI, false},
+		{"GET / HTTP/1.1 x\r\nHost: a\r\n\r\n", true, ErrInvalidHTTPVersion, false},
+		{"GET / HTTP/1.1\nHost: a\r\n\r\n", false, ErrInvalidHTTPVersion, false},
+	}
+	for _, v := range cases {
+		for _, strict := range []bool{false, true} {
+			for _, step := range []int{len(v.data), 1} {
+				nRequest := 0
+				closed := false
+				mux := &http.ServeMux{}
+				mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+					nRequest++
+					closed = closed || request.Close
+				})
+				parser := NewParser(nil, NewServerProcessor(mux), false, 1024*1024*4)
+				parser.SetStrict(strict)
+				data := v.data
+				if !strict && v.lax {
+					// not parsed if the connection is closed after the first
+					data += "GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+				}
+				var err error
+				for i := 0; i < len(data) && err == nil; i += step {
+					err = parser.Read([]byte(data[i:min(i+step, len(data))]))
+				}
+				switch {
+				case strict && err != v.err:
+					t.Fatalf("%q: expected %v in strict mode, got %v", v.data, v.err, err)
+				case strict && err == nil && nRequest != 1:
+					t.Fatalf("%q: expected a request in strict mode, got %v", v.data, nRequest)
+				case !strict && v.lax && (err != nil || closed != v.close || (closed && nRequest != 1) || (!closed && nRequest != 2)):
+					t.Fatalf("%q: expected close %v, got %v requests, close %v, %v", v.data, v.close, nRequest, closed, err)
+				case !strict && !v.lax && err == nil:
+					t.Fatalf("%q: error expected", v.data)
+				}
+			}
+		}
+	}
+}
+
+func gzipData(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func zlibData(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func chunkedData(data []byte) string {
+	return fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(data), data)
+}
+
+func TestParserTransferCodings(t *testing.T) {
+	body := []byte(strings.Repeat("hello world ", 100))
+	gzipped := gzipData(body)
+	layered := gzipData(zlibData(body))
+	cases := []struct {
+		data   string
+		decode bool
+		body   []byte
+		err    error
+	}{
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n" + chunkedData(gzipped), true, body, nil},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n" + chunkedData(gzipped), false, gzipped, nil},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: deflate\r\nTransfer-Encoding: x-gzip ,chunked\r\n\r\n" + chunkedData(layered), true, body, nil},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: br, chunked\r\n\r\n" + chunkedData(body), false, body, nil},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: br, chunked\r\n\r\n", true, nil, ErrUnsupportedTransferEncoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", true, nil, ErrInvalidTransferEncoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n", true, nil, ErrInvalidTransferEncoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n" + chunkedData(gzipData(make([]byte, 4096))), true, nil, ErrBodyTooLarge},
+	}
+	for _, v := range cases {
+		for _, step := range []int{len(v.data), 1} {
+			var got []byte
+			mux := &http.ServeMux{}
+			mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+				got, _ = io.ReadAll(request.Body)
+			})
+			parser := NewParser(nil, NewServerProcessor(mux), false, 1024*1024*4)
+			parser.SetLimits(Limits{MaxBodySize: 2048})
+			parser.SetTransferDecoding(v.decode)
+			var err error
+			for i := 0; i < len(v.data) && err == nil; i += step {
+				err = parser.Read([]byte(v.data[i:min(i+step, len(v.data))]))
+			}
+			if err != v.err || !bytes.Equal(got, v.body) {
+				t.Fatalf("%q: expected %v %v bytes, got %v %v bytes", v.data[:40], v.err, len(v.body), err, len(got))
+			}
+		}
+	}
+
+	// the body of a response without chunked ends with the connection
+	var got []byte
+	parser := NewParser(nil, NewClientProcessor(func(res *http.Response) {
+		got, _ = io.ReadAll(res.Body)
+	}), true, 1024*1024*4)
+	parser.SetTransferDecoding(true)
+	if err := parser.Read(append([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip\r\n\r\n"), gzipped...)); err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Fatal("response complete before the end of the connection")
+	}
+	if err := parser.Close(); err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("invalid body: %v, %v bytes", err, len(got))
+	}
+}
+
+func TestParserResponseFraming(t *testing.T) {
+	var bodies []string
+	var informational []int
+	processor := NewClientProcessor(func(res *http.Response) {
+		body := ""
+		if res.Body != nil {
+			data, _ := io.ReadAll(res.Body)
+			body = string(data)
+		}
+		bodies = append(bodies, body)
+	})
+	processor.(*ClientProcessor).HandleInformational(func(res *http.Response) {
+		informational = append(informational, res.StatusCode)
+	})
+	parser := NewParser(nil, processor, true, 1024*1024*4)
+
+	for _, method := range []string{"GET", "GET", "HEAD", "GET"} {
+		parser.ExpectResponse(method)
+	}
+	data := "HTTP/1.1 204 No Content\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"HTTP/1.1 304 Not Modified\r\nContent-Length: 1000\r\n\r\n" +
+		"HTTP/1.1 100 Continue\r\nContent-Length: 1000\r\n\r\n" +
+		"HTTP/1.1 103 Early Hints\r\nX-Hint: style\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n"
+	if err := parser.Read([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.Read([]byte("HTTP/1.0 200 OK\r\n\r\nhello ")); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.Read([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 3 {
+		t.Fatalf("response complete before the end of the connection")
+	}
+	if err := parser.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"", "", "", "hello world"}
+	if strings.Join(bodies, "|") != strings.Join(expected, "|") {
+		t.Fatalf("expected %q, got %q", expected, bodies)
+	}
+	if fmt.Sprint(informational) != "[100 103]" {
+		t.Fatalf("invalid informational responses: %v", informational)
+	}
+
+	// the connection is a tunnel after a 2xx response to CONNECT
+	bodies = nil
+	parser = NewParser(nil, processor, true, 1024*1024*4)
+	parser.ExpectResponse(http.MethodConnect)
+	if err := parser.Read([]byte("HTTP/1.1 200 Connection Established\r\nContent-Length: 1000\r\n\r\nGET / HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.Read([]byte("\x00\x01")); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 || bodies[0] != "" || string(parser.raw) != "GET / HTTP/1.1\r\n\x00\x01" {
+		t.Fatalf("invalid tunnel: %q, %q", bodies, parser.raw)
+	}
+
+	parser = NewParser(nil, NewClientProcessor(func(res *http.Response) {}), true, 1024*1024*4)
+	if err := parser.Read([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.Close(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+type chunkRecorder struct {
+	EmptyProcessor
+	events []string
+}
+
+func (r *chunkRecorder) OnChunkHeader(size int, ext map[string]string) {
+	r.events = append(r.events, fmt.Sprintf("header %d %v", size, ext))
+}
+
+func (r *chunkRecorder) OnChunkEnd() {
+	r.events = append(r.events, "end")
+}
+
+func (r *chunkRecorder) OnBody(data []byte) {
+	if n := len(r.events) - 1; n >= 0 && strings.HasPrefix(r.events[n], "body ") {
+		r.events[n] += string(data)
+		return
+	}
+	r.events = append(r.events, "body "+string(data))
+}
+
+func (r *chunkRecorder) OnComplete(conn net.Conn) {
+	r.events = append(r.events, "complete")
+}
+
+func TestParserChunkExtensions(t *testing.T) {
+	data := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5;name=value;quoted=\"a \\\"b\\\"\";flag\r\nhello\r\n" +
+		"6 ; x = y\r\n world\r\n" +
+		"0;last\r\n\r\n"
+	expected := []string{
+		`header 5 map[flag: name:value quoted:a "b"]`, "body hello", "end",
+		"header 6 map[x:y]", "body  world", "end",
+		"header 0 map[last:]", "complete",
+	}
+	for _, step := range []int{len(data), 1} {
+		r := &chunkRecorder{}
+		parser := NewParser(nil, r, false, 1024*1024*4)
+		for i := 0; i < len(data); i += step {
+			if err := parser.Read([]byte(data[i:min(i+step, len(data))])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if strings.Join(r.events, "|") != strings.Join(expected, "|") {
+			t.Fatalf("expected %q, got %q", expected, r.events)
+		}
+	}
+
+	head := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"
+	cases := []struct {
+		data      string
+		processor Processor
+		err       error
+	}{
+		{head + "5;=x\r\nhello\r\n", &chunkRecorder{}, ErrInvalidChunkExtension},
+		{head + "5;a=\"x\r\nhello\r\n", &chunkRecorder{}, ErrInvalidChunkExtension},
+		{head + "5;a=b c\r\nhello\r\n", &chunkRecorder{}, ErrInvalidChunkExtension},
+		{head + "5;=x\r\nhello\r\n", nil, nil},
+		{head + "5;a=" + strings.Repeat("b", 30) + "\r\nhello\r\n", nil, ErrChunkExtensionTooLarge},
+		{head + strings.Repeat("1;a="+strings.Repeat("b", 20)+"\r\nx\r\n", 10), nil, ErrBodyTooLarge},
+	}
+	for _, v := range cases {
+		for _, step := range []int{len(v.data), 1} {
+			parser := NewParser(nil, v.processor, false, 1024*1024*4)
+			parser.SetLimits(Limits{MaxBodySize: 200, MaxChunkExtensionSize: 32})
+			var err error
+			for i := 0; i < len(v.data) && err == nil; i += step {
+				err = parser.Read([]byte(v.data[i:min(i+step, len(v.data))]))
+			}
+			if err != v.err {
+				t.Fatalf("%q: expected %v, got %v", v.data, v.err, err)
+			}
+		}
+	}
+}
+
+func TestParserMethods(t *testing.T) {
+	webdav, err := StrictMethods.With("PATCH", "PROPFIND", "MKCOL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewMethodPolicy("BAD METHOD"); err == nil {
+		t.Fatal("invalid method registered")
+	}
+	cases := []struct {
+		methods *MethodPolicy
+		method  string
+		want    string
+		err     error
+	}{
+		{nil, "GET", "GET", nil},
+		{nil, "get", "GET", nil},
+		{nil, "PATCH", "", ErrInvalidMethod},
+		{webdav, "PATCH", "PATCH", nil},
+		{webdav, "propfind", "PROPFIND", nil},
+		{webdav, "GET", "GET", nil},
+		{webdav, "LOCK", "", ErrInvalidMethod},
+		{AnyMethod, "X-Custom_1", "X-Custom_1", nil},
+		{AnyMethod, "B@D", "", ErrInvalidMethod},
+	}
+	for _, v := range cases {
+		var method string
+		mux := &http.ServeMux{}
+		mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+			method = request.Method
+		})
+		parser := NewParser(nil, NewServerProcessor(mux), false, 1024*1024*4)
+		parser.SetMethodPolicy(v.methods)
+		err := parser.Read([]byte(v.method + " / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err != v.err || method != v.want {
+			t.Fatalf("%v: expected %q %v, got %q %v", v.method, v.want, v.err, method, err)
+		}
+	}
+}
+
+func TestParserMethodsCaseInsensitive(t *testing.T) {
+	methods, err := NewMethodPolicy("purge", "MKCOL", "BASELINE-CONTROL-X")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		method string
+		want   string
+	}{
+		{"purge", "purge"},
+		{"PURGE", "purge"},
+		{"PuRgE", "purge"},
+		{"mkcol", "MKCOL"},
+		{"MkCol", "MKCOL"},
+		{"baseline-control-x", "BASELINE-CONTROL-X"},
+		{"Baseline-Control-X", "BASELINE-CONTROL-X"},
+	}
+	for _, v := range cases {
+		var method string
+		mux := &http.ServeMux{}
+		mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+			method = request.Method
+		})
+		parser := NewParser(nil, NewServerProcessor(mux), false, 1024*1024*4)
+		parser.SetMethodPolicy(methods)
+		err := parser.Read([]byte(v.method + " / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err != nil || method != v.want {
+			t.Fatalf("%v: expected %q, got %q %v", v.method, v.want, method, err)
+		}
+	}
+}
+
 func testParser(t *testing.T, isClient bool, data []byte) error {
 	parser := newParser(isClient)
 	err := parser.Read(data)
@@ -178,6 +587,200 @@ func BenchmarkServerProcessor(b *testing.B) {
 	}
 }
 
+func TestParserHeaderKeys(t *testing.T) {
+	for key, want := range map[string]string{
+		"content-type":      "Content-Type",
+		"HOST":              "Host",
+		"x-forwarded-for":   "X-Forwarded-For",
+		"x-custom":          "X-Custom",
+		"bad key":           "bad key",
+		"Sec-WebSocket-Key": "Sec-Websocket-Key",
+	} {
+		if k := canonicalHeaderKey([]byte(key)); k != want {
+			t.Fatalf("%q: expected %q, got %q", key, want, k)
+		}
+	}
+
+	// the values of a request don't leak into the next ones
+	var headers []http.Header
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+		headers = append(headers, request.Header)
+	})
+	parser := NewParser(nil, NewServerProcessor(mux), false, 1024*1024*4)
+	data := "GET / HTTP/1.1\r\nHost: a\r\nCookie: 1\r\nX-Id: 1\r\nCookie: 2\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: b\r\nX-Id: 2\r\nCookie: 3\r\n\r\n"
+	if err := parser.Read([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 {
+		t.Fatalf("%v requests", len(headers))
+	}
+	first, second := headers[0], headers[1]
+	if first.Get("Host") != "a" || strings.Join(first["Cookie"], ",") != "1,2" || first.Get("X-Id") != "1" {
+		t.Fatalf("invalid header: %v", first)
+	}
+	if second.Get("Host") != "b" || strings.Join(second["Cookie"], ",") != "3" || second.Get("X-Id") != "2" {
+		t.Fatalf("invalid header: %v", second)
+	}
+}
+
+// BenchmarkServerProcessorRecycling compares the allocations of a request
+// with and without EnableRecycling. The requests, their header maps and
+// BodyReaders, the responses and the unparsed data are recycled, the common
+// header keys are interned and the values of the header keys share an
+// array. The allocations left with recycling are:
+//   - the strings of the header values, the handlers may keep them
+//   - the request URI and its *url.URL
+//   - the Content-Type, Content-Length and Date fields set in the header of
+//     the response, and the formatting of the date
+//   - the serialized header of the response, which is written to the
+//     connection, and its sorted keys
+//   - the routing of http.ServeMux and the []byte converted by the handler
+func BenchmarkServerProcessorRecycling(b *testing.B) {
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+	// the requests arrive in several reads, so that the parser keeps the
+	// unparsed data between them
+	reads := [][]byte{benchData[:100], benchData[100:400], benchData[400:]}
+	for _, recycling := range []bool{false, true} {
+		name := "default"
+		if recycling {
+			name = "recycling"
+		}
+		b.Run(name, func(b *testing.B) {
+			processor := NewServerProcessor(mux).(*ServerProcessor)
+			if recycling {
+				processor.EnableRecycling()
+			}
+			parser := NewParser(nil, processor, false, 1024*1024*4)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, data := range reads {
+					if err := parser.Read(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// testBytesProcessor inspects the messages like a router, without keeping
+// the data.
+type testBytesProcessor struct {
+	methods  [4]string
+	hosts    [4][16]byte
+	paths    [4][16]byte
+	headers  int
+	body     int
+	trailers int
+	messages int
+}
+
+func (bp *testBytesProcessor) OnMethod(method string) {
+	bp.methods[bp.messages%4] = method
+}
+
+func (bp *testBytesProcessor) OnURLBytes(uri []byte) error {
+	copy(bp.paths[bp.messages%4][:], uri)
+	return nil
+}
+
+func (bp *testBytesProcessor) OnProtoBytes(proto []byte) error {
+	if string(proto) != "HTTP/1.1" {
+		return ErrInvalidHTTPVersion
+	}
+	return nil
+}
+
+func (bp *testBytesProcessor) OnStatusBytes(code int, status []byte) {}
+
+func (bp *testBytesProcessor) OnHeaderBytes(key, value []byte) {
+	bp.headers++
+	if asciiEqualFold(key, "host") {
+		copy(bp.hosts[bp.messages%4][:], value)
+	}
+}
+
+func (bp *testBytesProcessor) OnContentLength(contentLength int) {}
+
+func (bp *testBytesProcessor) OnBody(data []byte) {
+	bp.body += len(data)
+}
+
+func (bp *testBytesProcessor) OnTrailerHeaderBytes(key, value []byte) {
+	bp.trailers++
+}
+
+func (bp *testBytesProcessor) OnComplete(conn net.Conn) {
+	bp.messages++
+}
+
+func TestBytesProcessor(t *testing.T) {
+	data := []byte("GET /a?b=1 HTTP/1.1\r\nHost: example.com\r\nconnection: keep-alive\r\n\r\n" +
+		"post /p HTTP/1.1\r\nHOST : x\r\nContent-Length: 5\r\n\r\nhello" +
+		"PUT /c HTTP/1.1\r\nHost: y\r\nTransfer-Encoding: chunked\r\nTrailer: Md5\r\n\r\n3\r\nabc\r\n0\r\nMd5: 0\r\n\r\n")
+	for _, step := range []int{len(data), 7, 1} {
+		bp := &testBytesProcessor{}
+		parser := NewBytesParser(nil, bp, false, 0)
+		for i := 0; i < len(data); i += step {
+			end := i + step
+			if end > len(data) {
+				end = len(data)
+			}
+			if err := parser.Read(data[i:end]); err != nil {
+				t.Fatalf("step %v: %v", step, err)
+			}
+		}
+		if bp.messages != 3 || bp.headers != 7 || bp.body != 8 || bp.trailers != 1 {
+			t.Fatalf("step %v: invalid messages: %+v", step, bp)
+		}
+		for i, expected := range []struct{ method, host, path string }{
+			{"GET", "example.com", "/a?b=1"},
+			{"POST", "x", "/p"},
+			{"PUT", "y", "/c"},
+		} {
+			host := string(bytes.TrimRight(bp.hosts[i][:], "\x00"))
+			path := string(bytes.TrimRight(bp.paths[i][:], "\x00"))
+			if bp.methods[i] != expected.method || host != expected.host || path != expected.path {
+				t.Fatalf("step %v: invalid message %v: %v %q %q", step, i, bp.methods[i], host, path)
+			}
+		}
+	}
+
+	// only the announced trailers are allocated
+	data = bytes.Replace(data, []byte("Trailer: Md5\r\n"), nil, 1)
+	data = bytes.Replace(data, []byte("Md5: 0\r\n"), nil, 1)
+	parser := NewBytesParser(nil, &testBytesProcessor{}, false, 0)
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := parser.Read(data); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations per read", allocs)
+	}
+}
+
+func BenchmarkBytesProcessor(b *testing.B) {
+	maxReadSize := 1024 * 1024 * 4
+	isClient := false
+	parser := NewBytesParser(nil, &testBytesProcessor{}, isClient, maxReadSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := parser.Read(benchData); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkEmpryProcessor(b *testing.B) {
 	maxReadSize := 1024 * 1024 * 4
 	isClient := false
@@ -0,0 +1,249 @@
+package nbhttp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxPipelineDepth .
+	DefaultMaxPipelineDepth = 16
+)
+
+// pendingResponse is the data of a response that can't be written yet
+// because the responses to earlier requests on the same connection are not
+// complete.
+type pendingResponse struct {
+	data []byte
+	done bool
+}
+
+// responseQueue writes the responses of a connection in the order of their
+// requests, whatever the order their handlers complete in.
+//
+// Responses are identified by their sequence, starting from 1. Reading from
+// the connection is paused while maxDepth requests are waiting for their
+// responses to be written, and the parser stops dispatching the requests it
+// has already read until unblock is called.
+type responseQueue struct {
+	mux      sync.Mutex
+	cond     sync.Cond
+	closed   bool
+	writer   io.Writer
+	pauser   readPauser
+	paused   bool
+	blocked  bool
+	unblock  func()
+	maxDepth uint64
+	last     uint64 // sequence of the last request
+	next     uint64 // sequence of the response being written
+	closeSeq uint64 // sequence of the response closing the connection
+	pending  map[uint64]*pendingResponse
+
+	// timed is set if the time of the last write or of the first pending
+	// response is tracked, for the timeouts of the server.
+	timed bool
+	since time.Time
+
+	closeFuncs []func()
+}
+
+func (q *responseQueue) init(writer io.Writer, maxDepth int) {
+	q.cond.L = &q.mux
+	if writer != nil {
+		q.setWriter(writer)
+	}
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxPipelineDepth
+	}
+	q.maxDepth = uint64(maxDepth)
+	q.next = 1
+}
+
+func (q *responseQueue) setWriter(writer io.Writer) {
+	q.writer = writer
+	q.pauser, _ = writer.(readPauser)
+}
+
+// add returns the sequence of a new response.
+func (q *responseQueue) add() uint64 {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.timed && q.next > q.last {
+		q.since = time.Now()
+	}
+	q.last++
+	if !q.paused && q.pauser != nil && q.last-q.next+1 >= q.maxDepth {
+		if q.pauser.PauseRead() == nil {
+			q.paused = true
+		}
+	}
+	return q.last
+}
+
+// full reports whether maxDepth requests are waiting for their responses,
+// unblock is then called once fewer are.
+func (q *responseQueue) full() bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.last-q.next+1 >= q.maxDepth {
+		q.blocked = true
+	}
+	return q.blocked
+}
+
+// write writes data of the response with sequence seq, or keeps it until
+// the previous responses are done. done reports whether data is the last
+// part of the response.
+func (q *responseQueue) write(seq uint64, data []byte, done bool) error {
+	q.mux.Lock()
+	if seq != q.next {
+		pr := q.pending[seq]
+		if pr == nil {
+			if q.pending == nil {
+				q.pending = map[uint64]*pendingResponse{}
+			}
+			pr = &pendingResponse{}
+			q.pending[seq] = pr
+		}
+		pr.data = append(pr.data, data...)
+		pr.done = done
+		q.mux.Unlock()
+		return nil
+	}
+
+	err := q.writeLocked(data)
+	if q.timed && len(data) > 0 {
+		q.since = time.Now()
+	}
+	if !done {
+		q.mux.Unlock()
+		return err
+	}
+	q.next++
+	for {
+		pr := q.pending[q.next]
+		if pr == nil {
+			break
+		}
+		if len(pr.data) > 0 {
+			if e := q.writeLocked(pr.data); e != nil && err == nil {
+				err = e
+			}
+			pr.data = nil
+		}
+		if !pr.done {
+			break
+		}
+		delete(q.pending, q.next)
+		q.next++
+	}
+	q.cond.Broadcast()
+	if q.timed {
+		q.since = time.Now()
+	}
+	if q.paused && q.last-q.next+1 < q.maxDepth {
+		q.paused = false
+		q.pauser.ResumeRead()
+	}
+	unblock := q.blocked && q.last-q.next+1 < q.maxDepth
+	if unblock {
+		q.blocked = false
+	}
+	shouldClose := q.closeSeq > 0 && q.next > q.closeSeq
+	q.mux.Unlock()
+
+	// closing calls the processor's onClose, which locks the queue
+	if shouldClose {
+		q.closeWriter()
+	} else if unblock && q.unblock != nil {
+		q.unblock()
+	}
+	return err
+}
+
+// closeAfter makes the connection be closed once the response with sequence
+// seq has been written.
+func (q *responseQueue) closeAfter(seq uint64) {
+	q.mux.Lock()
+	if q.closeSeq == 0 || seq < q.closeSeq {
+		q.closeSeq = seq
+	}
+	shouldClose := q.next > q.closeSeq
+	q.mux.Unlock()
+
+	if shouldClose {
+		q.closeWriter()
+	}
+}
+
+func (q *responseQueue) closeWriter() {
+	if closer, ok := q.writer.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// wait blocks until the responses before seq have been written, it returns
+// false if the connection has been closed.
+func (q *responseQueue) wait(seq uint64) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for q.next < seq && !q.closed {
+		q.cond.Wait()
+	}
+	return q.next >= seq
+}
+
+// activity reports whether responses are pending, and since when or since
+// when the connection is idle.
+func (q *responseQueue) activity() (bool, time.Time) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.next <= q.last, q.since
+}
+
+// written reports whether the responses before seq have been written.
+func (q *responseQueue) written(seq uint64) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.next >= seq
+}
+
+func (q *responseQueue) close() {
+	q.mux.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	closeFuncs := q.closeFuncs
+	q.closeFuncs = nil
+	q.mux.Unlock()
+
+	for _, f := range closeFuncs {
+		f()
+	}
+}
+
+// onClose registers f to be called when the connection is closed, it
+// returns false if it's already closed.
+func (q *responseQueue) onClose(f func()) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.closed {
+		return false
+	}
+	q.closeFuncs = append(q.closeFuncs, f)
+	return true
+}
+
+func (q *responseQueue) writeLocked(data []byte) error {
+	if q.writer == nil || len(data) == 0 {
+		return nil
+	}
+	if q.closeSeq > 0 && q.next > q.closeSeq {
+		// the connection is closed after an earlier response
+		return nil
+	}
+	_, err := q.writer.Write(data)
+	return err
+}
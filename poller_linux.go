@@ -0,0 +1,230 @@
+//go:build linux
+
+package nbhttp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const (
+	epollEventsRead = syscall.EPOLLIN | syscall.EPOLLPRI | syscall.EPOLLRDHUP
+)
+
+// poller reads from the connections registered to its epoll instance on a
+// single goroutine.
+type poller struct {
+	e     *Engine
+	index int
+
+	epfd   int
+	wakeup [2]int
+
+	mux   sync.Mutex
+	conns map[int]*Conn
+
+	readBuffer []byte
+
+	shutdown bool
+}
+
+func newPoller(e *Engine, index int) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &poller{
+		e:          e,
+		index:      index,
+		epfd:       epfd,
+		conns:      map[int]*Conn{},
+		readBuffer: make([]byte, e.ReadBufferSize),
+	}
+
+	if err = syscall.Pipe2(p.wakeup[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p.wakeup[0], &syscall.EpollEvent{Fd: int32(p.wakeup[0]), Events: syscall.EPOLLIN})
+	if err != nil {
+		syscall.Close(epfd)
+		syscall.Close(p.wakeup[0])
+		syscall.Close(p.wakeup[1])
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// addConn takes over the fd of conn and registers it to the poller, conn
+// itself is closed.
+func (p *poller) addConn(conn net.Conn, h connHandler) (net.Conn, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("unsupported connection type")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	fd := -1
+	var dupErr error
+	err = rc.Control(func(sysfd uintptr) {
+		fd, dupErr = syscall.Dup(int(sysfd))
+	})
+	if err == nil {
+		err = dupErr
+	}
+	laddr, raddr := conn.LocalAddr(), conn.RemoteAddr()
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	syscall.CloseOnExec(fd)
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	c := &Conn{
+		p:       p,
+		fd:      fd,
+		laddr:   laddr,
+		raddr:   raddr,
+		handler: h,
+	}
+	c.cond.L = &c.mux
+	parser, err := p.e.onOpen(c, h)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	c.parser = parser
+
+	p.mux.Lock()
+	p.conns[fd] = c
+	p.mux.Unlock()
+
+	err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: epollEventsRead})
+	if err != nil {
+		c.closeWithError(err)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *poller) deleteConn(c *Conn) {
+	p.mux.Lock()
+	if p.conns[c.fd] == c {
+		delete(p.conns, c.fd)
+	}
+	p.mux.Unlock()
+	syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+}
+
+func (p *poller) modEvents(fd int, events uint32) error {
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: events})
+}
+
+func (p *poller) start() {
+	defer p.e.wg.Done()
+	defer p.close()
+
+	events := make([]syscall.EpollEvent, 1024)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil && err != syscall.EINTR {
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			ev := &events[i]
+			fd := int(ev.Fd)
+			if fd == p.wakeup[0] {
+				p.mux.Lock()
+				shutdown := p.shutdown
+				p.mux.Unlock()
+				if shutdown {
+					return
+				}
+				continue
+			}
+
+			p.mux.Lock()
+			c := p.conns[fd]
+			p.mux.Unlock()
+			if c == nil {
+				continue
+			}
+
+			if ev.Events&syscall.EPOLLOUT != 0 {
+				c.flush()
+			}
+			if ev.Events&(syscall.EPOLLIN|syscall.EPOLLPRI|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+				p.read(c, ev.Events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0)
+			}
+		}
+	}
+}
+
+func (p *poller) read(c *Conn, hup bool) {
+	ok, paused := c.beginRead()
+	if !ok {
+		if paused && hup {
+			// HUP and ERR are always reported, so the connection can't
+			// wait for reading to be resumed.
+			c.closeWithError(io.ErrUnexpectedEOF)
+		}
+		return
+	}
+	defer c.endRead()
+
+	n, err := syscall.Read(c.fd, p.readBuffer)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	if err != nil {
+		c.closeWithError(err)
+		return
+	}
+	if n == 0 {
+		c.closeWithError(io.EOF)
+		return
+	}
+	c.handler.onData(c, c.parser, p.readBuffer[:n])
+}
+
+func (p *poller) stop() {
+	p.mux.Lock()
+	if p.shutdown {
+		p.mux.Unlock()
+		return
+	}
+	p.shutdown = true
+	p.mux.Unlock()
+	syscall.Write(p.wakeup[1], []byte{0})
+}
+
+func (p *poller) close() {
+	p.mux.Lock()
+	conns := make([]*Conn, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mux.Unlock()
+
+	for _, c := range conns {
+		c.closeWithError(ErrEngineStopped)
+	}
+	syscall.Close(p.epfd)
+	syscall.Close(p.wakeup[0])
+	syscall.Close(p.wakeup[1])
+}
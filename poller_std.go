@@ -0,0 +1,143 @@
+//go:build !linux
+
+package nbhttp
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// poller falls back to one reading goroutine per connection on platforms
+// without epoll.
+type poller struct {
+	e     *Engine
+	index int
+}
+
+func newPoller(e *Engine, index int) (*poller, error) {
+	return &poller{e: e, index: index}, nil
+}
+
+func (p *poller) addConn(conn net.Conn, h connHandler) (net.Conn, error) {
+	c := &stdConn{Conn: conn, done: make(chan struct{})}
+	c.cond.L = &c.mux
+	c.p, c.h = p, h
+	parser, err := p.e.onOpen(c, h)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.parser = parser
+	go p.read(c, parser, h)
+	return c, nil
+}
+
+func (p *poller) read(conn *stdConn, parser *Parser, h connHandler) {
+	defer close(conn.done)
+	buf := make([]byte, p.e.ReadBufferSize)
+	for {
+		if !conn.waitResume() {
+			return
+		}
+		n, err := conn.Read(buf)
+		if n > 0 {
+			h.onData(conn, parser, buf[:n])
+		}
+		if conn.isDetached() {
+			return
+		}
+		if err != nil {
+			conn.Close()
+			p.e.onClose(conn, parser, h, err)
+			return
+		}
+	}
+}
+
+func (p *poller) start() {
+	p.e.wg.Done()
+}
+
+func (p *poller) stop() {}
+
+// stdConn wraps the connections read by a goroutine so that reading can be
+// paused.
+type stdConn struct {
+	net.Conn
+
+	p      *poller
+	h      connHandler
+	parser *Parser
+
+	mux      sync.Mutex
+	cond     sync.Cond
+	paused   bool
+	closed   bool
+	detached bool
+	done     chan struct{} // closed when the reading goroutine exits
+}
+
+// PauseRead stops the reading goroutine until ResumeRead is called.
+func (c *stdConn) PauseRead() error {
+	c.mux.Lock()
+	c.paused = true
+	c.mux.Unlock()
+	return nil
+}
+
+// ResumeRead .
+func (c *stdConn) ResumeRead() error {
+	c.mux.Lock()
+	c.paused = false
+	c.cond.Broadcast()
+	c.mux.Unlock()
+	return nil
+}
+
+// Close .
+func (c *stdConn) Close() error {
+	c.mux.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mux.Unlock()
+	return c.Conn.Close()
+}
+
+// waitResume returns false if the connection has been hijacked.
+func (c *stdConn) waitResume() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for c.paused && !c.closed && !c.detached {
+		c.cond.Wait()
+	}
+	return !c.detached
+}
+
+func (c *stdConn) isDetached() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.detached
+}
+
+// hijack implements hijacker, a pending read is interrupted by a deadline
+// in the past.
+func (c *stdConn) hijack(wait bool) (net.Conn, error) {
+	c.mux.Lock()
+	if c.closed || c.detached {
+		c.mux.Unlock()
+		return nil, net.ErrClosed
+	}
+	c.detached = true
+	c.cond.Broadcast()
+	c.mux.Unlock()
+
+	if wait {
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+		<-c.done
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.p.e.onClose(c, c.parser, c.h, http.ErrHijacked)
+	return c.Conn, nil
+}
@@ -0,0 +1,107 @@
+package nbhttp
+
+import (
+	"net/http"
+	"sync"
+)
+
+const (
+	// defaultBufferSize is the capacity of the new buffers of the pool, and
+	// maxPooledBufferSize the capacity above which a buffer is dropped
+	// rather than pooled, so that a few large messages don't keep their
+	// memory.
+	defaultBufferSize   = 4096
+	maxPooledBufferSize = 64 * 1024
+)
+
+// bufferPool recycles the buffers that only live while a message is read,
+// such as the unparsed data of the parsers and the bodies of the requests.
+// The buffers are passed as pointers, so that putting them doesn't
+// allocate.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+var buffers bufferPool
+
+// get returns an empty buffer.
+func (bp *bufferPool) get() *[]byte {
+	if buf, ok := bp.pool.Get().(*[]byte); ok {
+		return buf
+	}
+	buf := make([]byte, 0, defaultBufferSize)
+	return &buf
+}
+
+// put recycles buf, the caller stores in it the slice of the array to
+// recycle, which may have been grown since buf was taken from the pool.
+func (bp *bufferPool) put(buf *[]byte) {
+	if cap(*buf) > maxPooledBufferSize {
+		return
+	}
+	*buf = (*buf)[:0]
+	bp.pool.Put(buf)
+}
+
+// the objects of a request recycled when RecycleRequests is enabled
+var (
+	requestPool = sync.Pool{
+		New: func() interface{} {
+			return &http.Request{Header: http.Header{}}
+		},
+	}
+	responsePool = sync.Pool{
+		New: func() interface{} {
+			return &Response{header: http.Header{}}
+		},
+	}
+	bodyReaderPool = sync.Pool{
+		New: func() interface{} {
+			return &BodyReader{}
+		},
+	}
+)
+
+func getRequest() *http.Request {
+	return requestPool.Get().(*http.Request)
+}
+
+// putRequest resets the request, keeping its header map.
+func putRequest(request *http.Request) {
+	header := request.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	clear(header)
+	*request = http.Request{Header: header}
+	requestPool.Put(request)
+}
+
+func getResponse() *Response {
+	return responsePool.Get().(*Response)
+}
+
+// putResponse resets the response, keeping its header map and the buffer of
+// its body.
+func putResponse(response *Response) {
+	header := response.header
+	if header == nil {
+		header = http.Header{}
+	}
+	clear(header)
+	body := response.body[:0]
+	if cap(body) > maxPooledBufferSize {
+		body = nil
+	}
+	*response = Response{header: header, body: body}
+	responsePool.Put(response)
+}
+
+func getBodyReader() *BodyReader {
+	return bodyReaderPool.Get().(*BodyReader)
+}
+
+func putBodyReader(br *BodyReader) {
+	br.Close()
+	bodyReaderPool.Put(br)
+}
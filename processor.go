@@ -6,12 +6,25 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/golang/net/http/httpguts"
 )
 
+const (
+	// DefaultMaxBodyBufferSize .
+	DefaultMaxBodyBufferSize = 1024 * 64
+
+	// headerValuesSize is the capacity of the arrays of header values.
+	headerValuesSize = 32
+)
+
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
 // Processor .
 type Processor interface {
 	OnMethod(method string)
@@ -26,31 +39,196 @@ type Processor interface {
 	WriteTo(w io.Writer, data []byte) (int, error)
 }
 
+// BytesProcessor is a Processor that receives the parts of the messages as
+// slices of the data being parsed, so that they can be inspected without
+// allocations. The slices are only valid during the call, and the header
+// keys are not canonicalized. The method is one registered in the
+// MethodPolicy of the parser.
+//
+// A Processor that also implements BytesProcessor receives the bytes.
+type BytesProcessor interface {
+	OnMethod(method string)
+	OnURLBytes(uri []byte) error
+	OnProtoBytes(proto []byte) error
+	OnStatusBytes(code int, status []byte)
+	OnHeaderBytes(key, value []byte)
+	OnContentLength(contentLength int)
+	OnBody(data []byte)
+	OnTrailerHeaderBytes(key, value []byte)
+	OnComplete(conn net.Conn)
+}
+
+// InformationalProcessor is implemented by the client processors that
+// receive the 1xx responses apart from the final responses. The status and
+// headers of a 1xx response are passed like those of any response, then
+// OnInformational is called instead of OnComplete. The 1xx responses are
+// passed to OnComplete otherwise.
+type InformationalProcessor interface {
+	OnInformational(conn net.Conn)
+}
+
+// ChunkProcessor is implemented by the processors that receive the chunks
+// of the chunked bodies. OnChunkHeader is called with the size and the
+// extensions of each chunk, nil if it has none, before its data is passed to
+// OnBody, then OnChunkEnd after its data. The last chunk has size 0, its
+// OnChunkHeader is followed by the trailers. The chunks of the bodies whose
+// transfer codings are decoded by the parser are not passed.
+type ChunkProcessor interface {
+	OnChunkHeader(size int, ext map[string]string)
+	OnChunkEnd()
+}
+
+// stringProcessor passes the parts of the messages to a Processor as
+// strings, with canonical header keys.
+type stringProcessor struct {
+	Processor
+}
+
+// OnURLBytes .
+func (sp stringProcessor) OnURLBytes(uri []byte) error {
+	return sp.OnURL(string(uri))
+}
+
+// OnProtoBytes .
+func (sp stringProcessor) OnProtoBytes(proto []byte) error {
+	switch string(proto) {
+	case "HTTP/1.1":
+		return sp.OnProto("HTTP/1.1")
+	case "HTTP/1.0":
+		return sp.OnProto("HTTP/1.0")
+	}
+	return sp.OnProto(string(proto))
+}
+
+// OnStatusBytes .
+func (sp stringProcessor) OnStatusBytes(code int, status []byte) {
+	sp.OnStatus(code, string(status))
+}
+
+// OnHeaderBytes .
+func (sp stringProcessor) OnHeaderBytes(key, value []byte) {
+	sp.OnHeader(canonicalHeaderKey(key), string(value))
+}
+
+// OnTrailerHeaderBytes .
+func (sp stringProcessor) OnTrailerHeaderBytes(key, value []byte) {
+	sp.OnTrailerHeader(canonicalHeaderKey(key), string(value))
+}
+
+// commonHeaderKeys are the keys that canonicalHeaderKey doesn't allocate.
+var commonHeaderKeys = map[string]string{}
+
+func init() {
+	for _, k := range []string{
+		"Accept", "Accept-Charset", "Accept-Encoding", "Accept-Language",
+		"Authorization", "Cache-Control", "Connection", "Content-Encoding",
+		"Content-Length", "Content-Type", "Cookie", "Date", "Expect",
+		"Forwarded", "Host", "If-Match", "If-Modified-Since", "If-None-Match",
+		"Origin", "Pragma", "Range", "Referer", "Sec-Websocket-Extensions",
+		"Sec-Websocket-Key", "Sec-Websocket-Protocol", "Sec-Websocket-Version",
+		"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+		"Upgrade-Insecure-Requests", "User-Agent", "Via", "X-Forwarded-For",
+		"X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip", "X-Requested-With",
+	} {
+		commonHeaderKeys[k] = k
+	}
+}
+
+// canonicalHeaderKey is http.CanonicalHeaderKey for the bytes of a key, the
+// common keys are canonicalized in a local buffer and not allocated.
+func canonicalHeaderKey(key []byte) string {
+	var buf [32]byte
+	if len(key) <= len(buf) {
+		upper := true
+		for i, c := range key {
+			if upper && 'a' <= c && c <= 'z' {
+				c -= 'a' - 'A'
+			} else if !upper && 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			buf[i] = c
+			upper = c == '-'
+		}
+		if k, ok := commonHeaderKeys[string(buf[:len(key)])]; ok {
+			return k
+		}
+	}
+	return http.CanonicalHeaderKey(string(key))
+}
+
 // ServerProcessor .
 type ServerProcessor struct {
-	request  *http.Request
-	handler  http.Handler
-	sequence uint64
+	conn      net.Conn
+	parser    *Parser
+	request   *http.Request
+	handler   http.Handler
+	executor  Executor
+	responses responseQueue
+
+	// maxKeepAliveRequests is the number of requests served on a connection
+	// before it's closed, nRequests the number of requests read, which the
+	// timer loads from the poller goroutine while another one may parse.
+	maxKeepAliveRequests int
+	nRequests            int32
+
+	// timer tracks the timeouts of the connection if the server has any.
+	timer *connTimer
+
+	// http2 is set if the server serves HTTP/2, the first bytes of a
+	// cleartext connection are kept in h2Preface while h2Sniffing.
+	http2      *HTTP2Config
+	h2Sniffing bool
+	h2Preface  []byte
+
+	// streaming is enabled by EnableStreaming, bodyPipe is the body of the
+	// request being read if its handler has already been called.
+	streaming     bool
+	maxBufferSize int
+	mux           sync.Mutex
+	bodyPipe      *BodyPipe
+
+	// recycling is enabled by EnableRecycling.
+	recycling bool
+
+	// headerValues is the array of the values of the header keys, shared by
+	// the requests until it's full like the one of net/textproto, so that
+	// a header doesn't allocate a slice per key.
+	headerValues []string
+
+	// expectContinue is set by SetExpectContinue, expectSequence is the
+	// sequence of the response to the request being read if 100 Continue
+	// has been sent to it.
+	expectContinue func(*http.Request) int
+	expectSequence uint64
 }
 
 // OnMethod .
 func (p *ServerProcessor) OnMethod(method string) {
 	if p.request == nil {
-		p.request = &http.Request{
-			Method: method,
-			Header: http.Header{},
+		if p.recycling {
+			p.request = getRequest()
+		} else {
+			p.request = &http.Request{Header: http.Header{}}
 		}
-	} else {
-		p.request.Method = method
 	}
+	p.request.Method = method
 }
 
 // OnURL .
 func (p *ServerProcessor) OnURL(uri string) error {
-	u, err := url.ParseRequestURI(uri)
+	// CONNECT requests have the authority-form "host:port"
+	justAuthority := p.request.Method == http.MethodConnect && !strings.HasPrefix(uri, "/")
+	rawurl := uri
+	if justAuthority {
+		rawurl = "http://" + uri
+	}
+	u, err := url.ParseRequestURI(rawurl)
 	if err != nil {
 		return err
 	}
+	if justAuthority {
+		u.Scheme = ""
+	}
 	p.request.URL = u
 	p.request.RequestURI = uri
 	return nil
@@ -75,22 +253,64 @@ func (p *ServerProcessor) OnStatus(code int, status string) {
 
 // OnHeader .
 func (p *ServerProcessor) OnHeader(key, value string) {
-	p.request.Header.Add(key, value)
+	key = http.CanonicalHeaderKey(key)
+	header := p.request.Header
+	if vv, ok := header[key]; ok {
+		header[key] = append(vv, value)
+		return
+	}
+	if len(p.headerValues) == cap(p.headerValues) {
+		p.headerValues = make([]string, 0, headerValuesSize)
+	}
+	n := len(p.headerValues)
+	p.headerValues = append(p.headerValues, value)
+	// appending to the values of a key reallocates them
+	header[key] = p.headerValues[n : n+1 : n+1]
 }
 
 // OnContentLength .
 func (p *ServerProcessor) OnContentLength(contentLength int) {
 	p.request.ContentLength = int64(contentLength)
+
+	if !p.streaming {
+		return
+	}
+	chunked := httpguts.HeaderValuesContainsToken(p.request.Header["Transfer-Encoding"], "chunked")
+	if contentLength <= 0 && !chunked {
+		return
+	}
+
+	// call the handler now and feed the body to it as it arrives
+	request := p.request
+	bodyPipe := newBodyPipe(p.conn, p.maxBufferSize)
+	p.mux.Lock()
+	p.bodyPipe = bodyPipe
+	p.mux.Unlock()
+	request.Body = bodyPipe
+	p.prepareRequest(p.conn, request)
+	response := p.newResponse(p.conn, request)
+	p.dispatch(response, request, true)
 }
 
 // OnBody .
 func (p *ServerProcessor) OnBody(data []byte) {
-	if p.request.Body == nil {
-		p.request.Body = &BodyReader{buffer: data}
-	} else {
-		br := p.request.Body.(*BodyReader)
-		br.buffer = append(br.buffer, data...)
+	if p.streaming {
+		p.mux.Lock()
+		bodyPipe := p.bodyPipe
+		p.mux.Unlock()
+		if bodyPipe != nil {
+			bodyPipe.write(data)
+			return
+		}
 	}
+	if p.request.Body == nil || p.request.Body == http.NoBody {
+		if p.recycling {
+			p.request.Body = getBodyReader()
+		} else {
+			p.request.Body = &BodyReader{}
+		}
+	}
+	p.request.Body.(*BodyReader).append(data)
 }
 
 // OnTrailerHeader .
@@ -106,16 +326,191 @@ func (p *ServerProcessor) OnComplete(conn net.Conn) {
 	request := p.request
 	p.request = nil
 
+	if p.streaming {
+		p.mux.Lock()
+		bodyPipe := p.bodyPipe
+		p.bodyPipe = nil
+		p.mux.Unlock()
+		if bodyPipe != nil {
+			bodyPipe.closeWithError(io.EOF)
+			p.checkKeepAlive(request)
+			return
+		}
+	}
+
+	p.prepareRequest(conn, request)
+	response := p.newResponse(conn, request)
+	p.checkKeepAlive(request)
+	p.dispatch(response, request, false)
+}
+
+// onExpect answers the Expect header of the request being read, once its
+// header is complete. The body of a "100-continue" request is read after
+// sending 100 Continue, unless the expectContinue hook rejects it with
+// another status. Other expectations fail with 417 Expectation Failed.
+func (p *ServerProcessor) onExpect(contentLength int, chunked bool) bool {
+	request := p.request
+	request.ContentLength = int64(contentLength)
+	continues := strings.EqualFold(textproto.TrimString(request.Header.Get("Expect")), "100-continue")
+	if continues && (!(contentLength > 0 || chunked) || !request.ProtoAtLeast(1, 1)) {
+		// there is nothing to wait for, or the client doesn't know 1xx
+		return true
+	}
+
+	p.prepareRequest(p.conn, request)
+	status := http.StatusExpectationFailed
+	if continues {
+		status = http.StatusContinue
+		if p.expectContinue != nil {
+			status = p.expectContinue(request)
+		}
+	}
+	if status == http.StatusContinue {
+		p.expectSequence = p.responses.add()
+		p.responses.write(p.expectSequence, continueResponse, false)
+		return true
+	}
+
+	// the client may send the body anyway, the connection is closed rather
+	// than reading it
+	p.request = nil
+	response := p.newResponse(p.conn, request)
+	response.close = true
+	response.WriteHeader(status)
+	response.finish()
+	p.release(response, request)
+	return false
+}
+
+// checkKeepAlive stops parsing the requests sent after one whose response
+// closes the connection.
+func (p *ServerProcessor) checkKeepAlive(request *http.Request) {
+	if p.parser == nil {
+		return
+	}
+	if request.Close || (p.maxKeepAliveRequests > 0 && int(atomic.LoadInt32(&p.nRequests)) >= p.maxKeepAliveRequests) {
+		p.parser.closing()
+	}
+}
+
+// endResponse finishes the response once its handler returned, the
+// connection is closed after it if the body of a streaming request has not
+// been read.
+func (p *ServerProcessor) endResponse(response *Response, request *http.Request) {
+	if bodyPipe, ok := request.Body.(*BodyPipe); ok && !bodyPipe.complete() {
+		response.close = true
+		bodyPipe.Close()
+		if response.wroteHeader {
+			p.responses.closeAfter(response.sequence)
+		}
+	}
+	response.finish()
+}
+
+// release closes the body of a request once its handler returned, the
+// request and its response are recycled if they are no longer used.
+func (p *ServerProcessor) release(response *Response, request *http.Request) {
+	if response.detached || response.hijacked {
+		return
+	}
+	br, ok := request.Body.(*BodyReader)
+	if ok {
+		br.Close()
+	}
+	if !p.recycling {
+		return
+	}
+	if ok {
+		putBodyReader(br)
+	} else if request.Body != http.NoBody {
+		// streaming
+		return
+	}
+	putResponse(response)
+	putRequest(request)
+}
+
+// serve runs the handler, then completes its response. A panic of the
+// handler is answered with 500 Internal Server Error, or closes the
+// connection if the header has been written. It reports whether the
+// connection has been hijacked.
+func (p *ServerProcessor) serve(response *Response, request *http.Request) (hijacked bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			logPanic(err)
+			response.abort()
+		}
+		p.endResponse(response, request)
+		hijacked = response.hijacked
+		p.release(response, request)
+	}()
+	p.handler.ServeHTTP(response, request)
+	return false
+}
+
+// dispatch runs the handler with the executor, streaming requests can't be
+// handled inline since their body is fed by the parsing goroutine.
+//
+// The data read after a CONNECT or Upgrade request is not parsed until its
+// handler returns, unless the handler takes over the connection.
+func (p *ServerProcessor) dispatch(response *Response, request *http.Request, streaming bool) {
+	parser := p.parser
+	upgrade := parser != nil && parser.upgrading()
+	if upgrade && !streaming && p.http2 != nil && isH2CUpgrade(request) && p.upgradeH2C(response, request) {
+		return
+	}
+	if p.executor == nil && !streaming {
+		response.inline = true
+		p.serve(response, request)
+		return
+	}
+	f := func() {
+		hijacked := p.serve(response, request)
+		if upgrade && !hijacked {
+			if err := parser.upgradeDone(); err != nil {
+				p.conn.Close()
+			}
+		}
+	}
+	if upgrade {
+		parser.deferred = true
+	}
+	if p.executor == nil {
+		go f()
+		return
+	}
+	if !p.executor(f) {
+		// overloaded
+		if upgrade {
+			parser.deferred = false
+		}
+		request.Body.Close()
+		response.WriteHeader(http.StatusServiceUnavailable)
+		response.finish()
+		p.release(response, request)
+	}
+}
+
+// prepareRequest sets the fields of the request that depend on the whole
+// header.
+func (p *ServerProcessor) prepareRequest(conn net.Conn, request *http.Request) {
 	if conn != nil {
 		request.RemoteAddr = conn.RemoteAddr().String()
 	}
+	if tlsConn, ok := conn.(*TLSConn); ok {
+		state := tlsConn.ConnectionState()
+		request.TLS = &state
+	}
 
 	if request.URL.Host == "" {
 		request.URL.Host = request.Header.Get("Host")
-		request.Host = request.URL.Host
 	}
+	request.Host = request.URL.Host
 
 	request.TransferEncoding = request.Header["Transfer-Encoding"]
+	if request.Body == nil {
+		request.Body = http.NoBody
+	}
 
 	if request.ProtoMajor < 1 {
 		request.Close = true
@@ -123,18 +518,80 @@ func (p *ServerProcessor) OnComplete(conn net.Conn) {
 		hasClose := httpguts.HeaderValuesContainsToken(request.Header["Connection"], "close")
 		if request.ProtoMajor == 1 && request.ProtoMinor == 0 {
 			request.Close = hasClose || !httpguts.HeaderValuesContainsToken(request.Header["Connection"], "keep-alive")
+		} else {
+			request.Close = hasClose
 		}
-		// if hasClose && removeCloseHeader {
-		// 	request.Header.Del("Connection")
-		// }
 	}
+	if p.parser != nil && p.parser.mustClose {
+		request.Close = true
+	}
+}
+
+// SetExpectContinue sets the hook deciding whether the body of the requests
+// sent with "Expect: 100-continue" is read. It's called with the header of
+// the request on the parsing goroutine, and returns http.StatusContinue to
+// read the body, or the status of the response rejecting the request, such
+// as 417 Expectation Failed or 413 Request Entity Too Large. 100 Continue is
+// sent to all of them if it's not set.
+func (p *ServerProcessor) SetExpectContinue(f func(request *http.Request) int) {
+	p.expectContinue = f
+}
+
+// EnableRecycling makes the processor reuse the requests, their headers
+// and bodies, and the responses once their handler returned, rather than
+// allocating new ones for each request. The handlers must not use them after
+// returning, unless the response is hijacked or detached.
+func (p *ServerProcessor) EnableRecycling() {
+	p.recycling = true
+}
+
+// EnableStreaming makes the processor call the handler as soon as the header
+// of a request with a body is parsed, the body is then read from a BodyPipe
+// while it arrives. Reading from the connection is paused while more than
+// maxBufferSize bytes of the body are waiting to be read by the handler.
+//
+// The handler is called on a new goroutine for such requests.
+func (p *ServerProcessor) EnableStreaming(maxBufferSize int) {
+	if maxBufferSize <= 0 {
+		maxBufferSize = DefaultMaxBodyBufferSize
+	}
+	p.streaming = true
+	p.maxBufferSize = maxBufferSize
+}
+
+func (p *ServerProcessor) setParser(parser *Parser) {
+	p.parser = parser
+}
+
+// setConn sets the connection the requests are read from and the responses
+// written to.
+func (p *ServerProcessor) setConn(conn net.Conn) {
+	p.conn = conn
+	if conn != nil {
+		p.responses.setWriter(conn)
+	}
+}
 
-	p.handler.ServeHTTP(p.newResponse(conn, request), request)
+func (p *ServerProcessor) onClose(err error) {
+	p.responses.close()
+	p.mux.Lock()
+	bodyPipe := p.bodyPipe
+	p.bodyPipe = nil
+	p.mux.Unlock()
+	if bodyPipe != nil {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		bodyPipe.closeWithError(err)
+	}
 }
 
 // WriteTo .
 func (p *ServerProcessor) WriteTo(w io.Writer, data []byte) (int, error) {
-	return len(data), nil
+	if w == nil {
+		return len(data), nil
+	}
+	return w.Write(data)
 }
 
 // HandleMessage .
@@ -144,31 +601,118 @@ func (p *ServerProcessor) HandleMessage(handler http.Handler) {
 	}
 }
 
-func (p *ServerProcessor) newResponse(conn net.Conn, request *http.Request) http.ResponseWriter {
-	response := &Response{
-		writer:    conn,
-		processor: p,
-		request:   request,
-		sequence:  atomic.AddUint64(&p.sequence, 1),
-		header:    http.Header{},
+// pipelineFull implements pipeliner.
+func (p *ServerProcessor) pipelineFull() bool {
+	return p.responses.full()
+}
+
+// unblock parses the requests read while the pipeline was full, it's called
+// by the goroutine writing the response that makes room for them.
+func (p *ServerProcessor) unblock() {
+	if p.parser == nil {
+		return
+	}
+	if err := p.parser.unblock(); err != nil {
+		p.onParseError(err)
+	}
+}
+
+// onParseError answers the request that couldn't be parsed after the
+// responses to the previous requests, then closes the connection.
+func (p *ServerProcessor) onParseError(err error) {
+	if p.parser != nil {
+		p.parser.discard()
+	}
+	p.mux.Lock()
+	bodyPipe := p.bodyPipe
+	p.bodyPipe = nil
+	p.mux.Unlock()
+	if bodyPipe != nil {
+		bodyPipe.closeWithError(err)
+	}
+
+	// the request may have been sent 100 Continue
+	seq := p.expectSequence
+	p.expectSequence = 0
+	if seq == 0 {
+		seq = p.responses.add()
 	}
+	p.responses.closeAfter(seq)
+	p.responses.write(seq, errorResponse(err), true)
+}
+
+// SetExecutor makes the processor run the handlers with executor, nil runs
+// them inline on the parsing goroutine.
+func (p *ServerProcessor) SetExecutor(executor Executor) {
+	p.executor = executor
+}
+
+// SetMaxPipelineDepth sets the number of requests of the connection whose
+// responses are not written yet, reading from the connection is paused when
+// it's reached, and the requests already read are only dispatched once
+// responses have been written.
+func (p *ServerProcessor) SetMaxPipelineDepth(maxDepth int) {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxPipelineDepth
+	}
+	p.responses.mux.Lock()
+	p.responses.maxDepth = uint64(maxDepth)
+	p.responses.mux.Unlock()
+}
+
+// SetMaxKeepAliveRequests sets the number of requests served on the
+// connection, it's closed after the response to the last one. 0 means no
+// limit.
+func (p *ServerProcessor) SetMaxKeepAliveRequests(n int) {
+	p.maxKeepAliveRequests = n
+}
+
+func (p *ServerProcessor) newResponse(conn net.Conn, request *http.Request) *Response {
+	var response *Response
+	if p.recycling {
+		response = getResponse()
+	} else {
+		response = &Response{header: http.Header{}}
+	}
+	response.processor = p
+	response.request = request
+	response.sequence = p.expectSequence
+	if response.sequence == 0 {
+		response.sequence = p.responses.add()
+	}
+	p.expectSequence = 0
+	nRequests := int(atomic.AddInt32(&p.nRequests, 1))
+	if p.maxKeepAliveRequests > 0 {
+		response.keepAliveMax = p.maxKeepAliveRequests - nRequests
+	}
+	response.close = request.Close || (p.maxKeepAliveRequests > 0 && response.keepAliveMax <= 0)
 	return response
 }
 
-// NewServerProcessor .
+// writeResponse writes data of a response in the order of the requests.
+func (p *ServerProcessor) writeResponse(response *Response, data []byte, done bool) error {
+	return p.responses.write(response.sequence, data, done)
+}
+
+// NewServerProcessor creates a processor that calls handler inline on the
+// parsing goroutine, see SetExecutor.
 func NewServerProcessor(handler http.Handler) Processor {
 	if handler == nil {
 		panic(errors.New("invalid handler for ServerProcessor: nil"))
 	}
-	return &ServerProcessor{
+	p := &ServerProcessor{
 		handler: handler,
 	}
+	p.responses.init(nil, DefaultMaxPipelineDepth)
+	p.responses.unblock = p.unblock
+	return p
 }
 
 // ClientProcessor .
 type ClientProcessor struct {
-	response *http.Response
-	handler  func(*http.Response)
+	response      *http.Response
+	handler       func(*http.Response)
+	informational func(*http.Response)
 }
 
 // OnMethod .
@@ -218,11 +762,9 @@ func (p *ClientProcessor) OnContentLength(contentLength int) {
 // OnBody .
 func (p *ClientProcessor) OnBody(data []byte) {
 	if p.response.Body == nil {
-		p.response.Body = &BodyReader{buffer: data}
-	} else {
-		br := p.response.Body.(*BodyReader)
-		br.buffer = append(br.buffer, data...)
+		p.response.Body = &BodyReader{}
 	}
+	p.response.Body.(*BodyReader).append(data)
 }
 
 // OnTrailerHeader .
@@ -239,6 +781,14 @@ func (p *ClientProcessor) OnComplete(conn net.Conn) {
 	p.response = nil
 }
 
+// OnInformational .
+func (p *ClientProcessor) OnInformational(conn net.Conn) {
+	if p.informational != nil {
+		p.informational(p.response)
+	}
+	p.response = nil
+}
+
 // WriteTo .
 func (p *ClientProcessor) WriteTo(w io.Writer, data []byte) (int, error) {
 	return len(data), nil
@@ -251,6 +801,12 @@ func (p *ClientProcessor) HandleMessage(handler func(*http.Response)) {
 	}
 }
 
+// HandleInformational sets the handler of the 1xx responses other than 101,
+// they're dropped if it's nil.
+func (p *ClientProcessor) HandleInformational(handler func(*http.Response)) {
+	p.informational = handler
+}
+
 // NewClientProcessor .
 func NewClientProcessor(handler func(*http.Response)) Processor {
 	if handler == nil {
@@ -304,6 +860,31 @@ func (p *EmptyProcessor) OnTrailerHeader(key, value string) {
 
 }
 
+// OnURLBytes .
+func (p *EmptyProcessor) OnURLBytes(uri []byte) error {
+	return nil
+}
+
+// OnProtoBytes .
+func (p *EmptyProcessor) OnProtoBytes(proto []byte) error {
+	return nil
+}
+
+// OnStatusBytes .
+func (p *EmptyProcessor) OnStatusBytes(code int, status []byte) {
+
+}
+
+// OnHeaderBytes .
+func (p *EmptyProcessor) OnHeaderBytes(key, value []byte) {
+
+}
+
+// OnTrailerHeaderBytes .
+func (p *EmptyProcessor) OnTrailerHeaderBytes(key, value []byte) {
+
+}
+
 // OnComplete .
 func (p *EmptyProcessor) OnComplete(conn net.Conn) {
 
@@ -1,8 +1,14 @@
 package nbhttp
 
 import (
-	"io"
 	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/net/http/httpguts"
 )
 
 // type ResponseWriter interface {
@@ -11,11 +17,22 @@ import (
 // 	WriteHeader(statusCode int)
 // }
 
+var (
+	headerNewlineToSpace = strings.NewReplacer("\n", " ", "\r", " ")
+
+	crlf      = []byte("\r\n")
+	lastChunk = []byte("0\r\n\r\n")
+)
+
+const (
+	// DefaultResponseBufferSize is the size of the body buffered by a Response
+	// before it's flushed to the connection.
+	DefaultResponseBufferSize = 32 * 1024
+)
+
 // Response represents the server side of an HTTP response.
-// todo:
 type Response struct {
-	writer    io.Writer
-	processor Processor
+	processor *ServerProcessor
 
 	sequence uint64
 	request  *http.Request // request for this response
@@ -23,9 +40,20 @@ type Response struct {
 	statusCode int // status code passed to WriteHeader
 	status     string
 	header     http.Header
-	trailers   http.Header
+	trailers   http.Header // announced trailers, sent after the last chunk
 
 	body []byte
+
+	close        bool // the connection is closed after the response
+	keepAliveMax int  // number of requests left on the connection, if limited
+
+	inline      bool // the handler runs inside Parser.Read
+	wroteHeader bool // the header has been written to the connection
+	chunked     bool
+	bodyAllowed bool
+	detached    bool // the response outlives the handler, see SSEWriter
+	finished    bool
+	hijacked    bool // the connection has been hijacked or upgraded
 }
 
 // Header .
@@ -35,15 +63,42 @@ func (response *Response) Header() http.Header {
 
 // Write .
 func (response *Response) Write(data []byte) (int, error) {
+	if response.hijacked {
+		return 0, http.ErrHijacked
+	}
 	response.WriteHeader(http.StatusOK)
 	if len(data) > 0 {
 		response.body = append(response.body, data...)
+		if len(response.body) >= DefaultResponseBufferSize {
+			response.Flush()
+		}
+	}
+	return len(data), nil
+}
+
+// WriteString .
+func (response *Response) WriteString(s string) (int, error) {
+	if response.hijacked {
+		return 0, http.ErrHijacked
+	}
+	response.WriteHeader(http.StatusOK)
+	if len(s) > 0 {
+		response.body = append(response.body, s...)
+		if len(response.body) >= DefaultResponseBufferSize {
+			response.Flush()
+		}
 	}
-	return response.processor.WriteTo(response.writer, data)
+	return len(s), nil
 }
 
-// WriteHeader .
+// WriteHeader . A 1xx status other than 101 sends an informational
+// response with the current header, such as 103 Early Hints, before the
+// final one.
 func (response *Response) WriteHeader(statusCode int) {
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		response.writeInformational(statusCode)
+		return
+	}
 	if response.statusCode == 0 {
 		response.status = http.StatusText(statusCode)
 		if response.status != "" {
@@ -51,3 +106,309 @@ func (response *Response) WriteHeader(statusCode int) {
 		}
 	}
 }
+
+// writeInformational writes a 1xx response, unless the final header has
+// been written or the client is an HTTP/1.0 one, which doesn't expect them.
+func (response *Response) writeInformational(statusCode int) {
+	status := http.StatusText(statusCode)
+	if status == "" || response.statusCode != 0 || response.wroteHeader || response.finished || response.hijacked {
+		return
+	}
+	if response.request != nil && !response.request.ProtoAtLeast(1, 1) {
+		return
+	}
+	data := append([]byte("HTTP/1.1 "), strconv.Itoa(statusCode)...)
+	data = append(data, ' ')
+	data = append(data, status...)
+	data = append(data, crlf...)
+	data = appendHeader(data, response.header, nil)
+	data = append(data, crlf...)
+	response.processor.writeResponse(response, data, false)
+}
+
+// abort replaces the response of a handler that panicked with 500 Internal
+// Server Error if its header hasn't been written, otherwise the rest of the
+// body is dropped so that the response can't look complete. The connection
+// is closed after it in both cases.
+func (response *Response) abort() {
+	if response.hijacked || response.finished {
+		return
+	}
+	response.close = true
+	response.detached = false
+	response.body = response.body[:0]
+	if !response.wroteHeader {
+		clear(response.header)
+		response.statusCode = http.StatusInternalServerError
+		response.status = http.StatusText(http.StatusInternalServerError)
+		return
+	}
+	response.bodyAllowed = false
+	response.processor.responses.closeAfter(response.sequence)
+}
+
+// Flush implements http.Flusher, it writes the header and the buffered body
+// to the connection. The body is sent with chunked encoding if the handler
+// didn't set Content-Length, or until the connection is closed for HTTP/1.0
+// clients.
+func (response *Response) Flush() {
+	response.flush()
+}
+
+func (response *Response) flush() error {
+	if response.finished || response.hijacked {
+		return http.ErrHijacked
+	}
+	response.WriteHeader(http.StatusOK)
+
+	var data []byte
+	if !response.wroteHeader {
+		data = response.encodeHeader(false)
+	}
+	data = response.appendBody(data)
+	if len(data) == 0 {
+		return nil
+	}
+	return response.processor.writeResponse(response, data, false)
+}
+
+// finish serializes the status line, headers and buffered body, then writes
+// them to the connection through the processor, after the responses to the
+// previous requests.
+func (response *Response) finish() error {
+	if response.detached {
+		return nil
+	}
+	return response.complete()
+}
+
+// complete is finish for detached responses too.
+func (response *Response) complete() error {
+	if response.finished {
+		return nil
+	}
+	response.finished = true
+	if response.hijacked {
+		// let the responses to the next requests through
+		return response.processor.writeResponse(response, nil, true)
+	}
+	response.WriteHeader(http.StatusOK)
+
+	var data []byte
+	if !response.wroteHeader {
+		data = response.encodeHeader(true)
+	}
+	data = response.appendBody(data)
+	if response.chunked {
+		data = response.appendTrailers(data)
+	}
+	return response.processor.writeResponse(response, data, true)
+}
+
+// encodeHeader serializes the status line and the headers. final reports
+// whether the whole body is buffered, otherwise the body is sent chunked
+// unless its length is known.
+func (response *Response) encodeHeader(final bool) []byte {
+	response.wroteHeader = true
+	statusCode := response.statusCode
+	header := response.header
+	bodyAllowed := bodyAllowedForStatus(statusCode)
+	isHead := response.request != nil && response.request.Method == "HEAD"
+	if response.request != nil && response.request.Method == http.MethodConnect && statusCode/100 == 2 {
+		// a tunnel is established, the data following the header is not a body
+		bodyAllowed = false
+	}
+	// HTTP/1.0 clients don't understand chunked encoding
+	http11 := response.request == nil || response.request.ProtoAtLeast(1, 1)
+	hasLength := header.Get("Content-Length") != ""
+
+	// the handler can close the connection with a Connection: close header
+	if httpguts.HeaderValuesContainsToken(header["Connection"], "close") {
+		response.close = true
+	}
+
+	chunked := bodyAllowed && http11 && httpguts.HeaderValuesContainsToken(header["Transfer-Encoding"], "chunked")
+	if bodyAllowed && http11 && !isHead && !hasLength && hasTrailers(header) {
+		// the trailers follow the last chunk
+		chunked = true
+	}
+	if !final && bodyAllowed && !isHead && !hasLength {
+		if http11 {
+			chunked = true
+		} else {
+			// the end of the body is the end of the connection
+			response.close = true
+		}
+	}
+	if response.close {
+		header.Set("Connection", "close")
+		header.Del("Keep-Alive")
+		response.processor.responses.closeAfter(response.sequence)
+	} else if !http11 {
+		header.Set("Connection", "keep-alive")
+		if response.keepAliveMax > 0 {
+			header.Set("Keep-Alive", "max="+strconv.Itoa(response.keepAliveMax))
+		}
+	}
+	if chunked {
+		header.Del("Content-Length")
+		header.Set("Transfer-Encoding", "chunked")
+		response.trailers = announcedTrailers(header)
+	} else {
+		header.Del("Transfer-Encoding")
+		if bodyAllowed {
+			if final && !hasLength && !(isHead && len(response.body) == 0) {
+				header.Set("Content-Length", strconv.Itoa(len(response.body)))
+			}
+		} else {
+			header.Del("Content-Length")
+		}
+	}
+	if _, hasType := header["Content-Type"]; !hasType && bodyAllowed && len(response.body) > 0 {
+		header.Set("Content-Type", http.DetectContentType(response.body))
+	}
+	if _, ok := header["Date"]; !ok {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	response.chunked = chunked
+	response.bodyAllowed = bodyAllowed && !isHead
+
+	size := 64 + len(response.body)
+	for k, vv := range header {
+		for _, v := range vv {
+			size += len(k) + len(v) + 4
+		}
+	}
+	data := make([]byte, 0, size)
+
+	data = append(data, "HTTP/1.1 "...)
+	data = strconv.AppendInt(data, int64(statusCode), 10)
+	data = append(data, ' ')
+	data = append(data, response.status...)
+	data = append(data, crlf...)
+
+	data = appendHeader(data, header, response.trailers)
+	return append(data, crlf...)
+}
+
+// appendBody appends the buffered body to data, as a chunk if the response
+// is chunked.
+func (response *Response) appendBody(data []byte) []byte {
+	body := response.body
+	response.body = response.body[:0]
+	if !response.bodyAllowed || len(body) == 0 {
+		return data
+	}
+	if response.chunked {
+		data = strconv.AppendInt(data, int64(len(body)), 16)
+		data = append(data, crlf...)
+		data = append(data, body...)
+		return append(data, crlf...)
+	}
+	return append(data, body...)
+}
+
+// appendTrailers appends the last chunk and the trailers, which are the
+// header values of the keys announced by the Trailer header and the keys
+// prefixed by http.TrailerPrefix.
+func (response *Response) appendTrailers(data []byte) []byte {
+	if !response.bodyAllowed {
+		return data
+	}
+	var trailers http.Header
+	for k := range response.trailers {
+		if vv, ok := response.header[k]; ok {
+			if trailers == nil {
+				trailers = http.Header{}
+			}
+			trailers[k] = vv
+		}
+	}
+	for k, vv := range response.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			if trailers == nil {
+				trailers = http.Header{}
+			}
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = vv
+		}
+	}
+	if len(trailers) == 0 {
+		return append(data, lastChunk...)
+	}
+	data = append(data, "0\r\n"...)
+	data = appendHeader(data, trailers, nil)
+	return append(data, crlf...)
+}
+
+// hasTrailers reports whether the handler announced trailers or set keys
+// prefixed by http.TrailerPrefix.
+func hasTrailers(header http.Header) bool {
+	if len(header["Trailer"]) > 0 {
+		return true
+	}
+	for k := range header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// announcedTrailers returns the keys of the Trailer header.
+func announcedTrailers(header http.Header) http.Header {
+	var trailers http.Header
+	for _, v := range header["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(textproto.TrimString(k))
+			if !httpguts.ValidTrailerHeader(k) {
+				continue
+			}
+			if trailers == nil {
+				trailers = http.Header{}
+			}
+			trailers[k] = nil
+		}
+	}
+	return trailers
+}
+
+// appendHeader appends the fields of header, except the keys of skip.
+func appendHeader(data []byte, header http.Header, skip http.Header) []byte {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		if !httpguts.ValidHeaderFieldName(k) {
+			continue
+		}
+		if _, ok := skip[k]; ok {
+			// sent as a trailer
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			v = headerNewlineToSpace.Replace(v)
+			v = strings.TrimSpace(v)
+			data = append(data, k...)
+			data = append(data, ": "...)
+			data = append(data, v...)
+			data = append(data, crlf...)
+		}
+	}
+	return data
+}
+
+// bodyAllowedForStatus reports whether a given response status code
+// permits a body. See RFC 7230, section 3.3.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == 204:
+		return false
+	case status == 304:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package nbhttp
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *testConn) Close() error                       { c.closed = true; return nil }
+func (c *testConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *testConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newTestProcessor(conn net.Conn, handler http.Handler) *ServerProcessor {
+	processor := NewServerProcessor(handler).(*ServerProcessor)
+	processor.setConn(conn)
+	return processor
+}
+
+func TestResponseWrite(t *testing.T) {
+	conn := &testConn{}
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("X-Test", "nbhttp")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	parser := NewParser(conn, newTestProcessor(conn, mux), false, 1024*1024*4)
+	if err := parser.Read([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var response *http.Response
+	var body []byte
+	client := NewParser(nil, NewClientProcessor(func(res *http.Response) {
+		response = res
+		body = readBody(res)
+	}), true, 1024*1024*4)
+	if err := client.Read(conn.Bytes()); err != nil {
+		t.Fatalf("%v: %q", err, conn.String())
+	}
+	if response == nil {
+		t.Fatalf("no response parsed: %q", conn.String())
+	}
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("invalid status code: %v", response.StatusCode)
+	}
+	if response.Header.Get("X-Test") != "nbhttp" {
+		t.Fatalf("invalid header: %v", response.Header)
+	}
+	if response.Header.Get("Content-Length") != "5" || response.Header.Get("Date") == "" {
+		t.Fatalf("invalid header: %v", response.Header)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("invalid body: %q", body)
+	}
+}
+
+func TestResponseChunked(t *testing.T) {
+	conn := &testConn{}
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Write([]byte("hello world"))
+	})
+	parser := NewParser(conn, newTestProcessor(conn, mux), false, 1024*1024*4)
+	if err := parser.Read([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\nHEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Transfer-Encoding: chunked\r\n\r\nb\r\nhello world\r\n0\r\n\r\n"
+	if !bytes.Contains(conn.Bytes(), []byte(expected)) {
+		t.Fatalf("invalid response: %q", conn.String())
+	}
+	if !bytes.HasSuffix(conn.Bytes(), []byte("Transfer-Encoding: chunked\r\n\r\n")) {
+		t.Fatalf("HEAD response should not have body: %q", conn.String())
+	}
+}
+
+func TestResponseFlush(t *testing.T) {
+	conn := &testConn{}
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("Trailer", "X-Sum")
+		w.Write([]byte("hello "))
+		w.(http.Flusher).Flush()
+		if request.ProtoAtLeast(1, 1) && !bytes.HasSuffix(conn.Bytes(), []byte("\r\n\r\n6\r\nhello \r\n")) {
+			t.Errorf("body not flushed: %q", conn.String())
+		}
+		w.Write([]byte("world"))
+		w.Header().Set("X-Sum", "11")
+		w.Header().Set(http.TrailerPrefix+"X-Extra", "nbhttp")
+	})
+	parser := NewParser(conn, newTestProcessor(conn, mux), false, 1024*1024*4)
+	if err := parser.Read([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var response *http.Response
+	var body []byte
+	client := NewParser(nil, NewClientProcessor(func(res *http.Response) {
+		response = res
+		body = readBody(res)
+	}), true, 1024*1024*4)
+	if err := client.Read(conn.Bytes()); err != nil {
+		t.Fatalf("%v: %q", err, conn.String())
+	}
+	if response == nil || string(body) != "hello world" {
+		t.Fatalf("invalid response: %q", conn.String())
+	}
+	if response.Header.Get("Transfer-Encoding") != "chunked" && len(response.TransferEncoding) == 0 {
+		t.Fatalf("response not chunked: %q", conn.String())
+	}
+	if response.Trailer.Get("X-Sum") != "11" || response.Trailer.Get("X-Extra") != "nbhttp" {
+		t.Fatalf("invalid trailers: %v", response.Trailer)
+	}
+
+	// HTTP/1.0 clients get the body until the connection is closed
+	conn = &testConn{}
+	parser = NewParser(conn, newTestProcessor(conn, mux), false, 1024*1024*4)
+	if err := parser.Read([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(conn.Bytes(), []byte("Connection: close\r\n")) || !bytes.HasSuffix(conn.Bytes(), []byte("\r\n\r\nhello world")) {
+		t.Fatalf("invalid response: %q", conn.String())
+	}
+	if !conn.closed {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestResponseTrailersWithoutFlush(t *testing.T) {
+	conn := &testConn{}
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("Trailer", "X-Sum")
+		w.Write([]byte("hello"))
+		w.Header().Set("X-Sum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "nbhttp")
+	})
+	parser := NewParser(conn, newTestProcessor(conn, mux), false, 1024*1024*4)
+	if err := parser.Read([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(conn.Bytes(), []byte("Content-Length")) || !bytes.Contains(conn.Bytes(), []byte("Transfer-Encoding: chunked\r\n")) {
+		t.Fatalf("response not chunked: %q", conn.String())
+	}
+
+	var response *http.Response
+	var body []byte
+	client := NewParser(nil, NewClientProcessor(func(res *http.Response) {
+		response = res
+		body = readBody(res)
+	}), true, 1024*1024*4)
+	if err := client.Read(conn.Bytes()); err != nil {
+		t.Fatalf("%v: %q", err, conn.String())
+	}
+	if response == nil || string(body) != "hello" {
+		t.Fatalf("invalid response: %q", conn.String())
+	}
+	if response.Header.Get("X-Sum") != "" {
+		t.Fatalf("trailer sent in the header: %q", conn.String())
+	}
+	if response.Trailer.Get("X-Sum") != "abc" || response.Trailer.Get("X-Late") != "nbhttp" {
+		t.Fatalf("invalid trailers: %v", response.Trailer)
+	}
+}
+
+func readBody(res *http.Response) []byte {
+	if res.Body == nil {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	buf.ReadFrom(res.Body)
+	return buf.Bytes()
+}
+
+func TestResponseOrder(t *testing.T) {
+	conn := &testConn{}
+	processor := newTestProcessor(conn, http.NotFoundHandler())
+
+	var responses []*Response
+	for i := 0; i < 5; i++ {
+		request, _ := http.NewRequest("GET", "/", nil)
+		responses = append(responses, processor.newResponse(conn, request))
+	}
+	for i := len(responses) - 1; i >= 0; i-- {
+		responses[i].Write([]byte{byte('0' + i)})
+		responses[i].finish()
+		if i > 0 && conn.Len() > 0 {
+			t.Fatalf("response %v written before response 0: %q", i, conn.String())
+		}
+	}
+
+	var bodies []byte
+	parser := NewParser(nil, NewClientProcessor(func(res *http.Response) {
+		bodies = append(bodies, readBody(res)...)
+	}), true, 1024*1024*4)
+	if err := parser.Read(conn.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if string(bodies) != "01234" {
+		t.Fatalf("invalid order: %q", bodies)
+	}
+}
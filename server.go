@@ -0,0 +1,388 @@
+package nbhttp
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReadBufferSize .
+	DefaultReadBufferSize = 1024 * 32
+
+	// DefaultMaxReadSize .
+	DefaultMaxReadSize = 1024 * 1024 * 4
+
+	// DefaultMaxWriteBufferSize .
+	DefaultMaxWriteBufferSize = 1024 * 1024 * 64
+)
+
+// Config .
+type Config struct {
+	// Network is the listening network, "tcp" by default.
+	Network string
+
+	// Addrs is the list of addresses to listen on.
+	Addrs []string
+
+	// NPoller is the number of pollers, runtime.NumCPU() by default.
+	NPoller int
+
+	// ReadBufferSize is the size of each poller's read buffer.
+	ReadBufferSize int
+
+	// MaxWriteBufferSize is the size of the data a connection buffers while
+	// its client doesn't read, the connection is closed above it.
+	// DefaultMaxWriteBufferSize if 0.
+	MaxWriteBufferSize int
+
+	// Engine runs the pollers of the server's connections, the server
+	// creates and owns one with NPoller, ReadBufferSize and
+	// MaxWriteBufferSize if nil.
+	Engine *Engine
+
+	// MaxReadSize is passed to each connection's Parser.
+	MaxReadSize int
+
+	// TLSConfig makes the server serve HTTPS, its certificates can be
+	// selected by SNI with GetCertificate. NextProtos is "http/1.1", preceded
+	// by "h2" if HTTP2 is set, if empty.
+	TLSConfig *tls.Config
+
+	// MaxTLSHandshakes is the number of TLS handshakes computed at once. Each
+	// handshake blocks a goroutine until it's complete since crypto/tls can't
+	// resume a handshake from the pollers, the handshakes waiting for the
+	// records of their clients don't count. DefaultMaxTLSHandshakes if 0.
+	MaxTLSHandshakes int
+
+	// TLSHandshakeTimeout is the time allowed for the TLS handshake since
+	// the accept, whatever the Timeouts, the connection is closed after it.
+	// DefaultTLSHandshakeTimeout if 0.
+	TLSHandshakeTimeout time.Duration
+
+	// HTTP2 enables HTTP/2, negotiated by ALPN under TLS, with prior
+	// knowledge or an "Upgrade: h2c" request otherwise.
+	HTTP2 *HTTP2Config
+
+	// Limits bounds the size of the requests.
+	Limits Limits
+
+	// Timeouts bounds the time spent reading requests, writing responses and
+	// waiting for the next request.
+	Timeouts Timeouts
+
+	// Methods is the set of accepted request methods, StrictMethods if nil.
+	Methods *MethodPolicy
+
+	// StrictParsing rejects the requests whose framing is ambiguous, see
+	// Parser.SetStrict.
+	StrictParsing bool
+
+	// DecodeTransferEncoding makes the gzip and deflate transfer codings of
+	// the request bodies be decoded, see Parser.SetTransferDecoding.
+	DecodeTransferEncoding bool
+
+	// StreamingBody makes the handler be called as soon as the header of a
+	// request is parsed, see ServerProcessor.EnableStreaming.
+	StreamingBody bool
+
+	// MaxBodyBufferSize is the size of the body buffered before reading
+	// from the connection is paused in streaming mode.
+	MaxBodyBufferSize int
+
+	// MaxPipelineDepth is the number of pipelined requests of a connection
+	// waiting for their responses before reading and parsing its requests
+	// is paused.
+	MaxPipelineDepth int
+
+	// MaxKeepAliveRequests is the number of requests served on a connection
+	// before it's closed, no limit if 0.
+	MaxKeepAliveRequests int
+
+	// RecycleRequests makes the requests and responses be reused once their
+	// handler returned, see ServerProcessor.EnableRecycling.
+	RecycleRequests bool
+
+	// ExpectContinue decides whether the body of the requests sent with
+	// "Expect: 100-continue" is read, see ServerProcessor.SetExpectContinue.
+	ExpectContinue func(request *http.Request) int
+
+	// Handler serves the requests, http.DefaultServeMux by default.
+	Handler http.Handler
+
+	// Executor runs Handler, it's called inline on the pollers if nil.
+	Executor Executor
+}
+
+// Server serves HTTP/1.x on many connections with a small number of
+// goroutines: pollers read from the connections and feed each connection's
+// Parser, which calls Handler when a request is complete.
+type Server struct {
+	Config
+
+	mux         sync.Mutex
+	wg          sync.WaitGroup
+	listeners   []net.Listener
+	timers      *connTimers
+	handshaker  *tlsHandshaker
+	ownedEngine bool
+	shutdown    bool
+}
+
+// NewServer .
+func NewServer(conf Config) *Server {
+	if conf.Network == "" {
+		conf.Network = "tcp"
+	}
+	if conf.MaxReadSize <= 0 {
+		conf.MaxReadSize = DefaultMaxReadSize
+	}
+	if conf.Handler == nil {
+		conf.Handler = http.DefaultServeMux
+	}
+	if conf.TLSConfig != nil {
+		conf.TLSConfig = conf.TLSConfig.Clone()
+		if len(conf.TLSConfig.NextProtos) == 0 {
+			conf.TLSConfig.NextProtos = []string{"http/1.1"}
+			if conf.HTTP2 != nil {
+				conf.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+			}
+		}
+	}
+	ownedEngine := false
+	if conf.Engine == nil {
+		conf.Engine = NewEngine(conf.NPoller, conf.ReadBufferSize)
+		if conf.MaxWriteBufferSize > 0 {
+			conf.Engine.MaxWriteBufferSize = conf.MaxWriteBufferSize
+		}
+		ownedEngine = true
+	}
+	s := &Server{
+		Config:      conf,
+		ownedEngine: ownedEngine,
+	}
+	if conf.TLSConfig != nil {
+		s.handshaker = newTLSHandshaker(conf.MaxTLSHandshakes, conf.TLSHandshakeTimeout)
+	}
+	return s
+}
+
+// Start listens on Addrs and starts the Engine if it's owned by the server.
+func (s *Server) Start() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.shutdown {
+		return ErrServerStopped
+	}
+
+	if err := s.Engine.Start(); err != nil {
+		return err
+	}
+	if s.Timeouts.enabled() {
+		s.timers = newConnTimers(s.Timeouts)
+	}
+
+	for _, addr := range s.Addrs {
+		ln, err := net.Listen(s.Network, addr)
+		if err != nil {
+			s.stopLocked()
+			return err
+		}
+		s.listeners = append(s.listeners, ln)
+		s.wg.Add(1)
+		go s.accept(ln)
+	}
+
+	return nil
+}
+
+// Stop closes the listeners, then stops the Engine if it's owned by the
+// server.
+func (s *Server) Stop() {
+	s.mux.Lock()
+	s.stopLocked()
+	s.mux.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) stopLocked() {
+	if s.shutdown {
+		return
+	}
+	s.shutdown = true
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	if s.ownedEngine {
+		s.Engine.Stop()
+	}
+	if s.timers != nil {
+		s.timers.stop()
+	}
+}
+
+// NumConns returns the number of open connections of the Engine.
+func (s *Server) NumConns() int {
+	return s.Engine.NumConns()
+}
+
+// Addr returns the addresses the server is listening on.
+func (s *Server) Addr() []net.Addr {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, ln := range s.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+func (s *Server) accept(ln net.Listener) {
+	defer s.wg.Done()
+
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mux.Lock()
+			shutdown := s.shutdown
+			s.mux.Unlock()
+			if shutdown {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			log.Printf("nbhttp: Accept failed: %v", err)
+			return
+		}
+		tempDelay = 0
+
+		if _, err := s.Engine.addConn(conn, s); err != nil {
+			log.Printf("nbhttp: add conn failed: %v", err)
+		}
+	}
+}
+
+func (s *Server) onOpen(conn net.Conn) (*Parser, error) {
+	var tlsConn *TLSConn
+	if s.TLSConfig != nil {
+		// the parser and the responses use the plaintext connection
+		tlsConn = newTLSConn(conn, s.TLSConfig, s.handshaker)
+		conn = tlsConn
+	}
+	processor := NewServerProcessor(s.Handler).(*ServerProcessor)
+	processor.setConn(conn)
+	processor.SetExecutor(s.Executor)
+	if s.StreamingBody {
+		processor.EnableStreaming(s.MaxBodyBufferSize)
+	}
+	if s.RecycleRequests {
+		processor.EnableRecycling()
+	}
+	processor.SetExpectContinue(s.ExpectContinue)
+	if s.MaxPipelineDepth > 0 {
+		processor.SetMaxPipelineDepth(s.MaxPipelineDepth)
+	}
+	processor.SetMaxKeepAliveRequests(s.MaxKeepAliveRequests)
+	if s.HTTP2 != nil {
+		processor.enableHTTP2(s.HTTP2, tlsConn == nil)
+	}
+	if s.timers != nil {
+		processor.responses.timed = true
+		processor.timer = s.timers.add(conn, processor, time.Now())
+	}
+	parser := NewParser(conn, processor, false, s.MaxReadSize)
+	parser.SetLimits(s.Limits)
+	parser.SetMethodPolicy(s.Methods)
+	parser.SetStrict(s.StrictParsing)
+	parser.SetTransferDecoding(s.DecodeTransferEncoding)
+	if tlsConn != nil {
+		tlsConn.parser = parser
+		tlsConn.onError = func(err error) {
+			s.onParseError(tlsConn, parser, err)
+		}
+		if s.HTTP2 != nil {
+			tlsConn.onHandshake = func() {
+				if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+					processor.startH2()
+				}
+			}
+		}
+	}
+	return parser, nil
+}
+
+func (s *Server) onData(conn net.Conn, parser *Parser, data []byte) {
+	var timer *connTimer
+	var now time.Time
+	p, _ := parser.processor.(*ServerProcessor)
+	if p != nil && p.timer != nil {
+		timer = p.timer
+		now = time.Now()
+	}
+	if p != nil && p.h2Sniffing {
+		if data = p.sniffH2C(data); len(data) == 0 {
+			return
+		}
+	}
+	if tlsConn, ok := parser.conn.(*TLSConn); ok {
+		tlsConn.feed(data)
+	} else if err := parser.Read(data); err != nil {
+		s.onParseError(conn, parser, err)
+		return
+	}
+	if timer != nil {
+		timer.onRead(now, parser.phase())
+	}
+}
+
+// onParseError closes a connection whose input couldn't be parsed, after
+// the responses to the requests read before.
+func (s *Server) onParseError(conn net.Conn, parser *Parser, err error) {
+	if p, ok := parser.processor.(*ServerProcessor); ok && !parser.isUpgraded() {
+		p.onParseError(err)
+		return
+	}
+	conn.Close()
+}
+
+func (s *Server) onClose(conn net.Conn, parser *Parser, err error) {
+	if tlsConn, ok := parser.conn.(*TLSConn); ok {
+		tlsConn.onClose()
+	}
+	parser.onClose(err)
+	if p, ok := parser.processor.(*ServerProcessor); ok && p.timer != nil {
+		s.timers.remove(p.timer)
+	}
+}
+
+// errorResponse returns the response sent before closing a connection whose
+// input couldn't be parsed.
+func errorResponse(err error) []byte {
+	switch err {
+	case ErrLineTooLarge:
+		return []byte("HTTP/1.1 414 Request-URI Too Long\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	case ErrHeaderTooLarge, ErrTooManyHeaders:
+		return []byte("HTTP/1.1 431 Request Header Fields Too Large\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	case ErrBodyTooLarge:
+		return []byte("HTTP/1.1 413 Request Entity Too Large\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	case ErrUnsupportedTransferEncoding:
+		return []byte("HTTP/1.1 501 Not Implemented\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	default:
+		return []byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	}
+}
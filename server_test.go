@@ -0,0 +1,1035 @@
+package nbhttp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, handler http.Handler) (*Server, string) {
+	return newTestServerWithExecutor(t, nil, handler)
+}
+
+func newTestServerWithExecutor(t *testing.T, executor Executor, handler http.Handler) (*Server, string) {
+	svr := NewServer(Config{
+		Addrs:    []string{"127.0.0.1:0"},
+		NPoller:  2,
+		Handler:  handler,
+		Executor: executor,
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return svr, "http://" + svr.Addr()[0].String()
+}
+
+func TestServer(t *testing.T) {
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if request.Body != nil {
+			io.Copy(w, request.Body)
+		}
+	})
+	svr, addr := newTestServer(t, mux)
+	defer svr.Stop()
+
+	client := &http.Client{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				body := fmt.Sprintf("hello %v-%v %v", i, j, strings.Repeat("x", i*j*1000))
+				res, err := client.Post(addr+"/echo", "text/plain", bytes.NewBufferString(body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, err := io.ReadAll(res.Body)
+				res.Body.Close()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if string(data) != body {
+					t.Errorf("invalid body: %v, expected %v", len(data), len(body))
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	res, err := client.Get(addr + "/notfound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("invalid status code: %v", res.StatusCode)
+	}
+}
+
+func TestServerRecycleRequests(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("X-Id", request.Header.Get("X-Id"))
+		io.Copy(w, request.Body)
+	})
+	for _, executor := range []Executor{nil, GoExecutor} {
+		svr := NewServer(Config{
+			Addrs:           []string{"127.0.0.1:0"},
+			NPoller:         2,
+			RecycleRequests: true,
+			Handler:         handler,
+			Executor:        executor,
+		})
+		if err := svr.Start(); err != nil {
+			t.Fatal(err)
+		}
+		addr := "http://" + svr.Addr()[0].String()
+
+		client := &http.Client{}
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					id := fmt.Sprintf("%v-%v", i, j)
+					body := id + strings.Repeat("x", (i*j%7)*20*1024)
+					req, _ := http.NewRequest("POST", addr, strings.NewReader(body))
+					req.Header.Set("X-Id", id)
+					res, err := client.Do(req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					data, _ := io.ReadAll(res.Body)
+					res.Body.Close()
+					if res.Header.Get("X-Id") != id || string(data) != body {
+						t.Errorf("invalid response to %v: %v, %v bytes", id, res.Header.Get("X-Id"), len(data))
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		client.CloseIdleConnections()
+		svr.Stop()
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	svr := NewServer(Config{
+		Addrs:   []string{"127.0.0.1:0"},
+		NPoller: 1,
+		Limits:  Limits{MaxBodySize: 16},
+		Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	res, err := http.Post("http://"+svr.Addr()[0].String(), "text/plain", strings.NewReader(strings.Repeat("x", 17)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("invalid status code: %v", res.StatusCode)
+	}
+}
+
+func TestServerStreamingBody(t *testing.T) {
+	started := make(chan struct{}, 1)
+	svr := NewServer(Config{
+		Addrs:             []string{"127.0.0.1:0"},
+		NPoller:           1,
+		StreamingBody:     true,
+		MaxBodyBufferSize: 1024,
+		Limits:            Limits{MaxBodySize: -1},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			started <- struct{}{}
+			n, err := io.Copy(io.Discard, request.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			fmt.Fprintf(w, "%v", n)
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+	addr := svr.Addr()[0].String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\n"))
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("handler not called before the body was sent")
+	}
+	conn.Write([]byte("hello"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(res.Body)
+	if string(data) != "5" {
+		t.Fatalf("invalid body size: %s", data)
+	}
+
+	size := 1024 * 1024 * 8
+	res, err = http.Post("http://"+addr, "text/plain", bytes.NewReader(make([]byte, size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	data, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != fmt.Sprintf("%v", size) {
+		t.Fatalf("invalid body size: %s", data)
+	}
+}
+
+func TestServerExecutor(t *testing.T) {
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/sleep/", func(w http.ResponseWriter, request *http.Request) {
+		d, _ := time.ParseDuration(strings.TrimPrefix(request.URL.Path, "/sleep/"))
+		time.Sleep(d)
+		w.Write([]byte(request.URL.Path))
+	})
+	svr := NewServer(Config{
+		Addrs:    []string{"127.0.0.1:0"},
+		NPoller:  1,
+		Executor: GoExecutor,
+		Handler:  mux,
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	paths := []string{"/sleep/100ms", "/sleep/1ms", "/sleep/50ms", "/sleep/0s"}
+	for _, path := range paths {
+		conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	}
+	reader := bufio.NewReader(conn)
+	for _, path := range paths {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		if string(data) != path {
+			t.Fatalf("invalid response order: %s, expected %s", data, path)
+		}
+	}
+}
+
+func TestServerPipelinedParseError(t *testing.T) {
+	svr := NewServer(Config{
+		Addrs:    []string{"127.0.0.1:0"},
+		NPoller:  1,
+		Executor: GoExecutor,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(request.URL.Path))
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /2 HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /3 HTTP/1.1\r\nHost: localhost\r\nBad Header\r\n\r\n" +
+		"GET /4 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"200 /1", "200 /2", "400 "} {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if got := fmt.Sprintf("%d %s", res.StatusCode, body); got != expected {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("connection not closed after the error: %v", err)
+	}
+}
+
+func TestServerPipelineDepth(t *testing.T) {
+	const depth = 4
+	var mux sync.Mutex
+	running, maxRunning := 0, 0
+	svr := NewServer(Config{
+		Addrs:            []string{"127.0.0.1:0"},
+		NPoller:          1,
+		Executor:         GoExecutor,
+		MaxPipelineDepth: depth,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			mux.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mux.Unlock()
+			time.Sleep(time.Millisecond)
+			mux.Lock()
+			running--
+			mux.Unlock()
+			w.Write([]byte(request.URL.Path))
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// all the requests are read at once
+	var data []byte
+	for i := 0; i < 100; i++ {
+		data = append(data, fmt.Sprintf("GET /%d HTTP/1.1\r\nHost: localhost\r\n\r\n", i)...)
+	}
+	conn.Write(data)
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 100; i++ {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != fmt.Sprintf("/%d", i) {
+			t.Fatalf("invalid response order: %s, expected /%d", body, i)
+		}
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if maxRunning > depth {
+		t.Fatalf("%v handlers ran at the same time, expected at most %v", maxRunning, depth)
+	}
+}
+
+func TestServerWorkerPoolOverload(t *testing.T) {
+	pool := NewWorkerPool(1, 0)
+	defer pool.Stop()
+
+	release := make(chan struct{})
+	svr, addr := newTestServerWithExecutor(t, pool.Exec, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		<-release
+	}))
+	defer svr.Stop()
+
+	done := make(chan int, 1)
+	go func() {
+		res, err := http.Get(addr)
+		if err != nil {
+			t.Error(err)
+			done <- 0
+			return
+		}
+		res.Body.Close()
+		done <- res.StatusCode
+	}()
+	time.Sleep(time.Second / 10)
+
+	res, err := http.Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("invalid status code: %v", res.StatusCode)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("invalid status code: %v", code)
+	}
+}
+
+func TestServerHandlerPanic(t *testing.T) {
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, request *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("X-Partial", "1")
+		w.Write([]byte("partial"))
+		panic(http.ErrAbortHandler)
+	})
+	mux.HandleFunc("/flushed", func(w http.ResponseWriter, request *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+	pool := NewWorkerPool(4, 16)
+	defer pool.Stop()
+
+	for _, executor := range []Executor{nil, GoExecutor, pool.Exec} {
+		svr, addr := newTestServerWithExecutor(t, executor, mux)
+
+		conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		reader := bufio.NewReader(conn)
+		for _, code := range []int{http.StatusOK, http.StatusInternalServerError} {
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(res.Body)
+			if res.StatusCode != code || (code == http.StatusOK) != (string(data) == "ok") || res.Header.Get("X-Partial") != "" {
+				t.Fatalf("invalid response: %v %q %v", res.StatusCode, data, res.Header)
+			}
+			if code == http.StatusInternalServerError && !res.Close {
+				t.Fatal("connection not closed after a panic")
+			}
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+		conn.Close()
+
+		// the response can't look complete once its header has been written
+		res, err := http.Get(addr + "/flushed")
+		if err == nil {
+			_, err = io.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		if err == nil {
+			t.Fatal("truncated response read without error")
+		}
+		svr.Stop()
+	}
+}
+
+type echoUpgrader struct{}
+
+func (echoUpgrader) Read(p *Parser, data []byte) error {
+	_, err := p.Conn().Write(data)
+	return err
+}
+
+func TestServerHijack(t *testing.T) {
+	for _, executor := range []Executor{nil, GoExecutor} {
+		svr, _ := newTestServerWithExecutor(t, executor, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err = w.Write([]byte("x")); err != http.ErrHijacked {
+				t.Errorf("invalid write error: %v", err)
+			}
+			go func() {
+				defer conn.Close()
+				rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+				rw.Flush()
+				for {
+					line, err := rw.ReadString('\n')
+					if err != nil {
+						return
+					}
+					rw.WriteString(line)
+					rw.Flush()
+				}
+			}()
+		}))
+
+		conn, err := net.Dial("tcp", svr.Addr()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello\n"))
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("invalid status code: %v", res.StatusCode)
+		}
+		for _, s := range []string{"hello\n", "world\n"} {
+			if s != "hello\n" {
+				conn.Write([]byte(s))
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != s {
+				t.Fatalf("invalid echo: %q, expected %q", line, s)
+			}
+		}
+		conn.Close()
+		svr.Stop()
+	}
+}
+
+func TestServerUpgrade(t *testing.T) {
+	for _, executor := range []Executor{nil, GoExecutor} {
+		svr, _ := newTestServerWithExecutor(t, executor, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			if request.Method != http.MethodConnect {
+				// declined upgrade, the connection stays HTTP
+				w.Write([]byte(request.URL.Path))
+				return
+			}
+			if request.Host != "example.com:443" {
+				t.Errorf("invalid host: %v", request.Host)
+			}
+			w.WriteHeader(http.StatusOK)
+			if err := w.(*Response).Upgrade(echoUpgrader{}); err != nil {
+				t.Error(err)
+			}
+		}))
+
+		conn, err := net.Dial("tcp", svr.Addr()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET /declined HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n" +
+			"GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nping"))
+		reader := bufio.NewReader(conn)
+		for _, path := range []string{"/declined", "/next"} {
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(res.Body)
+			if string(data) != path {
+				t.Fatalf("invalid body: %s, expected %s", data, path)
+			}
+		}
+		res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || res.ContentLength > 0 {
+			t.Fatalf("invalid response: %v %v", res.StatusCode, res.ContentLength)
+		}
+		conn.Write([]byte("pong"))
+		buf := make([]byte, 8)
+		if _, err = io.ReadFull(reader, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "pingpong" {
+			t.Fatalf("invalid tunnel data: %q", buf)
+		}
+		conn.Close()
+		svr.Stop()
+	}
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	svr := NewServer(Config{
+		Addrs:                []string{"127.0.0.1:0"},
+		NPoller:              1,
+		MaxKeepAliveRequests: 2,
+		StreamingBody:        true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/close" {
+				w.Header().Set("Connection", "close")
+			}
+			w.Write([]byte(request.URL.Path))
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	cases := []struct {
+		requests string
+		paths    []string
+		header   string // Connection and Keep-Alive headers of the responses
+	}{
+		// the requests after a Connection: close one are not served
+		{"GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\nGET /b HTTP/1.1\r\nHost: localhost\r\n\r\n", []string{"/a"}, "close "},
+		{"GET /a HTTP/1.0\r\n\r\nGET /b HTTP/1.0\r\n\r\n", []string{"/a"}, "close "},
+		{"GET /a HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /b HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET /c HTTP/1.0\r\nConnection: keep-alive\r\n\r\n",
+			[]string{"/a", "/b"}, "keep-alive max=1,close "},
+		{"GET /a HTTP/1.1\r\nHost: localhost\r\n\r\nGET /b HTTP/1.1\r\nHost: localhost\r\n\r\nGET /c HTTP/1.1\r\nHost: localhost\r\n\r\n", []string{"/a", "/b"}, " ,close "},
+		{"GET /close HTTP/1.1\r\nHost: localhost\r\n\r\n", []string{"/close"}, "close "},
+		// the body that the handler didn't read
+		{"POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nhello", []string{"/a"}, "close "},
+	}
+	for _, v := range cases {
+		conn, err := net.Dial("tcp", svr.Addr()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(v.requests))
+		reader := bufio.NewReader(conn)
+		var headers []string
+		for _, path := range v.paths {
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("%q: %v", v.requests, err)
+			}
+			data, _ := io.ReadAll(res.Body)
+			if string(data) != path {
+				t.Fatalf("%q: invalid body %q, expected %q", v.requests, data, path)
+			}
+			connection := res.Header.Get("Connection")
+			if res.Close {
+				// removed by http.ReadResponse
+				connection = "close"
+			}
+			headers = append(headers, connection+" "+res.Header.Get("Keep-Alive"))
+		}
+		if header := strings.Join(headers, ","); header != v.header {
+			t.Fatalf("%q: invalid headers %q, expected %q", v.requests, header, v.header)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := reader.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%q: connection not closed: %v %v", v.requests, n, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerExpectContinue(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		svr := NewServer(Config{
+			Addrs:         []string{"127.0.0.1:0"},
+			NPoller:       1,
+			StreamingBody: streaming,
+			ExpectContinue: func(request *http.Request) int {
+				if request.ContentLength > 10 {
+					return http.StatusRequestEntityTooLarge
+				}
+				return http.StatusContinue
+			},
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+				io.Copy(w, request.Body)
+			}),
+		})
+		if err := svr.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			request  string
+			body     string // sent after the 100 Continue response
+			statuses []int
+		}{
+			{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", "hello", []int{100, 200}},
+			{"POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nExpect: 100-Continue\r\n\r\n", "5\r\nhello\r\n0\r\n\r\n", []int{100, 200}},
+			// rejected by the hook
+			{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\nExpect: 100-continue\r\n\r\n", "", []int{413}},
+			{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: something\r\n\r\n", "", []int{417}},
+			// nothing to continue
+			{"GET / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\n\r\n", "", []int{200}},
+			{"POST / HTTP/1.0\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\nhello", "", []int{200}},
+		}
+		for _, v := range cases {
+			conn, err := net.Dial("tcp", svr.Addr()[0].String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write([]byte(v.request))
+			reader := bufio.NewReader(conn)
+			for _, status := range v.statuses {
+				res, err := http.ReadResponse(reader, nil)
+				if err != nil {
+					t.Fatalf("%q: %v", v.request, err)
+				}
+				if res.StatusCode != status {
+					t.Fatalf("%q: invalid status %v, expected %v", v.request, res.StatusCode, status)
+				}
+				if status == http.StatusContinue {
+					conn.Write([]byte(v.body))
+					continue
+				}
+				data, _ := io.ReadAll(res.Body)
+				if status == http.StatusOK && len(data) == 0 && v.request[0] == 'P' {
+					t.Fatalf("%q: empty body", v.request)
+				}
+				if status != http.StatusOK && !res.Close {
+					t.Fatalf("%q: the connection is not closed", v.request)
+				}
+			}
+			conn.Close()
+		}
+		svr.Stop()
+	}
+}
+
+func TestServerEarlyHints(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	})
+	for _, http2 := range []bool{false, true} {
+		conf := Config{
+			Addrs:   []string{"127.0.0.1:0"},
+			NPoller: 1,
+			Handler: handler,
+		}
+		transport := &http.Transport{}
+		if http2 {
+			conf.HTTP2 = &HTTP2Config{}
+			transport.Protocols = new(http.Protocols)
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+		svr := NewServer(conf)
+		if err := svr.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		var hints []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				hints = append(hints, fmt.Sprintf("%v %v", code, header.Get("Link")))
+				return nil
+			},
+		}
+		request, _ := http.NewRequest("GET", "http://"+svr.Addr()[0].String(), nil)
+		request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+		res, err := (&http.Client{Transport: transport}).Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(data) != "hello" || res.Header.Get("Link") == "" {
+			t.Fatalf("invalid response: %q %v", data, res.Header)
+		}
+		if len(hints) != 1 || hints[0] != "103 </style.css>; rel=preload; as=style" {
+			t.Fatalf("invalid early hints: %q", hints)
+		}
+		transport.CloseIdleConnections()
+		svr.Stop()
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	svr := NewServer(Config{
+		Addrs:    []string{"127.0.0.1:0"},
+		NPoller:  1,
+		Executor: GoExecutor,
+		Timeouts: Timeouts{
+			ReadHeaderTimeout: 100 * time.Millisecond,
+			ReadTimeout:       200 * time.Millisecond,
+			WriteTimeout:      100 * time.Millisecond,
+			IdleTimeout:       100 * time.Millisecond,
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/slow" {
+				time.Sleep(300 * time.Millisecond)
+			}
+			w.Write([]byte(request.URL.Path))
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	cases := []struct {
+		requests string
+		response string // prefix of what's read before the connection is closed
+	}{
+		{"", ""},
+		{"GET / HTTP/1.1\r\nHost", "HTTP/1.1 408 "},
+		{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nhello", "HTTP/1.1 408 "},
+		{"GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n", ""},
+		// closed when idle after the response
+		{"GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n", "HTTP/1.1 200 "},
+	}
+	for _, v := range cases {
+		conn, err := net.Dial("tcp", svr.Addr()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		begin := time.Now()
+		conn.Write([]byte(v.requests))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("%q: connection not closed: %v", v.requests, err)
+		}
+		if !strings.HasPrefix(string(data), v.response) || (v.response == "" && len(data) > 0) {
+			t.Fatalf("%q: invalid response %q", v.requests, data)
+		}
+		// the timeouts start when the connection is accepted or read
+		if used := time.Since(begin); used < 50*time.Millisecond {
+			t.Fatalf("%q: closed too early: %v", v.requests, used)
+		}
+		conn.Close()
+	}
+
+	// requests reset the idle timeout
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(res.Body)
+	}
+}
+
+func newTestCertificate(t *testing.T, host string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServerTLS(t *testing.T) {
+	certs := map[string]tls.Certificate{
+		"a.example.com": newTestCertificate(t, "a.example.com"),
+		"b.example.com": newTestCertificate(t, "b.example.com"),
+	}
+	svr := NewServer(Config{
+		Addrs:   []string{"127.0.0.1:0"},
+		NPoller: 1,
+		TLSConfig: &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cert := certs[hello.ServerName]
+				return &cert, nil
+			},
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			if request.TLS == nil || request.TLS.NegotiatedProtocol != "http/1.1" {
+				t.Errorf("invalid TLS state: %+v", request.TLS)
+				return
+			}
+			w.Write([]byte(request.TLS.ServerName + ":"))
+			io.Copy(w, request.Body)
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+	addr := svr.Addr()[0].String()
+
+	for host := range certs {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: host, InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}},
+		}}
+		for _, size := range []int{0, 100, 1024 * 1024} {
+			body := strings.Repeat("x", size)
+			res, err := client.Post("https://"+addr, "text/plain", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if string(data) != host+":"+body {
+				t.Fatalf("invalid body: %v bytes", len(data))
+			}
+			if cn := res.TLS.PeerCertificates[0].Subject.CommonName; cn != host {
+				t.Fatalf("invalid certificate: %v", cn)
+			}
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+// heldConn keeps the data written while hold is set until flush.
+type heldConn struct {
+	net.Conn
+	hold bool
+	buf  []byte
+}
+
+func (c *heldConn) Write(b []byte) (int, error) {
+	if c.hold {
+		c.buf = append(c.buf, b...)
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *heldConn) flush() error {
+	c.hold = false
+	_, err := c.Conn.Write(c.buf)
+	c.buf = nil
+	return err
+}
+
+func TestServerTLSTimeouts(t *testing.T) {
+	cert := newTestCertificate(t, "localhost")
+	svr := NewServer(Config{
+		Addrs:     []string{"127.0.0.1:0"},
+		NPoller:   1,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Timeouts: Timeouts{
+			ReadTimeout: 200 * time.Millisecond,
+			IdleTimeout: 100 * time.Millisecond,
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			w.Write([]byte(request.URL.Path))
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+
+	for i := 0; i < 10; i++ {
+		raw, err := net.Dial("tcp", svr.Addr()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the request is sent with the end of the handshake, so that it's
+		// parsed by the handshake's goroutine
+		held := &heldConn{Conn: raw}
+		conn := tls.Client(held, &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(tls.ConnectionState) error {
+				held.hold = true
+				return nil
+			},
+		})
+		if err = conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET /tls HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err = held.flush(); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != "/tls" {
+			t.Fatalf("invalid body: %q", body)
+		}
+		// closed when idle after the response
+		if _, err = reader.ReadByte(); err != io.EOF {
+			t.Fatalf("connection not closed: %v", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerTLSHandshakeLimit(t *testing.T) {
+	cert := newTestCertificate(t, "localhost")
+	svr := NewServer(Config{
+		Addrs:               []string{"127.0.0.1:0"},
+		NPoller:             1,
+		TLSConfig:           &tls.Config{Certificates: []tls.Certificate{cert}},
+		MaxTLSHandshakes:    1,
+		TLSHandshakeTimeout: 2 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	})
+	if err := svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer svr.Stop()
+	addr := svr.Addr()[0].String()
+
+	// the handshakes waiting for partial records don't hold the only slot
+	var stalled []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{0x16, 0x03, 0x01})
+		stalled = append(stalled, conn)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake blocked by the stalled ones: %v", err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	conn.Close()
+
+	// the stalled handshakes time out, whatever the Timeouts
+	for _, conn := range stalled {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("stalled handshake not closed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package nbhttp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSSEHeartbeat .
+	DefaultSSEHeartbeat = 15 * time.Second
+
+	// DefaultSSEMaxBufferedSize .
+	DefaultSSEMaxBufferedSize = 1024 * 1024
+)
+
+var sseNewlineReplacer = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// SSEEvent is an event of a text/event-stream, the empty fields are not
+// sent.
+type SSEEvent struct {
+	ID    string
+	Event string
+	Retry time.Duration
+	Data  []byte
+}
+
+// appendSSEEvent formats e, each line of the data is sent as a data field.
+func appendSSEEvent(buf []byte, e *SSEEvent) []byte {
+	if e.ID != "" {
+		buf = appendSSEField(buf, "id", e.ID)
+	}
+	if e.Event != "" {
+		buf = appendSSEField(buf, "event", e.Event)
+	}
+	if e.Retry > 0 {
+		buf = append(buf, "retry: "...)
+		buf = strconv.AppendInt(buf, int64(e.Retry/time.Millisecond), 10)
+		buf = append(buf, '\n')
+	}
+	if e.Data != nil {
+		for _, line := range strings.Split(sseNewlineReplacer.Replace(string(e.Data)), "\n") {
+			buf = append(buf, "data: "...)
+			buf = append(buf, line...)
+			buf = append(buf, '\n')
+		}
+	}
+	return append(buf, '\n')
+}
+
+// appendSSEField appends a field that can't span lines.
+func appendSSEField(buf []byte, name, value string) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, ": "...)
+	buf = append(buf, headerNewlineToSpace.Replace(value)...)
+	return append(buf, '\n')
+}
+
+func appendSSEComment(buf []byte, comment string) []byte {
+	for _, line := range strings.Split(sseNewlineReplacer.Replace(comment), "\n") {
+		buf = append(buf, ": "...)
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	return append(buf, '\n')
+}
+
+// SSEWriter streams server-sent events on a Response. The response stays
+// open after the handler returns, until Close is called or the connection
+// is closed, so that events can be sent from any goroutine without keeping
+// one per client.
+type SSEWriter struct {
+	mux       sync.Mutex
+	response  *Response
+	lastID    string
+	heartbeat time.Duration
+	timer     *time.Timer
+	closed    bool
+	done      chan struct{}
+
+	hubs []*SSEHub
+}
+
+// NewSSEWriter writes the header of an event stream and returns its writer,
+// w must be the Response passed to the handler. A comment is sent after
+// heartbeat without events to keep the connection alive through proxies,
+// DefaultSSEHeartbeat is used if 0, none if negative.
+func NewSSEWriter(w http.ResponseWriter, r *http.Request, heartbeat time.Duration) (*SSEWriter, error) {
+	response, ok := w.(*Response)
+	if !ok || response.hijacked || response.wroteHeader {
+		return nil, ErrSSENotSupported
+	}
+	if heartbeat == 0 {
+		heartbeat = DefaultSSEHeartbeat
+	}
+
+	header := response.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	header.Del("Content-Length")
+	response.WriteHeader(http.StatusOK)
+	response.detached = true
+
+	sw := &SSEWriter{
+		response:  response,
+		heartbeat: heartbeat,
+		done:      make(chan struct{}),
+	}
+	if r != nil {
+		sw.lastID = r.Header.Get("Last-Event-ID")
+	}
+	if !response.processor.responses.onClose(sw.onClose) {
+		sw.onClose()
+		return nil, ErrSSEClosed
+	}
+
+	sw.mux.Lock()
+	defer sw.mux.Unlock()
+	response.flush()
+	if heartbeat > 0 && !sw.closed {
+		sw.timer = time.AfterFunc(heartbeat, sw.sendHeartbeat)
+	}
+	return sw, nil
+}
+
+// LastEventID returns the Last-Event-ID header sent by a reconnecting
+// client.
+func (sw *SSEWriter) LastEventID() string {
+	return sw.lastID
+}
+
+// Send sends an event.
+func (sw *SSEWriter) Send(e *SSEEvent) error {
+	return sw.write(appendSSEEvent(nil, e))
+}
+
+// Comment sends a comment, which is ignored by the clients.
+func (sw *SSEWriter) Comment(comment string) error {
+	return sw.write(appendSSEComment(nil, comment))
+}
+
+// Done returns a channel that's closed when the stream is closed.
+func (sw *SSEWriter) Done() <-chan struct{} {
+	return sw.done
+}
+
+// Close ends the stream, the connection stays open for the next requests.
+func (sw *SSEWriter) Close() error {
+	sw.mux.Lock()
+	if sw.closed {
+		sw.mux.Unlock()
+		return nil
+	}
+	hubs := sw.closeLocked()
+	err := sw.response.complete()
+	sw.mux.Unlock()
+
+	sw.leave(hubs)
+	return err
+}
+
+// write sends formatted data, the stream is closed if it fails.
+func (sw *SSEWriter) write(data []byte) error {
+	sw.mux.Lock()
+	if sw.closed {
+		sw.mux.Unlock()
+		return ErrSSEClosed
+	}
+	sw.response.body = append(sw.response.body, data...)
+	if err := sw.response.flush(); err != nil {
+		sw.mux.Unlock()
+		sw.abort()
+		return err
+	}
+	if sw.timer != nil {
+		sw.timer.Reset(sw.heartbeat)
+	}
+	sw.mux.Unlock()
+	return nil
+}
+
+// abort closes the stream and its connection.
+func (sw *SSEWriter) abort() {
+	sw.mux.Lock()
+	if sw.closed {
+		sw.mux.Unlock()
+		return
+	}
+	hubs := sw.closeLocked()
+	sw.mux.Unlock()
+	sw.leave(hubs)
+	if conn := sw.response.processor.conn; conn != nil {
+		conn.Close()
+	}
+}
+
+// buffered returns the size of the data written to the connection that the
+// client hasn't received yet.
+func (sw *SSEWriter) buffered() int {
+	if bw, ok := sw.response.processor.conn.(bufferedWriter); ok {
+		return bw.bufferedWrites()
+	}
+	return 0
+}
+
+func (sw *SSEWriter) sendHeartbeat() {
+	sw.write(appendSSEComment(nil, "heartbeat"))
+}
+
+// onClose is called when the connection is closed.
+func (sw *SSEWriter) onClose() {
+	sw.mux.Lock()
+	if sw.closed {
+		sw.mux.Unlock()
+		return
+	}
+	hubs := sw.closeLocked()
+	sw.mux.Unlock()
+	sw.leave(hubs)
+}
+
+func (sw *SSEWriter) closeLocked() []*SSEHub {
+	sw.closed = true
+	if sw.timer != nil {
+		sw.timer.Stop()
+	}
+	close(sw.done)
+	hubs := sw.hubs
+	sw.hubs = nil
+	return hubs
+}
+
+func (sw *SSEWriter) leave(hubs []*SSEHub) {
+	for _, h := range hubs {
+		h.Unsubscribe(sw)
+	}
+}
+
+// SSEHub broadcasts events to the subscribed SSEWriters, which are
+// unsubscribed when they are closed.
+type SSEHub struct {
+	mux         sync.RWMutex
+	subscribers map[*SSEWriter]struct{}
+	maxBuffered int
+}
+
+// NewSSEHub .
+func NewSSEHub() *SSEHub {
+	return &SSEHub{
+		subscribers: map[*SSEWriter]struct{}{},
+		maxBuffered: DefaultSSEMaxBufferedSize,
+	}
+}
+
+// SetMaxBufferedSize sets the size of the events a subscriber can have
+// buffered, waiting to be written to its connection because it doesn't read
+// them fast enough. The connection of a subscriber above it is closed by the
+// next Broadcast. DefaultSSEMaxBufferedSize is used if 0, none if negative.
+func (h *SSEHub) SetMaxBufferedSize(size int) {
+	if size == 0 {
+		size = DefaultSSEMaxBufferedSize
+	}
+	h.mux.Lock()
+	h.maxBuffered = size
+	h.mux.Unlock()
+}
+
+// Subscribe adds sw to the hub, it returns false if sw is closed.
+func (h *SSEHub) Subscribe(sw *SSEWriter) bool {
+	sw.mux.Lock()
+	defer sw.mux.Unlock()
+	if sw.closed {
+		return false
+	}
+	h.mux.Lock()
+	if _, ok := h.subscribers[sw]; !ok {
+		h.subscribers[sw] = struct{}{}
+		sw.hubs = append(sw.hubs, h)
+	}
+	h.mux.Unlock()
+	return true
+}
+
+// Unsubscribe .
+func (h *SSEHub) Unsubscribe(sw *SSEWriter) {
+	h.mux.Lock()
+	delete(h.subscribers, sw)
+	h.mux.Unlock()
+}
+
+// Len returns the number of subscribers.
+func (h *SSEHub) Len() int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return len(h.subscribers)
+}
+
+// Broadcast sends e to all the subscribers, it's formatted once. It returns
+// the number of subscribers the event was sent to, the slow subscribers are
+// closed instead, see SetMaxBufferedSize.
+func (h *SSEHub) Broadcast(e *SSEEvent) int {
+	data := appendSSEEvent(nil, e)
+
+	h.mux.RLock()
+	subscribers := make([]*SSEWriter, 0, len(h.subscribers))
+	for sw := range h.subscribers {
+		subscribers = append(subscribers, sw)
+	}
+	maxBuffered := h.maxBuffered
+	h.mux.RUnlock()
+
+	n := 0
+	for _, sw := range subscribers {
+		if maxBuffered > 0 && sw.buffered() > maxBuffered {
+			sw.abort()
+			continue
+		}
+		if sw.write(data) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Close closes the streams of all the subscribers.
+func (h *SSEHub) Close() {
+	h.mux.Lock()
+	subscribers := h.subscribers
+	h.subscribers = map[*SSEWriter]struct{}{}
+	h.mux.Unlock()
+
+	for sw := range subscribers {
+		sw.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package nbhttp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSEEvent(t *testing.T) {
+	data := appendSSEEvent(nil, &SSEEvent{
+		ID:    "1\n2",
+		Event: "update",
+		Retry: 3 * time.Second,
+		Data:  []byte("a\r\nb\rc\n"),
+	})
+	expected := "id: 1 2\nevent: update\nretry: 3000\ndata: a\ndata: b\ndata: c\ndata: \n\n"
+	if string(data) != expected {
+		t.Fatalf("invalid event: %q, expected %q", data, expected)
+	}
+	if data = appendSSEComment(nil, "x\ny"); string(data) != ": x\n: y\n\n" {
+		t.Fatalf("invalid comment: %q", data)
+	}
+}
+
+func TestSSEHub(t *testing.T) {
+	hub := NewSSEHub()
+	svr, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		sw, err := NewSSEWriter(w, request, 50*time.Millisecond)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hub.Subscribe(sw)
+	}))
+	defer svr.Stop()
+
+	const n = 10
+	var readers []*bufio.Reader
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", svr.Addr()[0].String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("invalid header: %v", res.Header)
+		}
+		readers = append(readers, bufio.NewReader(res.Body))
+	}
+	if hub.Len() != n {
+		t.Fatalf("invalid subscribers: %v", hub.Len())
+	}
+
+	// the heartbeat comes first when idle
+	time.Sleep(100 * time.Millisecond)
+	if sent := hub.Broadcast(&SSEEvent{Event: "tick", Data: []byte("hello")}); sent != n {
+		t.Fatalf("event sent to %v subscribers", sent)
+	}
+	for _, r := range readers {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, ":") || line == "\n" {
+				continue
+			}
+			lines = append(lines, line)
+			if line == "data: hello\n" {
+				break
+			}
+		}
+		if strings.Join(lines, "") != "event: tick\ndata: hello\n" {
+			t.Fatalf("invalid event: %q", lines)
+		}
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for i := 0; i < 100 && hub.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hub.Len() != 0 {
+		t.Fatalf("closed connections still subscribed: %v", hub.Len())
+	}
+}
+
+func TestSSEHubSlowSubscriber(t *testing.T) {
+	hub := NewSSEHub()
+	hub.SetMaxBufferedSize(64 * 1024)
+	svr, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		sw, err := NewSSEWriter(w, request, -1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hub.Subscribe(sw)
+	}))
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Addr()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	for i := 0; i < 100 && hub.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the client doesn't read the events
+	e := &SSEEvent{Data: []byte(strings.Repeat("x", 64*1024))}
+	for i := 0; i < 10000 && hub.Len() > 0; i++ {
+		hub.Broadcast(e)
+	}
+	if hub.Len() != 0 {
+		t.Fatal("slow subscriber not dropped")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("slow subscriber not closed: %v", err)
+	}
+}
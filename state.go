@@ -29,6 +29,9 @@ const (
 	// state: Body ContentLength
 	stateBodyContentLength
 
+	// state: Body delimited by the end of the connection
+	stateBodyUntilClose
+
 	// state: Body Chunk
 	stateHeaderOverLF
 	stateBodyChunkSizeBlankLine
@@ -49,4 +52,16 @@ const (
 	// state: Body CRLF
 	stateTailCR
 	stateTailLF
+
+	// state: the pipeline is full, the data read is parsed once responses
+	// have been written
+	statePipelineFull
+
+	// state: after a CONNECT or Upgrade request
+	stateUpgradePending
+	stateUpgraded
+	stateHijacked
+
+	// state: the connection is closed after the response to the last request
+	stateClosing
 )
@@ -1,19 +1,6 @@
 package nbhttp
 
-import "strings"
-
 var (
-	validMethods = map[string]bool{
-		"OPTIONS": true,
-		"GET":     true,
-		"HEAD":    true,
-		"POST":    true,
-		"PUT":     true,
-		"DELETE":  true,
-		"TRACE":   true,
-		"CONNECT": true,
-	}
-
 	tokenCharMap = [256]bool{
 		'!':  true,
 		'#':  true,
@@ -100,20 +87,11 @@ var (
 	hexCharMap      = [256]bool{}
 	alphaCharMap    = [256]bool{}
 	alphaNumCharMap = [256]bool{}
-
-	validMethodCharMap = [256]bool{}
 )
 
 func init() {
 	var dis byte = 'a' - 'A'
 
-	for m := range validMethods {
-		for _, c := range m {
-			validMethodCharMap[c] = true
-			validMethodCharMap[byte(c)+dis] = true
-		}
-	}
-
 	for i := byte(0); i < 10; i++ {
 		numCharMap['0'+i] = true
 		alphaNumCharMap['0'+i] = true
@@ -156,11 +134,3 @@ func isAlphaNum(c byte) bool {
 func isToken(c byte) bool {
 	return tokenCharMap[c]
 }
-
-func isValidMethod(m string) bool {
-	return validMethods[strings.ToUpper(m)]
-}
-
-func isValidMethodChar(c byte) bool {
-	return validMethodCharMap[c]
-}
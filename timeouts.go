@@ -0,0 +1,334 @@
+package nbhttp
+
+import (
+	"container/heap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// phases of a server connection, see Parser.phase.
+const (
+	phaseIdle   = iota // waiting for a request
+	phaseHeader        // reading the header of a request
+	phaseBody          // reading the body of a request
+	phaseNone          // not reading requests
+)
+
+var requestTimeoutResponse = []byte("HTTP/1.1 408 Request Timeout\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+// Timeouts are the time limits of the connections of a Server, no limit
+// applies if they are 0.
+type Timeouts struct {
+	// ReadHeaderTimeout is the time allowed to read the header of a request,
+	// from its first byte, or from the accept for the first request.
+	// ReadTimeout is used if 0.
+	ReadHeaderTimeout time.Duration
+
+	// ReadTimeout is the time allowed to read a whole request.
+	ReadTimeout time.Duration
+
+	// WriteTimeout is the time allowed for a response to be written since
+	// its request was read or since the last write to the connection, so a
+	// streaming response must write at least once per WriteTimeout.
+	WriteTimeout time.Duration
+
+	// IdleTimeout is the time a connection waits for the next request.
+	// ReadTimeout is used if 0.
+	IdleTimeout time.Duration
+}
+
+func (t Timeouts) enabled() bool {
+	return t.ReadHeaderTimeout > 0 || t.ReadTimeout > 0 || t.WriteTimeout > 0 || t.IdleTimeout > 0
+}
+
+// min returns the shortest timeout.
+func (t Timeouts) min() time.Duration {
+	var min time.Duration
+	for _, d := range []time.Duration{t.ReadHeaderTimeout, t.ReadTimeout, t.WriteTimeout, t.IdleTimeout} {
+		if d > 0 && (min == 0 || d < min) {
+			min = d
+		}
+	}
+	return min
+}
+
+// bufferedWriter is implemented by the connections that buffer the data that
+// can't be written yet.
+type bufferedWriter interface {
+	bufferedWrites() int
+}
+
+// connTimer tracks the deadline of a server connection. The deadline is
+// computed when the connection is read and when it expires, so that reads
+// and writes don't update the timer heap unless it gets earlier.
+type connTimer struct {
+	timers    *connTimers
+	conn      net.Conn
+	processor *ServerProcessor
+
+	mux       sync.Mutex
+	phase     int
+	requests  int       // number of requests read, to detect a new request
+	readStart time.Time // time the current request started to be read
+
+	index   int       // in the heap, -1 if not scheduled
+	when    time.Time // deadline while scheduled
+	removed bool      // the connection is closed
+}
+
+// onRead records the phase of the connection after data read at now has
+// been parsed.
+func (ct *connTimer) onRead(now time.Time, phase int) {
+	ct.mux.Lock()
+	requests := int(atomic.LoadInt32(&ct.processor.nRequests))
+	switch phase {
+	case phaseHeader, phaseBody:
+		if ct.phase == phaseIdle || ct.requests != requests {
+			ct.readStart = now
+		}
+	case phaseIdle:
+		if requests > 0 {
+			ct.readStart = time.Time{}
+		}
+	default:
+		ct.readStart = time.Time{}
+	}
+	ct.phase = phase
+	ct.requests = requests
+	deadline, _, _ := ct.deadline(now)
+	ct.mux.Unlock()
+
+	if !deadline.IsZero() {
+		ct.timers.schedule(ct, deadline, false)
+	}
+}
+
+// deadline returns the time the connection expires, or has to be checked
+// again if expires is false, and whether it's reading a request. It's zero
+// for the connections that no longer have timeouts.
+func (ct *connTimer) deadline(now time.Time) (deadline time.Time, expires bool, reading bool) {
+	t := &ct.timers.timeouts
+	earliest := func(start time.Time, d time.Duration) {
+		if d > 0 && !start.IsZero() {
+			if dl := start.Add(d); deadline.IsZero() || dl.Before(deadline) {
+				deadline = dl
+			}
+		}
+	}
+
+	busy, since := ct.processor.responses.activity()
+	if !busy {
+		if bw, ok := ct.processor.conn.(bufferedWriter); ok && bw.bufferedWrites() > 0 {
+			busy = true
+		}
+	}
+	if busy {
+		earliest(since, t.WriteTimeout)
+	}
+
+	switch ct.phase {
+	case phaseHeader:
+		reading = true
+		headerTimeout := t.ReadHeaderTimeout
+		if headerTimeout == 0 {
+			headerTimeout = t.ReadTimeout
+		}
+		earliest(ct.readStart, headerTimeout)
+		earliest(ct.readStart, t.ReadTimeout)
+	case phaseBody:
+		reading = true
+		earliest(ct.readStart, t.ReadTimeout)
+	case phaseIdle:
+		if busy {
+			break
+		}
+		if ct.requests == 0 {
+			// the first request is expected right after the accept
+			headerTimeout := t.ReadHeaderTimeout
+			if headerTimeout == 0 {
+				headerTimeout = t.ReadTimeout
+			}
+			earliest(ct.readStart, headerTimeout)
+			break
+		}
+		idleTimeout := t.IdleTimeout
+		if idleTimeout == 0 {
+			idleTimeout = t.ReadTimeout
+		}
+		earliest(since, idleTimeout)
+	}
+	if deadline.IsZero() && busy {
+		// the responses have no timeout, the connection may have one after
+		return now.Add(t.min()), false, false
+	}
+	return deadline, true, reading && !busy
+}
+
+// expire is called when the scheduled deadline has passed, the connection
+// is closed unless it has been extended.
+func (ct *connTimer) expire(now time.Time) {
+	ct.mux.Lock()
+	deadline, expires, reading := ct.deadline(now)
+	ct.mux.Unlock()
+
+	if deadline.IsZero() {
+		// upgraded connections have no timeouts
+		return
+	}
+	if deadline.After(now) || !expires {
+		ct.timers.schedule(ct, deadline, true)
+		return
+	}
+	if reading {
+		ct.conn.Write(requestTimeoutResponse)
+	}
+	ct.conn.Close()
+}
+
+// connTimers runs the timers of the connections of a Server on a single
+// goroutine, with a heap of their deadlines.
+type connTimers struct {
+	timeouts Timeouts
+
+	mux     sync.Mutex
+	items   timerHeap
+	wakeup  chan struct{}
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newConnTimers(timeouts Timeouts) *connTimers {
+	ts := &connTimers{
+		timeouts: timeouts,
+		wakeup:   make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+	}
+	ts.wg.Add(1)
+	go ts.run()
+	return ts
+}
+
+// add starts tracking a connection accepted at now.
+func (ts *connTimers) add(conn net.Conn, processor *ServerProcessor, now time.Time) *connTimer {
+	ct := &connTimer{
+		timers:    ts,
+		conn:      conn,
+		processor: processor,
+		readStart: now,
+		index:     -1,
+	}
+	ct.mux.Lock()
+	deadline, _, _ := ct.deadline(now)
+	ct.mux.Unlock()
+	if !deadline.IsZero() {
+		ts.schedule(ct, deadline, false)
+	}
+	return ct
+}
+
+// schedule sets the deadline of ct, it's only moved later if force is set.
+func (ts *connTimers) schedule(ct *connTimer, deadline time.Time, force bool) {
+	ts.mux.Lock()
+	if ct.removed {
+		ts.mux.Unlock()
+		return
+	}
+	if ct.index >= 0 {
+		if !force && !deadline.Before(ct.when) {
+			ts.mux.Unlock()
+			return
+		}
+		ct.when = deadline
+		heap.Fix(&ts.items, ct.index)
+	} else {
+		ct.when = deadline
+		heap.Push(&ts.items, ct)
+	}
+	first := ct.index == 0
+	ts.mux.Unlock()
+
+	if first {
+		select {
+		case ts.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (ts *connTimers) remove(ct *connTimer) {
+	ts.mux.Lock()
+	ct.removed = true
+	if ct.index >= 0 {
+		heap.Remove(&ts.items, ct.index)
+	}
+	ts.mux.Unlock()
+}
+
+func (ts *connTimers) run() {
+	defer ts.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now := time.Now()
+		ts.mux.Lock()
+		var expired *connTimer
+		wait := time.Hour
+		if len(ts.items) > 0 {
+			if first := ts.items[0]; !first.when.After(now) {
+				expired = heap.Pop(&ts.items).(*connTimer)
+			} else {
+				wait = first.when.Sub(now)
+			}
+		}
+		ts.mux.Unlock()
+
+		if expired != nil {
+			expired.expire(now)
+			continue
+		}
+
+		// a stale expiration after a wakeup only makes the heap be checked
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-ts.wakeup:
+		case <-ts.stopped:
+			return
+		}
+	}
+}
+
+func (ts *connTimers) stop() {
+	close(ts.stopped)
+	ts.wg.Wait()
+}
+
+// timerHeap implements heap.Interface, ordered by deadline.
+type timerHeap []*connTimer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	ct := x.(*connTimer)
+	ct.index = len(*h)
+	*h = append(*h, ct)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	ct := old[n-1]
+	old[n-1] = nil
+	ct.index = -1
+	*h = old[:n-1]
+	return ct
+}
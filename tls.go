@@ -0,0 +1,266 @@
+package nbhttp
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxTLSHandshakes .
+	DefaultMaxTLSHandshakes = 1024
+
+	// DefaultTLSHandshakeTimeout .
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+
+	tlsReadBufferSize = 16 * 1024
+)
+
+// errTLSWouldBlock is returned by tlsTransport.Read when all the data
+// delivered by the poller has been read, crypto/tls keeps the partial
+// records of the temporary errors.
+var errTLSWouldBlock net.Error = tlsWouldBlockError{}
+
+type tlsWouldBlockError struct{}
+
+func (tlsWouldBlockError) Error() string   { return "tls: no data available" }
+func (tlsWouldBlockError) Timeout() bool   { return false }
+func (tlsWouldBlockError) Temporary() bool { return true }
+
+var tlsReadBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, tlsReadBufferSize)
+		return &buf
+	},
+}
+
+// tlsTransport is the net.Conn of a tls.Conn, it reads the data delivered by
+// the poller and writes to the connection of the poller.
+//
+// crypto/tls can't resume a handshake that failed to read, so Read blocks
+// until the handshake is complete, which runs on its own goroutine. The
+// handshake gives its slot of the tlsHandshaker back while it waits for the
+// records of the client. Once it's complete Read doesn't block, the records
+// are decrypted as they are delivered.
+type tlsTransport struct {
+	net.Conn
+
+	handshaker  *tlsHandshaker
+	mux         sync.Mutex
+	cond        sync.Cond
+	buffer      []byte
+	handshaking bool
+	closed      bool
+}
+
+// Read .
+func (t *tlsTransport) Read(b []byte) (int, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for len(t.buffer) == 0 {
+		if t.closed {
+			return 0, io.EOF
+		}
+		if !t.handshaking {
+			return 0, errTLSWouldBlock
+		}
+		t.handshaker.release()
+		for len(t.buffer) == 0 && !t.closed {
+			t.cond.Wait()
+		}
+		t.mux.Unlock()
+		t.handshaker.acquire()
+		t.mux.Lock()
+	}
+	n := copy(b, t.buffer)
+	t.buffer = t.buffer[n:]
+	if len(t.buffer) == 0 {
+		t.buffer = nil
+	}
+	return n, nil
+}
+
+// Close .
+func (t *tlsTransport) Close() error {
+	t.onClose()
+	return t.Conn.Close()
+}
+
+func (t *tlsTransport) feed(data []byte) {
+	t.mux.Lock()
+	t.buffer = append(t.buffer, data...)
+	t.cond.Broadcast()
+	t.mux.Unlock()
+}
+
+func (t *tlsTransport) onClose() {
+	t.mux.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.mux.Unlock()
+}
+
+// TLSConn is the connection of a request received over TLS, the data written
+// to it is encrypted.
+type TLSConn struct {
+	*tls.Conn
+
+	transport  *tlsTransport
+	handshaker *tlsHandshaker
+	parser     *Parser
+	onError    func(err error)
+
+	// onHandshake is called once the handshake is complete, before the
+	// plaintext is parsed.
+	onHandshake func()
+
+	// readMux makes the plaintext be parsed in order, by the poller or by
+	// the handshake goroutine.
+	readMux   sync.Mutex
+	started   bool
+	handshook bool
+
+	// timer closes the connection if the handshake isn't complete in time.
+	timer *time.Timer
+}
+
+func newTLSConn(conn net.Conn, config *tls.Config, handshaker *tlsHandshaker) *TLSConn {
+	t := &tlsTransport{Conn: conn, handshaker: handshaker, handshaking: true}
+	t.cond.L = &t.mux
+	c := &TLSConn{
+		Conn:       tls.Server(t, config),
+		transport:  t,
+		handshaker: handshaker,
+	}
+	// the handshake blocks its goroutine until the client sends its records
+	c.timer = time.AfterFunc(handshaker.timeout, func() {
+		conn.Close()
+	})
+	return c
+}
+
+// onClose wakes up the handshake of the closed connection.
+func (c *TLSConn) onClose() {
+	c.timer.Stop()
+	c.transport.onClose()
+}
+
+// feed decrypts data read by the poller and passes the plaintext to the
+// parser, the handshake is started by the first call.
+func (c *TLSConn) feed(data []byte) {
+	c.transport.feed(data)
+
+	c.readMux.Lock()
+	if !c.handshook {
+		start := !c.started
+		c.started = true
+		c.readMux.Unlock()
+		if start {
+			go c.handshake()
+		}
+		return
+	}
+	c.readLocked()
+	c.readMux.Unlock()
+}
+
+func (c *TLSConn) handshake() {
+	c.handshaker.acquire()
+	err := c.Handshake()
+	c.handshaker.release()
+	c.timer.Stop()
+	c.transport.mux.Lock()
+	c.transport.handshaking = false
+	c.transport.mux.Unlock()
+	if err != nil {
+		c.Close()
+		return
+	}
+	if c.onHandshake != nil {
+		c.onHandshake()
+	}
+
+	// parse the data that followed the handshake
+	c.readMux.Lock()
+	c.handshook = true
+	c.readLocked()
+	c.readMux.Unlock()
+}
+
+// tlsHandshaker limits the TLS handshakes of a server computed at once. A
+// handshake holds a slot while it runs and releases it while it waits for
+// the records of the client, so that the stalled clients don't delay the
+// others. The connections whose handshake isn't complete after timeout are
+// closed.
+type tlsHandshaker struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newTLSHandshaker(max int, timeout time.Duration) *tlsHandshaker {
+	if max <= 0 {
+		max = DefaultMaxTLSHandshakes
+	}
+	if timeout <= 0 {
+		timeout = DefaultTLSHandshakeTimeout
+	}
+	return &tlsHandshaker{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// acquire waits for a slot, at most max handshakes run at once.
+func (h *tlsHandshaker) acquire() {
+	h.slots <- struct{}{}
+}
+
+func (h *tlsHandshaker) release() {
+	<-h.slots
+}
+
+// readLocked parses the records delivered so far.
+func (c *TLSConn) readLocked() {
+	buf := tlsReadBufferPool.Get().(*[]byte)
+	defer tlsReadBufferPool.Put(buf)
+	for {
+		n, err := c.Read(*buf)
+		if n > 0 {
+			if perr := c.parser.Read((*buf)[:n]); perr != nil {
+				c.onError(perr)
+				return
+			}
+		}
+		if err == errTLSWouldBlock {
+			return
+		}
+		if err != nil {
+			// close_notify or a corrupted record
+			c.Close()
+			return
+		}
+	}
+}
+
+// PauseRead .
+func (c *TLSConn) PauseRead() error {
+	if pauser, ok := c.transport.Conn.(readPauser); ok {
+		return pauser.PauseRead()
+	}
+	return errors.ErrUnsupported
+}
+
+// ResumeRead .
+func (c *TLSConn) ResumeRead() error {
+	if pauser, ok := c.transport.Conn.(readPauser); ok {
+		return pauser.ResumeRead()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *TLSConn) bufferedWrites() int {
+	if bw, ok := c.transport.Conn.(bufferedWriter); ok {
+		return bw.bufferedWrites()
+	}
+	return 0
+}
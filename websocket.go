@@ -0,0 +1,581 @@
+package nbhttp
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/golang/net/http/httpguts"
+)
+
+const (
+	// DefaultWebsocketMaxMessageSize .
+	DefaultWebsocketMaxMessageSize = 1024 * 1024 * 4
+
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// MessageType is the opcode of a websocket frame.
+type MessageType int8
+
+// Message types, RFC 6455 section 5.2.
+const (
+	ContinuationMessage MessageType = 0
+	TextMessage         MessageType = 1
+	BinaryMessage       MessageType = 2
+	CloseMessage        MessageType = 8
+	PingMessage         MessageType = 9
+	PongMessage         MessageType = 10
+)
+
+// Close codes, RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+)
+
+// CloseError is the close code and reason of a websocket connection.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+// Error .
+func (e *CloseError) Error() string {
+	return "websocket: close " + strconv.Itoa(e.Code) + " " + e.Text
+}
+
+// WebsocketUpgrader upgrades the requests of a Server to websocket
+// connections, whose frames are then parsed by the pollers and delivered to
+// the callbacks.
+type WebsocketUpgrader struct {
+	// MaxMessageSize limits the size of a message, including all its
+	// fragments. Zero uses DefaultWebsocketMaxMessageSize and negative
+	// disables the limit.
+	MaxMessageSize int
+
+	// Subprotocols are the subprotocols supported by the server in order of
+	// preference.
+	Subprotocols []string
+
+	// CheckOrigin returns true if the request's Origin is accepted, nil
+	// accepts requests without Origin or whose Origin host is the Host.
+	CheckOrigin func(r *http.Request) bool
+
+	// OnOpen is called once the handshake response has been written.
+	OnOpen func(c *WebsocketConn)
+
+	// OnMessage is called with each complete text or binary message, data
+	// belongs to the callback.
+	OnMessage func(c *WebsocketConn, messageType MessageType, data []byte)
+
+	// OnPing and OnPong are called with the payload of the control frames,
+	// pings are answered before OnPing is called. data is only valid during
+	// the call.
+	OnPing func(c *WebsocketConn, data []byte)
+	OnPong func(c *WebsocketConn, data []byte)
+
+	// OnClose is called once the connection is closed, err is a *CloseError
+	// if a close frame has been received or sent.
+	OnClose func(c *WebsocketConn, err error)
+
+	// EnableCompression negotiates permessage-deflate, RFC 7692, when the
+	// client offers it.
+	EnableCompression bool
+
+	// CompressionLevel is the flate level of the messages sent, zero uses
+	// DefaultWebsocketCompressionLevel.
+	CompressionLevel int
+
+	// CompressionThreshold is the size below which messages are sent
+	// uncompressed, zero uses DefaultWebsocketCompressionThreshold and
+	// negative compresses every message.
+	CompressionThreshold int
+
+	// ServerNoContextTakeover compresses each message on its own, which
+	// costs some ratio but lets the compressors be shared between
+	// connections. It's also used when the client asks for it.
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover asks the client to compress each message on
+	// its own, so that no decompression window is kept per connection.
+	ClientNoContextTakeover bool
+
+	// ClientMaxWindowBits limits the window of the client's compressor, from
+	// 8 to 15, when the client supports it. Zero leaves it to the client.
+	ClientMaxWindowBits int
+}
+
+// Upgrade performs the websocket handshake of r, then switches the
+// connection from HTTP to websocket frames. On failure, an HTTP error has
+// been written to w.
+//
+// The callbacks are called on the poller's goroutine, a message may be
+// delivered before Upgrade returns if it was sent with the handshake.
+func (u *WebsocketUpgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*WebsocketConn, error) {
+	response, ok := w.(*Response)
+	if !ok {
+		return nil, ErrUpgradeNotSupported
+	}
+	if r.Method != http.MethodGet {
+		return nil, u.fail(w, http.StatusMethodNotAllowed, "method is not GET")
+	}
+	if !httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade") {
+		return nil, u.fail(w, http.StatusBadRequest, "'upgrade' token not found in 'Connection' header")
+	}
+	if !httpguts.HeaderValuesContainsToken(r.Header["Upgrade"], "websocket") {
+		return nil, u.fail(w, http.StatusBadRequest, "'websocket' token not found in 'Upgrade' header")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, u.fail(w, http.StatusUpgradeRequired, "unsupported version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, u.fail(w, http.StatusBadRequest, "invalid 'Sec-WebSocket-Key' header")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(r) {
+		return nil, u.fail(w, http.StatusForbidden, "origin not allowed")
+	}
+
+	c := &WebsocketConn{
+		conn:           response.processor.conn,
+		upgrader:       u,
+		subprotocol:    u.selectSubprotocol(r),
+		maxMessageSize: u.MaxMessageSize,
+	}
+	if c.maxMessageSize == 0 {
+		c.maxMessageSize = DefaultWebsocketMaxMessageSize
+	}
+
+	header := w.Header()
+	for k, vv := range responseHeader {
+		header[k] = vv
+	}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", websocketAccept(key))
+	if c.subprotocol != "" {
+		header.Set("Sec-WebSocket-Protocol", c.subprotocol)
+	}
+	if u.EnableCompression {
+		if d, ok := u.negotiateDeflate(r.Header["Sec-Websocket-Extensions"]); ok {
+			c.deflate = d
+			header.Set("Sec-WebSocket-Extensions", d.extension())
+		}
+	}
+	w.WriteHeader(http.StatusSwitchingProtocols)
+
+	if err := response.Upgrade(c); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	c.open()
+	return c, nil
+}
+
+func (u *WebsocketUpgrader) fail(w http.ResponseWriter, status int, reason string) error {
+	http.Error(w, http.StatusText(status), status)
+	return fmt.Errorf("%w: %s", ErrWebsocketBadHandshake, reason)
+}
+
+func (u *WebsocketUpgrader) selectSubprotocol(r *http.Request) string {
+	for _, supported := range u.Subprotocols {
+		for _, v := range r.Header["Sec-Websocket-Protocol"] {
+			for _, requested := range strings.Split(v, ",") {
+				if strings.TrimSpace(requested) == supported {
+					return supported
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header["Origin"]
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin[0])
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// WebsocketConn is a server side websocket connection, it implements
+// Upgrader to parse the frames read from the connection.
+type WebsocketConn struct {
+	conn           net.Conn
+	upgrader       *WebsocketUpgrader
+	subprotocol    string
+	maxMessageSize int
+	openOnce       sync.Once
+
+	// deflate is set if permessage-deflate has been negotiated
+	deflate *deflateState
+
+	// read state, only used by the parsing goroutine
+	buffer      []byte
+	message     []byte
+	messageType MessageType // type of the fragmented message being read
+	compressed  bool        // the fragmented message is compressed
+	readDone    bool        // a close frame has been received or sent on error
+
+	mux       sync.Mutex
+	closeSent bool
+	closeErr  error
+
+	session interface{}
+}
+
+func (c *WebsocketConn) open() {
+	c.openOnce.Do(func() {
+		if c.upgrader.OnOpen != nil {
+			c.upgrader.OnOpen(c)
+		}
+	})
+}
+
+// Read implements Upgrader.
+func (c *WebsocketConn) Read(p *Parser, data []byte) error {
+	c.open()
+	if c.readDone {
+		return nil
+	}
+
+	if len(c.buffer) > 0 {
+		data = append(c.buffer, data...)
+	}
+	for len(data) > 0 && !c.readDone {
+		n, err := c.parseFrame(data)
+		if err != nil {
+			c.buffer = nil
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+	}
+	// data may share the array of c.buffer, append copies it to the front
+	c.buffer = append(c.buffer[:0], data...)
+	return nil
+}
+
+// parseFrame handles the frame at the beginning of data, it returns 0 if
+// the frame is not complete.
+func (c *WebsocketConn) parseFrame(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	fin := data[0]&0x80 != 0
+	compressed := data[0]&0x40 != 0
+	opcode := MessageType(data[0] & 0x0f)
+	if data[0]&0x30 != 0 || (compressed && (c.deflate == nil || (opcode != TextMessage && opcode != BinaryMessage))) {
+		return 0, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if data[1]&0x80 == 0 {
+		return 0, c.fail(CloseProtocolError, "unmasked client frame")
+	}
+
+	offset := 2
+	length := uint64(data[1] & 0x7f)
+	switch length {
+	case 126:
+		if len(data) < 4 {
+			return 0, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(data[2:4]))
+		offset = 4
+	case 127:
+		if len(data) < 10 {
+			return 0, nil
+		}
+		length = binary.BigEndian.Uint64(data[2:10])
+		if length>>63 != 0 {
+			return 0, c.fail(CloseProtocolError, "invalid payload length")
+		}
+		offset = 10
+	}
+
+	if opcode >= CloseMessage {
+		if !fin {
+			return 0, c.fail(CloseProtocolError, "fragmented control frame")
+		}
+		if length > 125 {
+			return 0, c.fail(CloseProtocolError, "control frame too large")
+		}
+	} else if c.maxMessageSize > 0 && uint64(len(c.message))+length > uint64(c.maxMessageSize) {
+		return 0, c.fail(CloseMessageTooBig, "message too large")
+	}
+
+	if uint64(len(data)-offset) < 4+length {
+		return 0, nil
+	}
+	mask := data[offset : offset+4]
+	offset += 4
+	payload := data[offset : offset+int(length)]
+	maskBytes(mask, payload)
+
+	return offset + int(length), c.handleFrame(fin, opcode, compressed, payload)
+}
+
+func (c *WebsocketConn) handleFrame(fin bool, opcode MessageType, compressed bool, payload []byte) error {
+	switch opcode {
+	case ContinuationMessage:
+		if c.messageType == ContinuationMessage {
+			return c.fail(CloseProtocolError, "unexpected continuation frame")
+		}
+		c.message = append(c.message, payload...)
+		if fin {
+			messageType, message := c.messageType, c.message
+			c.messageType, c.message = ContinuationMessage, nil
+			return c.deliver(messageType, c.compressed, message)
+		}
+	case TextMessage, BinaryMessage:
+		if c.messageType != ContinuationMessage {
+			return c.fail(CloseProtocolError, "continuation frame expected")
+		}
+		if fin {
+			if compressed {
+				// decompressed into a new buffer
+				return c.deliver(opcode, true, payload)
+			}
+			return c.deliver(opcode, false, append([]byte(nil), payload...))
+		}
+		c.messageType = opcode
+		c.compressed = compressed
+		c.message = append([]byte(nil), payload...)
+	case CloseMessage:
+		return c.handleClose(payload)
+	case PingMessage:
+		if err := c.writeFrame(PongMessage, payload); err != nil && err != ErrWebsocketClosed {
+			return err
+		}
+		if c.upgrader.OnPing != nil {
+			c.upgrader.OnPing(c, payload)
+		}
+	case PongMessage:
+		if c.upgrader.OnPong != nil {
+			c.upgrader.OnPong(c, payload)
+		}
+	default:
+		return c.fail(CloseProtocolError, "unknown opcode "+strconv.Itoa(int(opcode)))
+	}
+	return nil
+}
+
+func (c *WebsocketConn) deliver(messageType MessageType, compressed bool, data []byte) error {
+	if compressed {
+		var err error
+		if data, err = c.deflate.decompress(data, c.maxMessageSize); err == errDeflateTooLarge {
+			return c.fail(CloseMessageTooBig, "message too large")
+		} else if err != nil {
+			return c.fail(CloseInvalidFramePayloadData, "invalid compressed message")
+		}
+	}
+	if messageType == TextMessage && !utf8.Valid(data) {
+		return c.fail(CloseInvalidFramePayloadData, "invalid UTF-8 in text message")
+	}
+	if c.upgrader.OnMessage != nil {
+		c.upgrader.OnMessage(c, messageType, data)
+	}
+	return nil
+}
+
+// handleClose answers a close frame and closes the connection.
+func (c *WebsocketConn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close payload")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		if !isValidCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.Valid(payload[2:]) {
+			return c.fail(CloseInvalidFramePayloadData, "invalid UTF-8 in close reason")
+		}
+		closeErr.Text = string(payload[2:])
+	}
+
+	c.readDone = true
+	c.mux.Lock()
+	if c.closeErr == nil {
+		c.closeErr = closeErr
+	}
+	c.mux.Unlock()
+	if closeErr.Code == CloseNoStatusReceived {
+		c.writeFrame(CloseMessage, nil)
+	} else {
+		c.writeFrame(CloseMessage, payload[:2])
+	}
+	return c.conn.Close()
+}
+
+// fail sends a close frame with code and returns the error that makes the
+// server close the connection.
+func (c *WebsocketConn) fail(code int, text string) error {
+	c.readDone = true
+	c.WriteClose(code, text)
+	return &CloseError{Code: code, Text: text}
+}
+
+func isValidCloseCode(code int) bool {
+	switch code {
+	case CloseNormalClosure, CloseGoingAway, CloseProtocolError, CloseUnsupportedData,
+		CloseInvalidFramePayloadData, ClosePolicyViolation, CloseMessageTooBig,
+		CloseMandatoryExtension, CloseInternalServerErr:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// onClose is called by the Parser when the connection has been closed.
+func (c *WebsocketConn) onClose(err error) {
+	c.mux.Lock()
+	c.closeSent = true
+	if c.closeErr != nil {
+		err = c.closeErr
+	} else {
+		err = &CloseError{Code: CloseAbnormalClosure, Text: fmt.Sprint(err)}
+	}
+	c.mux.Unlock()
+	if c.upgrader.OnClose != nil {
+		c.upgrader.OnClose(c, err)
+	}
+}
+
+// WriteMessage writes data as a single frame, control frames are limited
+// to 125 bytes.
+func (c *WebsocketConn) WriteMessage(messageType MessageType, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage:
+	case PingMessage, PongMessage:
+		if len(data) > 125 {
+			return ErrWebsocketInvalidMessage
+		}
+	default:
+		return ErrWebsocketInvalidMessage
+	}
+	return c.writeFrame(messageType, data)
+}
+
+// WriteClose sends a close frame with code and text, the connection is
+// closed when the peer answers it.
+func (c *WebsocketConn) WriteClose(code int, text string) error {
+	payload := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, text...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	c.mux.Lock()
+	if c.closeErr == nil {
+		c.closeErr = &CloseError{Code: code, Text: text}
+	}
+	c.mux.Unlock()
+	return c.writeFrame(CloseMessage, payload)
+}
+
+func (c *WebsocketConn) writeFrame(opcode MessageType, payload []byte) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closeSent {
+		return ErrWebsocketClosed
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	b0 := 0x80 | byte(opcode)
+	if c.deflate != nil && opcode < CloseMessage && len(payload) >= c.deflate.threshold {
+		payload = c.deflate.compress(payload)
+		b0 |= 0x40
+	}
+
+	length := len(payload)
+	frame := make([]byte, 0, 10+length)
+	frame = append(frame, b0)
+	switch {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	frame = append(frame, payload...)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close closes the connection without the closing handshake, see
+// WriteClose.
+func (c *WebsocketConn) Close() error {
+	return c.conn.Close()
+}
+
+// Subprotocol returns the negotiated subprotocol.
+func (c *WebsocketConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// LocalAddr .
+func (c *WebsocketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr .
+func (c *WebsocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Session returns user session
+func (c *WebsocketConn) Session() interface{} {
+	return c.session
+}
+
+// SetSession sets user session
+func (c *WebsocketConn) SetSession(session interface{}) {
+	c.session = session
+}
+
+func maskBytes(mask []byte, data []byte) {
+	for i := range data {
+		data[i] ^= mask[i&3]
+	}
+}
@@ -0,0 +1,241 @@
+package nbhttp
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultWebsocketCompressionLevel .
+	DefaultWebsocketCompressionLevel = flate.BestSpeed
+
+	// DefaultWebsocketCompressionThreshold .
+	DefaultWebsocketCompressionThreshold = 256
+
+	deflateWindowSize = 1 << 15
+)
+
+var (
+	// deflateTail ends a message with the sync flush marker removed by the
+	// sender, then with an empty final block so that the reader gets io.EOF.
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+	errDeflateTooLarge = errors.New("websocket: decompressed message too large")
+
+	flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+	flateReaderPool  sync.Pool
+)
+
+// deflateState is the permessage-deflate state of a WebsocketConn. The
+// compressor is only used with the connection's write lock held, the
+// decompressor only by the parsing goroutine.
+type deflateState struct {
+	level     int
+	threshold int
+
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	clientMaxWindowBits     int // sent in the response if not zero
+
+	writer      *flate.Writer
+	writeBuffer bytes.Buffer
+
+	reader io.ReadCloser
+	dict   []byte // last decompressed bytes, with client context takeover
+}
+
+// negotiateDeflate accepts the first permessage-deflate offer of the
+// Sec-WebSocket-Extensions headers that can be honored.
+func (u *WebsocketUpgrader) negotiateDeflate(values []string) (*deflateState, bool) {
+	for _, v := range values {
+		for _, offer := range strings.Split(v, ",") {
+			if d, ok := u.acceptDeflateOffer(offer); ok {
+				return d, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (u *WebsocketUpgrader) acceptDeflateOffer(offer string) (*deflateState, bool) {
+	params := strings.Split(offer, ";")
+	if strings.TrimSpace(params[0]) != "permessage-deflate" {
+		return nil, false
+	}
+
+	d := &deflateState{
+		level:                   u.CompressionLevel,
+		threshold:               u.CompressionThreshold,
+		serverNoContextTakeover: u.ServerNoContextTakeover,
+		clientNoContextTakeover: u.ClientNoContextTakeover,
+	}
+	if d.level == 0 || d.level < flate.HuffmanOnly || d.level > flate.BestCompression {
+		d.level = DefaultWebsocketCompressionLevel
+	}
+	if d.threshold == 0 {
+		d.threshold = DefaultWebsocketCompressionThreshold
+	}
+
+	seen := map[string]bool{}
+	clientMaxWindowBits := 0
+	for _, param := range params[1:] {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(param), "=")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[name] {
+			return nil, false
+		}
+		seen[name] = true
+
+		switch name {
+		case "server_no_context_takeover":
+			if hasValue {
+				return nil, false
+			}
+			d.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if hasValue {
+				return nil, false
+			}
+			d.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			// compress/flate always uses a 32KB window
+			if bits, ok := parseWindowBits(value); !ok || bits != 15 {
+				return nil, false
+			}
+		case "client_max_window_bits":
+			clientMaxWindowBits = 15
+			if hasValue {
+				bits, ok := parseWindowBits(value)
+				if !ok {
+					return nil, false
+				}
+				clientMaxWindowBits = bits
+			}
+		default:
+			return nil, false
+		}
+	}
+	// any client window can be decompressed, it's only limited on request
+	if clientMaxWindowBits > 0 && u.ClientMaxWindowBits >= 8 && u.ClientMaxWindowBits <= 15 {
+		d.clientMaxWindowBits = u.ClientMaxWindowBits
+		if clientMaxWindowBits < d.clientMaxWindowBits {
+			d.clientMaxWindowBits = clientMaxWindowBits
+		}
+	}
+	return d, true
+}
+
+func parseWindowBits(value string) (int, bool) {
+	bits, err := strconv.Atoi(value)
+	return bits, err == nil && bits >= 8 && bits <= 15
+}
+
+// extension returns the Sec-WebSocket-Extensions header of the response.
+func (d *deflateState) extension() string {
+	s := "permessage-deflate"
+	if d.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if d.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if d.clientMaxWindowBits > 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(d.clientMaxWindowBits)
+	}
+	return s
+}
+
+// compress returns the payload of a compressed message, it's only valid
+// until the next call.
+func (d *deflateState) compress(data []byte) []byte {
+	d.writeBuffer.Reset()
+	w := d.writer
+	if d.serverNoContextTakeover {
+		w = getFlateWriter(&d.writeBuffer, d.level)
+		defer putFlateWriter(w, d.level)
+	} else if w == nil {
+		w, _ = flate.NewWriter(&d.writeBuffer, d.level)
+		d.writer = w
+	}
+	w.Write(data)
+	w.Flush()
+	// remove the 0x00 0x00 0xff 0xff of the sync flush
+	out := d.writeBuffer.Bytes()
+	return out[:len(out)-4]
+}
+
+// decompress returns the decompressed message, errDeflateTooLarge if it
+// exceeds maxSize.
+func (d *deflateState) decompress(data []byte, maxSize int) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail))
+	var r io.ReadCloser
+	if d.clientNoContextTakeover {
+		r = getFlateReader(src)
+		defer putFlateReader(r)
+	} else {
+		if d.reader == nil {
+			d.reader = flate.NewReaderDict(src, d.dict)
+		} else {
+			d.reader.(flate.Resetter).Reset(src, d.dict)
+		}
+		r = d.reader
+	}
+
+	var out []byte
+	var err error
+	if maxSize > 0 {
+		out, err = io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+		if err == nil && len(out) > maxSize {
+			err = errDeflateTooLarge
+		}
+	} else {
+		out, err = io.ReadAll(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.clientNoContextTakeover {
+		d.dict = append(d.dict, out...)
+		if len(d.dict) > deflateWindowSize {
+			copy(d.dict, d.dict[len(d.dict)-deflateWindowSize:])
+			d.dict = d.dict[:deflateWindowSize]
+		}
+	}
+	return out, nil
+}
+
+func getFlateWriter(w io.Writer, level int) *flate.Writer {
+	if v := flateWriterPools[level-flate.HuffmanOnly].Get(); v != nil {
+		fw := v.(*flate.Writer)
+		fw.Reset(w)
+		return fw
+	}
+	fw, _ := flate.NewWriter(w, level)
+	return fw
+}
+
+func putFlateWriter(fw *flate.Writer, level int) {
+	fw.Reset(io.Discard)
+	flateWriterPools[level-flate.HuffmanOnly].Put(fw)
+}
+
+func getFlateReader(src io.Reader) io.ReadCloser {
+	if v := flateReaderPool.Get(); v != nil {
+		fr := v.(io.ReadCloser)
+		fr.(flate.Resetter).Reset(src, nil)
+		return fr
+	}
+	return flate.NewReader(src)
+}
+
+func putFlateReader(fr io.ReadCloser) {
+	fr.(flate.Resetter).Reset(bytes.NewReader(nil), nil)
+	flateReaderPool.Put(fr)
+}
@@ -0,0 +1,309 @@
+package nbhttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFrame(t *testing.T, conn net.Conn, fin bool, opcode MessageType, payload []byte, masked bool) {
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	var b1 byte
+	if masked {
+		b1 = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, b1|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, b1|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, b1|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	data := append([]byte(nil), payload...)
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		maskBytes(mask, data)
+	}
+	frame = append(frame, data...)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFrame(t *testing.T, reader *bufio.Reader) (MessageType, []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		io.ReadFull(reader, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		io.ReadFull(reader, ext)
+		length = int(binary.BigEndian.Uint64(ext))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return MessageType(header[0] & 0x0f), payload
+}
+
+func dialTestWebsocket(t *testing.T, addr string, handshake string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if handshake == "" {
+		handshake = "GET /ws HTTP/1.1\r\nHost: " + addr + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Protocol: chat, echo\r\n\r\n"
+	}
+	conn.Write([]byte(handshake))
+	return conn, bufio.NewReader(conn)
+}
+
+func newTestWebsocketServer(t *testing.T, executor Executor, upgrader *WebsocketUpgrader) (*Server, string) {
+	svr, _ := newTestServerWithExecutor(t, executor, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader.Upgrade(w, r, nil)
+	}))
+	return svr, svr.Addr()[0].String()
+}
+
+func TestWebsocket(t *testing.T) {
+	for _, executor := range []Executor{nil, GoExecutor} {
+		closed := make(chan error, 1)
+		upgrader := &WebsocketUpgrader{
+			Subprotocols: []string{"echo"},
+			OnMessage: func(c *WebsocketConn, messageType MessageType, data []byte) {
+				c.WriteMessage(messageType, data)
+			},
+			OnClose: func(c *WebsocketConn, err error) {
+				closed <- err
+			},
+		}
+		svr, addr := newTestWebsocketServer(t, executor, upgrader)
+
+		conn, reader := dialTestWebsocket(t, addr, "")
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusSwitchingProtocols ||
+			res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" ||
+			res.Header.Get("Sec-WebSocket-Protocol") != "echo" {
+			t.Fatalf("invalid handshake response: %v %v", res.StatusCode, res.Header)
+		}
+
+		writeTestFrame(t, conn, true, TextMessage, []byte("hello"), true)
+		if mt, data := readTestFrame(t, reader); mt != TextMessage || string(data) != "hello" {
+			t.Fatalf("invalid message: %v %q", mt, data)
+		}
+
+		// fragmented message interleaved with a ping
+		big := make([]byte, 70000)
+		for i := range big {
+			big[i] = byte(i)
+		}
+		writeTestFrame(t, conn, false, BinaryMessage, big[:100], true)
+		writeTestFrame(t, conn, true, PingMessage, []byte("ping"), true)
+		writeTestFrame(t, conn, false, ContinuationMessage, big[100:1000], true)
+		writeTestFrame(t, conn, true, ContinuationMessage, big[1000:], true)
+		if mt, data := readTestFrame(t, reader); mt != PongMessage || string(data) != "ping" {
+			t.Fatalf("invalid pong: %v %q", mt, data)
+		}
+		if mt, data := readTestFrame(t, reader); mt != BinaryMessage || string(data) != string(big) {
+			t.Fatalf("invalid fragmented message: %v %v", mt, len(data))
+		}
+
+		payload := binary.BigEndian.AppendUint16(nil, CloseNormalClosure)
+		writeTestFrame(t, conn, true, CloseMessage, append(payload, "bye"...), true)
+		if mt, data := readTestFrame(t, reader); mt != CloseMessage || binary.BigEndian.Uint16(data) != CloseNormalClosure {
+			t.Fatalf("invalid close: %v %v", mt, data)
+		}
+		if err, ok := (<-closed).(*CloseError); !ok || err.Code != CloseNormalClosure || err.Text != "bye" {
+			t.Fatalf("invalid close error: %v", err)
+		}
+		conn.Close()
+		svr.Stop()
+	}
+}
+
+func TestWebsocketErrors(t *testing.T) {
+	upgrader := &WebsocketUpgrader{MaxMessageSize: 1024}
+	svr, addr := newTestWebsocketServer(t, nil, upgrader)
+	defer svr.Stop()
+
+	conn, reader := dialTestWebsocket(t, addr, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("invalid status code: %v", res.StatusCode)
+	}
+	conn.Close()
+
+	tests := []struct {
+		fin     bool
+		opcode  MessageType
+		payload []byte
+		masked  bool
+		code    int
+	}{
+		{true, TextMessage, []byte("hello"), false, CloseProtocolError},
+		{true, BinaryMessage, make([]byte, 2048), true, CloseMessageTooBig},
+		{true, TextMessage, []byte{0xff, 0xfe}, true, CloseInvalidFramePayloadData},
+		{false, PingMessage, nil, true, CloseProtocolError},
+		{true, ContinuationMessage, []byte("x"), true, CloseProtocolError},
+		{true, MessageType(3), nil, true, CloseProtocolError},
+	}
+	for i, test := range tests {
+		conn, reader := dialTestWebsocket(t, addr, "")
+		if _, err := http.ReadResponse(reader, nil); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFrame(t, conn, test.fin, test.opcode, test.payload, test.masked)
+		mt, data := readTestFrame(t, reader)
+		if mt != CloseMessage || len(data) < 2 || int(binary.BigEndian.Uint16(data)) != test.code {
+			t.Fatalf("%v: invalid close: %v %v", i, mt, data)
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatalf("%v: connection not closed: %v", i, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebsocketCompression(t *testing.T) {
+	tests := []struct {
+		offer     string
+		upgrader  WebsocketUpgrader
+		extension string
+	}{
+		{"permessage-deflate; client_max_window_bits", WebsocketUpgrader{ClientMaxWindowBits: 10},
+			"permessage-deflate; client_max_window_bits=10"},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate; server_no_context_takeover", WebsocketUpgrader{},
+			"permessage-deflate; server_no_context_takeover"},
+		{"permessage-deflate", WebsocketUpgrader{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{"permessage-deflate; unknown", WebsocketUpgrader{}, ""},
+	}
+	for i, test := range tests {
+		received := make(chan string, 4)
+		upgrader := test.upgrader
+		upgrader.EnableCompression = true
+		upgrader.CompressionThreshold = 10
+		upgrader.OnMessage = func(c *WebsocketConn, messageType MessageType, data []byte) {
+			received <- string(data)
+			c.WriteMessage(messageType, data)
+		}
+		svr, addr := newTestWebsocketServer(t, nil, &upgrader)
+
+		conn, reader := dialTestWebsocket(t, addr, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Extensions: "+test.offer+"\r\n\r\n")
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ext := res.Header.Get("Sec-WebSocket-Extensions"); ext != test.extension {
+			t.Fatalf("%v: invalid extension: %q, expected %q", i, ext, test.extension)
+		}
+		if test.extension == "" {
+			conn.Close()
+			svr.Stop()
+			continue
+		}
+
+		var compressed bytes.Buffer
+		fw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+		var dict []byte
+		for _, message := range []string{"short", strings.Repeat("hello websocket ", 100), strings.Repeat("hello websocket ", 100)} {
+			compressed.Reset()
+			if strings.Contains(test.extension, "client_no_context_takeover") {
+				fw.Reset(&compressed)
+			}
+			fw.Write([]byte(message))
+			fw.Flush()
+			payload := compressed.Bytes()[:compressed.Len()-4]
+
+			frame := []byte{0x80 | 0x40 | byte(TextMessage)}
+			writeTestFrameHeader := func(n int) {
+				if n <= 125 {
+					frame = append(frame, 0x80|byte(n))
+				} else {
+					frame = append(frame, 0x80|126)
+					frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+				}
+			}
+			writeTestFrameHeader(len(payload))
+			mask := []byte{5, 6, 7, 8}
+			frame = append(frame, mask...)
+			masked := append([]byte(nil), payload...)
+			maskBytes(mask, masked)
+			conn.Write(append(frame, masked...))
+
+			select {
+			case got := <-received:
+				if got != message {
+					t.Fatalf("%v: invalid message: %q", i, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%v: message not received", i)
+			}
+
+			header := make([]byte, 2)
+			io.ReadFull(reader, header)
+			n := int(header[1] & 0x7f)
+			if n == 126 {
+				ext := make([]byte, 2)
+				io.ReadFull(reader, ext)
+				n = int(binary.BigEndian.Uint16(ext))
+			}
+			data := make([]byte, n)
+			io.ReadFull(reader, data)
+			if len(message) < 10 {
+				if header[0]&0x40 != 0 || string(data) != message {
+					t.Fatalf("%v: short message compressed: %x", i, header[0])
+				}
+				continue
+			}
+			if header[0]&0x40 == 0 {
+				t.Fatalf("%v: message not compressed", i)
+			}
+			if n >= len(message) {
+				t.Fatalf("%v: bad compression: %v", i, n)
+			}
+			fr := flate.NewReaderDict(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail)), dict)
+			out, err := io.ReadAll(fr)
+			if err != nil || string(out) != message {
+				t.Fatalf("%v: invalid compressed response: %v", i, err)
+			}
+			if !strings.Contains(test.extension, "server_no_context_takeover") {
+				dict = append(dict, out...)
+			}
+		}
+		conn.Close()
+		svr.Stop()
+	}
+}